@@ -2,287 +2,463 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
 	"strings"
-	"sync"
-	"time"
 
 	"backup/domain"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 const (
-	dryrunSampleFileListLength = 25
-	awsRegionUSEast1           = "us-east-1"
+	awsRegionUSEast1 = "us-east-1"
+
+	//s3DeleteBatchSize is the most objects a single DeleteObjects request may delete
+	s3DeleteBatchSize = 1000
 )
 
-//this map maps the simple region (eg "us-east-2") to a an enumerated type in the Go SDK. It would appear
-//setting region in the s3Client is not enough. Extend this map to handle other regions EXCEPT "us-east-1"
-//which acts as kind of a catch-all region where no such specification is required
-var awsRegionToLocationConstraintMap = map[string]s3types.BucketLocationConstraint{
-	"us-east-2": s3types.BucketLocationConstraintUsEast2,
+//s3Storage is the AWS S3 implementation of domain.Storage
+type s3Storage struct {
+	client *s3.Client
+	region string
 }
 
-//wtop-level function to setup AWS bucket and kickoff file writing
-func writeObjectsToAws(appConfig domain.Config, objectsList []*domain.FileInfo) error {
-
-	//create a context to use with all AWS calls
-	ctx := context.Background()
+//creates an S3-backed storage using the configured profile and region. A custom endpoint points the client at an
+//S3-compatible service (MinIO, Ceph RGW, Wasabi etc) instead of AWS
+func newS3Storage(ctx context.Context, appConfig domain.Config) (*s3Storage, error) {
 
-	//S3 config uses credentials and named profile from $HOME/.aws directory
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithSharedConfigProfile(appConfig.AwsProfile()),
-		config.WithRegion(appConfig.Region()))
+	//S3 config uses credentials and named profile from $HOME/.aws directory. Without a profile the SDK's usual
+	//credential chain applies (eg the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables)
+	opts := []func(*config.LoadOptions) error{config.WithRegion(appConfig.Region())}
+	if appConfig.AwsProfile() != "" {
+		opts = append(opts, config.WithSharedConfigProfile(appConfig.AwsProfile()))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
-		return fmt.Errorf("AWS config failed: %v", err)
+		return nil, fmt.Errorf("AWS config failed: %v", err)
 	}
-	s3Client := s3.NewFromConfig(cfg)
 
-	//do things differently on a dryrun
-	if appConfig.Dryrun() {
-		return handleDryrun(ctx, s3Client, appConfig, objectsList)
-	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if appConfig.S3Endpoint() != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(appConfig.S3Endpoint())
+		}
+		o.UsePathStyle = appConfig.S3PathStyle()
+	})
 
-	//prepare to create the bucket in the current region. Deal with AWS not respecting the region in the Client
-	//and the fact that us-east-1 is a default that does not use the LocationConstraint mechanism. Fun!
-	bucket := appConfig.Bucket()
-	region := appConfig.Region()
-	cbInput := &s3.CreateBucketInput{
-		Bucket: &bucket,
-	}
+	return &s3Storage{
+		client: client,
+		region: appConfig.Region(),
+	}, nil
+}
 
-	if region != awsRegionUSEast1 {
-		//look up the location constraint based on the region we are using
-		locationConstraint, found := awsRegionToLocationConstraintMap[appConfig.Region()]
-		if !found {
-			return fmt.Errorf("no coorisponding LocationConstraint for region: %s. Extend the map in aws.go", appConfig.Region())
-		}
-		cbInput.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{LocationConstraint: locationConstraint}
-	}
+//Name returns the name of this storage backend
+func (s *s3Storage) Name() string {
+	return "s3"
+}
 
-	//actually create the bucket
-	_, err = s3Client.CreateBucket(ctx, cbInput)
+//ListContainers lists all buckets owned by the caller
+func (s *s3Storage) ListContainers(ctx context.Context) ([]string, error) {
+	lbOutput, err := s.client.ListBuckets(ctx, &s3.ListBucketsInput{})
 	if err != nil {
-		return fmt.Errorf("unable to create bucket: %s error: %v", bucket, err)
+		return nil, err
 	}
 
-	appConfig.Logger().Infow("bucket created successfully", "bucketName", bucket, "region", region, "meta", domain.Aws)
-
-	//actually write the objects to s3
-	writeAllObjectsToS3(ctx, s3Client, appConfig, objectsList)
+	names := make([]string, 0, len(lbOutput.Buckets))
+	for _, b := range lbOutput.Buckets {
+		names = append(names, *b.Name)
+	}
+	return names, nil
+}
 
-	return nil
+//ContainerExists checks for a bucket with HeadBucket, which unlike listing every bucket only needs rights to the
+//bucket itself
+func (s *s3Storage) ContainerExists(ctx context.Context, container string) (bool, error) {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &container,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
-//manages multithreaded approach to sending files to S3
-func writeAllObjectsToS3(ctx context.Context, s3Client *s3.Client, appConfig domain.Config, objectsList []*domain.FileInfo) {
-	logger := appConfig.Logger()
-	defer logger.Sync()
+//CreateContainer creates a bucket in the configured region
+func (s *s3Storage) CreateContainer(ctx context.Context, container string) error {
 
-	logger.Infow("preparing to store objects", "storageRoutineCount", appConfig.HashRoutinesCount(), "meta", domain.Chat)
-	storeStart := time.Now()
+	//prepare to create the bucket in the current region. Deal with AWS not respecting the region in the Client
+	//and the fact that us-east-1 is a default that does not use the LocationConstraint mechanism. Fun! Every other
+	//region's location constraint is simply its name
+	cbInput := &s3.CreateBucketInput{
+		Bucket: &container,
+	}
 
-	//the channel that will carry all data to the routines - size it to handle the data we will put in
-	channel := make(chan *domain.FileInfo, len(objectsList))
+	if s.region != awsRegionUSEast1 {
+		cbInput.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(s.region),
+		}
+	}
 
-	//load the channel with objects to process
-	for _, fi := range objectsList {
+	_, err := s.client.CreateBucket(ctx, cbInput)
+	return err
+}
 
-		//do not attempt to store files that have not been / were not successfully hashed
-		if !fi.HashSuccess {
-			logger.Infow("skipping un-hashed file", "path", fi.FullName, "meta", domain.Aws)
-			continue
+//ConfigureContainer applies versioning, default encryption, a public access block, tags and lifecycle rules to a
+//bucket. Only the settings that are enabled are applied
+func (s *s3Storage) ConfigureContainer(ctx context.Context, container string, settings *domain.BucketSettings, tags map[string]string) error {
+	if settings.Versioning {
+		_, err := s.client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  &container,
+			VersioningConfiguration: &s3types.VersioningConfiguration{Status: s3types.BucketVersioningStatusEnabled},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning: %v", err)
 		}
-		channel <- fi
 	}
 
-	//close the channel so all consumers know when the work is done
-	close(channel)
+	if settings.Encryption != "" {
+		byDefault := &s3types.ServerSideEncryptionByDefault{SSEAlgorithm: s3types.ServerSideEncryptionAes256}
+		if settings.Encryption == domain.BucketEncryptionKMS {
+			byDefault.SSEAlgorithm = s3types.ServerSideEncryptionAwsKms
+			if settings.KmsKeyId != "" {
+				byDefault.KMSMasterKeyID = &settings.KmsKeyId
+			}
+		}
 
-	//launch multiple go routines to store the objects. use waitgroup to halt main thread until all
-	//routines are finished
-	var wg sync.WaitGroup
-	for i := 0; i < appConfig.StorageRoutinesCount(); i++ {
-		wg.Add(1)
-		go storeFilesInChannel(ctx, s3Client, appConfig, objectsList, channel, &wg)
+		//a bucket key saves a KMS request per object
+		_, err := s.client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: &container,
+			ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
+				Rules: []s3types.ServerSideEncryptionRule{{
+					ApplyServerSideEncryptionByDefault: byDefault,
+					BucketKeyEnabled:                   settings.Encryption == domain.BucketEncryptionKMS,
+				}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set default encryption: %v", err)
+		}
 	}
 
-	logger.Infow("waiting for storing to complete...", "meta", domain.Chat)
-	wg.Wait()
+	if settings.BlockPublicAccess {
+		_, err := s.client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+			Bucket: &container,
+			PublicAccessBlockConfiguration: &s3types.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       true,
+				BlockPublicPolicy:     true,
+				IgnorePublicAcls:      true,
+				RestrictPublicBuckets: true,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to block public access: %v", err)
+		}
+	}
 
-	storeTime := prettyTime(time.Since(storeStart))
-	logger.Infow("storing is complete", "totalTime", storeTime, "meta", domain.Stat)
-}
+	if len(tags) > 0 {
+		tagSet := make([]s3types.Tag, 0, len(tags))
+		for k, v := range tags {
+			key, value := k, v
+			tagSet = append(tagSet, s3types.Tag{Key: &key, Value: &value})
+		}
+		_, err := s.client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+			Bucket:  &container,
+			Tagging: &s3types.Tagging{TagSet: tagSet},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag bucket: %v", err)
+		}
+	}
 
-//routine to read files from channel and store to S3.
-func storeFilesInChannel(ctx context.Context, s3Client *s3.Client, appConfig domain.Config, objectsList []*domain.FileInfo, ch chan *domain.FileInfo, wg *sync.WaitGroup) {
-	logger := appConfig.Logger()
-	defer logger.Sync()
-	defer wg.Done()
+	if settings.HasLifecycle() {
+		_, err := s.client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 &container,
+			LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{Rules: []s3types.LifecycleRule{lifecycleRule(settings)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set lifecycle rules: %v", err)
+		}
+	}
+	return nil
+}
 
-	//track file and storaged-related errors and shut down this routine if excessive errors occur
-	//this is just a quick failure in case there is a systemic problem somewhere - it allows
-	//the routine to give up under the assumption that a systemic issue will cause all other
-	//routines issues as well and there is no sense in continuing to try to open ~25-50K files
-	//under such circumstances
-	errCount := 0
-	maxAllowedErrors := appConfig.MaxStorageChannelErrorCount()
+//builds a single lifecycle rule covering every object in a bucket. Settings validation keeps transition and expiration
+//away from fixed buckets, whose objects outlive any one run
+func lifecycleRule(settings *domain.BucketSettings) s3types.LifecycleRule {
+	id := "backup"
+	rule := s3types.LifecycleRule{
+		ID:     &id,
+		Status: s3types.ExpirationStatusEnabled,
+		Filter: &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+	}
+	if settings.TransitionDays > 0 {
+		rule.Transitions = []s3types.Transition{{
+			Days:         int32(settings.TransitionDays),
+			StorageClass: s3types.TransitionStorageClass(settings.TransitionStorageClass),
+		}}
+	}
 
-	filesProcessed := 0
-	for fi := range ch {
+	//with versioning on, expiring an object only hides it - the noncurrent version must expire too
+	if settings.ExpirationDays > 0 {
+		rule.Expiration = &s3types.LifecycleExpiration{Days: int32(settings.ExpirationDays)}
+		if settings.Versioning {
+			rule.NoncurrentVersionExpiration = &s3types.NoncurrentVersionExpiration{NoncurrentDays: int32(settings.ExpirationDays)}
+		}
+	}
+	if settings.AbortIncompleteUploadDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &s3types.AbortIncompleteMultipartUpload{DaysAfterInitiation: int32(settings.AbortIncompleteUploadDays)}
+	}
+	return rule
+}
 
-		filesProcessed++
-		filename := fi.FullName
+//PutObject stores a single object. S3 rejects the object if the body does not match ContentMD5
+func (s *s3Storage) PutObject(ctx context.Context, req *domain.PutObjectRequest) error {
+	poi := &s3.PutObjectInput{
+		Bucket:     &req.Container,
+		Key:        &req.Key,
+		Body:       req.Body,
+		ContentMD5: &req.ContentMD5,
+		Metadata:   req.Metadata,
+	}
+	if req.StorageClass != "" {
+		poi.StorageClass = s3types.StorageClass(req.StorageClass)
+	}
 
-		//open the file
-		f, err := os.Open(filename)
-		if err != nil {
-			errCount++
-			logger.Errorw("failed to open file for storage", "path", fi.FullName, "err", err, "meta", domain.Err)
-			fi.StorageSuccess = false
-		} else {
-
-			//prep the call to AWS s3
-			bucket := appConfig.Bucket()
-			key := toKey(filename)
-			poi := &s3.PutObjectInput{
-				Bucket:     &bucket,
-				Key:        &key,
-				Body:       f,
-				ContentMD5: &fi.Hash,
-			}
+	_, err := s.client.PutObject(ctx, poi)
+	return err
+}
 
-			//retry AWS a few times using a 2^n exponential backoff where n is
-			//the number of failures that have happened for this file
-			storageErrorCount := 0
-			var storageErr error
-			allowedStorageAttempts := appConfig.StorageRetryCount()
-			if allowedStorageAttempts <= 0 {
-				allowedStorageAttempts = 1
-			}
+//HeadObject fetches the details of a single object
+func (s *s3Storage) HeadObject(ctx context.Context, container string, key string) (*domain.ObjectInfo, error) {
+	hoOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &container,
+		Key:    &key,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+			return nil, fmt.Errorf("%w: %s/%s", domain.ErrObjectNotFound, container, key)
+		}
+		return nil, err
+	}
 
-			//while we have not hit our max error threshold, attempt a send to S3
-			for storageErrorCount < allowedStorageAttempts {
-
-				//send to S3
-				_, storageErr = s3Client.PutObject(ctx, poi)
-
-				//storage error
-				if storageErr != nil {
-
-					//increase failure count
-					storageErrorCount++
-					logger.Debugw("putObject attempt failed", "path", filename, "failCount", storageErrorCount, "meta", domain.Aws)
-
-					//give up & leave retry loop - no sense in mucking about with retries, we have failed
-					if storageErrorCount >= allowedStorageAttempts {
-						break
-					}
-
-					//a retry is possible - calculate a backoff delay
-					backoffDuration, err := calcBackoff(storageErrorCount)
-					if err != nil { //failed to parse the duration - should not happen, right? Right?
-						logger.Errorw("unable to calculate backoff duration", "err", err, "meta", domain.Err)
-					} else {
-						time.Sleep(backoffDuration) //sleep this thread and retry
-						f.Seek(0, 0)                //move file pointer back to head of file. Needed? Not sure yet.
-					}
-				} else { //storage success, leave the retry loop
-					break
-				}
-			}
+	return &domain.ObjectInfo{
+		Key:      key,
+		Size:     hoOutput.ContentLength,
+		ETag:     trimETag(hoOutput.ETag),
+		Metadata: hoOutput.Metadata,
+	}, nil
+}
 
-			//we still failed after retries, mark this as a true failure
-			if storageErr != nil {
-				errCount++
-				logger.Errorw("failed to store file after exhausting retries", "path", filename, "err", storageErr, "meta", domain.Err)
-				fi.StorageSuccess = false
-			} else {
-				fi.StorageSuccess = true
-			}
+//ListObjects lists every object in a bucket that begins with prefix, following continuation tokens as needed
+func (s *s3Storage) ListObjects(ctx context.Context, container string, prefix string) ([]*domain.ObjectInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &container,
+	}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
 
-			err := f.Close()
-			if err != nil {
-				logger.Warnw("failed to close file after storing", "path", fi.FullName, "meta", domain.Aws)
-			}
+	objects := make([]*domain.ObjectInfo, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
 		}
+		for _, o := range page.Contents {
+			objects = append(objects, &domain.ObjectInfo{
+				Key:  *o.Key,
+				Size: o.Size,
+				ETag: trimETag(o.ETag),
+			})
+		}
+	}
+	return objects, nil
+}
 
-		//exit on excessive errors
-		if errCount > maxAllowedErrors {
-			logger.Errorw("storage routine exceeded max error count. Shutting it down", "maxAllowedErrors", maxAllowedErrors, "meta", domain.Aws)
-			break
+//GetObject opens a single object for reading
+func (s *s3Storage) GetObject(ctx context.Context, container string, key string) (io.ReadCloser, *domain.ObjectInfo, error) {
+	goOutput, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &container,
+		Key:    &key,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, nil, fmt.Errorf("%w: %s/%s", domain.ErrObjectNotFound, container, key)
 		}
 
-		//note each 100 files this routine handles
-		if filesProcessed == 100 {
-			logger.Debugw("a storage routine has processed 100 files", "meta", domain.Chat)
-			filesProcessed = 0
+		//GLACIER and DEEP_ARCHIVE objects can only be read once a RestoreObject request has brought back a copy
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidObjectState" {
+			return nil, nil, fmt.Errorf("%w: %s/%s", domain.ErrObjectArchived, container, key)
 		}
+		return nil, nil, err
+	}
 
+	return goOutput.Body, &domain.ObjectInfo{
+		Key:      key,
+		Size:     goOutput.ContentLength,
+		ETag:     trimETag(goOutput.ETag),
+		Metadata: goOutput.Metadata,
+	}, nil
+}
+
+//CreateMultipartUpload begins an object that is stored in parts
+func (s *s3Storage) CreateMultipartUpload(ctx context.Context, req *domain.PutObjectRequest) (*domain.MultipartUpload, error) {
+	cmuOutput, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       &req.Container,
+		Key:          &req.Key,
+		Metadata:     req.Metadata,
+		StorageClass: s3types.StorageClass(req.StorageClass),
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	return &domain.MultipartUpload{
+		Container: req.Container,
+		Key:       req.Key,
+		UploadId:  *cmuOutput.UploadId,
+	}, nil
 }
 
-//critical function here - change a win file name (eg E:\\foo\\bar) into something S3 will use to build folders in the console (E:->foo->bar)
-func toKey(filename string) string {
-	return strings.ReplaceAll(filename, "\\", "/")
+//UploadPart stores one part of a multipart upload. S3 rejects the part if the body does not match ContentMD5
+func (s *s3Storage) UploadPart(ctx context.Context, upload *domain.MultipartUpload, part *domain.UploadPartRequest) (string, error) {
+	upOutput, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     &upload.Container,
+		Key:        &upload.Key,
+		UploadId:   &upload.UploadId,
+		PartNumber: part.PartNumber,
+		Body:       part.Body,
+		ContentMD5: &part.ContentMD5,
+	})
+	if err != nil {
+		return "", err
+	}
+	return trimETag(upOutput.ETag), nil
 }
 
-//manages a dryrun from an AWS perspective
-func handleDryrun(ctx context.Context, s3Client *s3.Client, appConfig domain.Config, objectsList []*domain.FileInfo) error {
-	logger := appConfig.Logger()
-	defer logger.Sync()
+//CompleteMultipartUpload asks S3 to assemble the uploaded parts into the object
+func (s *s3Storage) CompleteMultipartUpload(ctx context.Context, upload *domain.MultipartUpload, parts []*domain.CompletedPart) error {
+	completed := make([]s3types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		etag := p.ETag
+		completed = append(completed, s3types.CompletedPart{
+			ETag:       &etag,
+			PartNumber: p.PartNumber,
+		})
+	}
 
-	logger.Infow("beginning AWS dryrun...", "meta", domain.Chat)
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &upload.Container,
+		Key:             &upload.Key,
+		UploadId:        &upload.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
 
-	var sb strings.Builder
+//AbortMultipartUpload discards an incomplete upload so its parts are no longer stored (or billed)
+func (s *s3Storage) AbortMultipartUpload(ctx context.Context, upload *domain.MultipartUpload) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &upload.Container,
+		Key:      &upload.Key,
+		UploadId: &upload.UploadId,
+	})
+	return err
+}
 
-	//config dump
-	sb.WriteString("\n")
-	sb.WriteString("Current Configuration\n")
-	sb.WriteString("---------------------\n")
-	sb.WriteString(appConfig.String())
+//DeleteObjects deletes objects in batches of up to 1000, the most a single S3 request accepts
+func (s *s3Storage) DeleteObjects(ctx context.Context, container string, keys []string) error {
+	ids := make([]s3types.ObjectIdentifier, 0, len(keys))
+	for i := range keys {
+		ids = append(ids, s3types.ObjectIdentifier{Key: &keys[i]})
+	}
+	return s.deleteObjectIdentifiers(ctx, container, ids)
+}
 
-	//Try to contact AWS and get a bucket list
-	lbOutput, err := s3Client.ListBuckets(ctx, &s3.ListBucketsInput{})
-	if err != nil {
-		return fmt.Errorf("dryrun Error: unable to list AWS buckets: %v", err)
+//DeleteContainer deletes every version of every object in a bucket, including delete markers left by versioning,
+//then the bucket itself. S3 refuses to delete a bucket that holds anything
+func (s *s3Storage) DeleteContainer(ctx context.Context, container string) error {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: &container,
 	}
+	for {
+		lovOutput, err := s.client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return err
+		}
 
-	found := false
-	sb.WriteString("\n")
-	sb.WriteString("AWS Bucket Listing\n")
-	sb.WriteString("---------------------\n")
-	for _, b := range lbOutput.Buckets {
-		sb.WriteString(fmt.Sprintf("  %s\n", *b.Name))
-		if *b.Name == appConfig.DryrunBucket() {
-			found = true
+		ids := make([]s3types.ObjectIdentifier, 0, len(lovOutput.Versions)+len(lovOutput.DeleteMarkers))
+		for _, v := range lovOutput.Versions {
+			ids = append(ids, s3types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range lovOutput.DeleteMarkers {
+			ids = append(ids, s3types.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+		err = s.deleteObjectIdentifiers(ctx, container, ids)
+		if err != nil {
+			return err
 		}
-	}
 
-	//note the existance of the dryrun bucket
-	sb.WriteString("Successfully located dryrun bucket: ")
-	if found {
-		sb.WriteString("true\n")
-	} else {
-		sb.WriteString("false\n")
-		return fmt.Errorf("dryrun Error: unable to locate dryrun bucket: %s", appConfig.DryrunBucket())
+		if !lovOutput.IsTruncated {
+			break
+		}
+		input.KeyMarker = lovOutput.NextKeyMarker
+		input.VersionIdMarker = lovOutput.NextVersionIdMarker
 	}
 
-	//print out a selection of the files to be transferred
-	sb.WriteString("\n")
-	sb.WriteString(fmt.Sprintf("Sample File List [%d of %d total files]\n", dryrunSampleFileListLength, len(objectsList)))
-	sb.WriteString("---------------------------------------\n")
-	for i := 0; i < dryrunSampleFileListLength; i++ {
-		sb.WriteString(fmt.Sprintf("  %s\n", objectsList[i].FullName))
-	}
+	_, err := s.client.DeleteBucket(ctx, &s3.DeleteBucketInput{
+		Bucket: &container,
+	})
+	return err
+}
 
-	fmt.Println(sb.String())
+//deletes objects (or object versions) in batches. S3 reports the objects it failed to delete rather than failing
+//the whole request so those are turned into an error
+func (s *s3Storage) deleteObjectIdentifiers(ctx context.Context, container string, ids []s3types.ObjectIdentifier) error {
+	for start := 0; start < len(ids); start += s3DeleteBatchSize {
+		end := start + s3DeleteBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
 
-	logger.Infow("AWS dryrun complete", "meta", domain.Chat)
+		doOutput, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &container,
+			Delete: &s3types.Delete{Objects: ids[start:end], Quiet: true},
+		})
+		if err != nil {
+			return err
+		}
+		if len(doOutput.Errors) > 0 {
+			e := doOutput.Errors[0]
+			return fmt.Errorf("failed to delete %d objects. First: %s error: %s %s", len(doOutput.Errors), stringValue(e.Key), stringValue(e.Code), stringValue(e.Message))
+		}
+	}
 	return nil
 }
+
+//S3 returns ETags wrapped in double quotes
+func trimETag(etag *string) string {
+	if etag == nil {
+		return ""
+	}
+	return strings.Trim(*etag, `"`)
+}
+
+//the SDK uses pointers for optional strings
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
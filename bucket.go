@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"backup/domain"
+)
+
+const (
+	bucketTagRunId     = "backup:run-id"
+	bucketTagHost      = "backup:host"
+	bucketTagBasePaths = "backup:base-paths"
+
+	maxBucketTagValueLength = 256
+)
+
+//creates the bucket this run stores its objects in and applies the configured settings to it. A fixed bucket is
+//only created (and configured) by the first run to use it
+func prepareBucket(ctx context.Context, store domain.Storage, appConfig domain.Config) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	bucket := appConfig.Bucket()
+	if appConfig.FixedBucket() != "" {
+		exists, err := store.ContainerExists(ctx, bucket)
+		if err != nil {
+			return fmt.Errorf("unable to find bucket: %s error: %v", bucket, err)
+		}
+		if exists {
+			logger.Infow("storing in existing bucket", "bucketName", bucket, "prefix", appConfig.Prefix(), "storage", store.Name(), "meta", domain.Aws)
+			return nil
+		}
+	}
+
+	err := store.CreateContainer(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("unable to create bucket: %s error: %v", bucket, err)
+	}
+	logger.Infow("bucket created successfully", "bucketName", bucket, "prefix", appConfig.Prefix(), "storage", store.Name(), "meta", domain.Aws)
+
+	err = configureBucket(ctx, store, appConfig, bucket)
+	if err != nil {
+		return fmt.Errorf("unable to configure bucket: %s error: %v", bucket, err)
+	}
+	return nil
+}
+
+//applies the configured settings to a newly created bucket
+func configureBucket(ctx context.Context, store domain.Storage, appConfig domain.Config, bucket string) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	settings := appConfig.BucketSettings()
+	var tags map[string]string
+	if settings.Tags {
+		tags = bucketTags(appConfig, bucket)
+	}
+
+	err := store.ConfigureContainer(ctx, bucket, settings, tags)
+	if err != nil {
+		return err
+	}
+	logger.Infow("bucket configured", "bucketName", bucket, "versioning", settings.Versioning, "encryption", settings.Encryption, "blockPublicAccess", settings.BlockPublicAccess, "tagCount", len(tags), "lifecycle", settings.HasLifecycle(), "meta", domain.Aws)
+	return nil
+}
+
+//builds the tags describing a run - its id, the machine it ran on and the folders it backs up. A fixed bucket
+//outlives the run that created it so is not tagged with its id
+func bucketTags(appConfig domain.Config, bucket string) map[string]string {
+	tags := make(map[string]string)
+	if appConfig.FixedBucket() == "" {
+		tags[bucketTagRunId] = bucket
+	}
+	if host, err := os.Hostname(); err == nil {
+		tags[bucketTagHost] = bucketTagValue(host)
+	}
+
+	paths := make([]string, 0, len(appConfig.BasePaths()))
+	for _, p := range appConfig.BasePaths() {
+		paths = append(paths, domain.NormalizePath(p))
+	}
+	tags[bucketTagBasePaths] = bucketTagValue(strings.Join(paths, " "))
+	return tags
+}
+
+//makes a tag value acceptable to S3 by replacing the characters it does not allow and trimming it to length
+func bucketTagValue(v string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) || strings.ContainsRune("_.:/=+-@", r) {
+			return r
+		}
+		return '_'
+	}, v)
+
+	runes := []rune(cleaned)
+	if len(runes) > maxBucketTagValueLength {
+		runes = runes[:maxBucketTagValueLength]
+	}
+	return string(runes)
+}
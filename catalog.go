@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"backup/domain"
+)
+
+//records this run in the catalog, both locally and as an object in the destination. Resuming or reprocessing a run
+//updates the snapshot the catalog already holds for it
+func recordSnapshot(appConfig domain.Config, objectsList []*domain.FileInfo, basedOn string, started time.Time) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	//the run may have been interrupted, which is all the more reason to record it
+	ctx := context.Background()
+
+	catalog, err := domain.ReadCatalog(appConfig.CatalogFilepath())
+	if err != nil {
+		return err
+	}
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+
+	//a fixed bucket may be shared with other machines - pick up the runs they added to its catalog
+	if appConfig.FixedBucket() != "" {
+		stored, err := fetchCatalog(ctx, store, appConfig.Bucket())
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			catalog.Merge(stored)
+		}
+	}
+
+	snapshot := &domain.Snapshot{
+		RunId:          appConfig.RunName(),
+		Bucket:         appConfig.Bucket(),
+		Prefix:         appConfig.Prefix(),
+		Started:        started,
+		Finished:       time.Now(),
+		BasePaths:      appConfig.BasePaths(),
+		ExclusionsHash: domain.ExclusionsHash(appConfig.Exclusions()),
+		Incremental:    appConfig.Incremental(),
+		BasedOn:        basedOn,
+	}
+	for _, fi := range objectsList {
+		if fi.Excluded {
+			continue
+		}
+		if fi.StorageSuccess {
+			snapshot.FileCount++
+			snapshot.TotalBytes += fi.Size
+		} else {
+			snapshot.FailureCount++
+		}
+	}
+
+	//a resumed or reprocessed run finishes a run the catalog already has - it began when that run did
+	if previous := catalog.Find(snapshot.RunId); previous != nil {
+		snapshot.Started = previous.Started
+		if appConfig.Reprocess() {
+
+			//reprocessing only sees the files that failed so adds to what the run already held
+			snapshot.FileCount += previous.FileCount
+			snapshot.TotalBytes += previous.TotalBytes
+			snapshot.Incremental = previous.Incremental
+			snapshot.BasedOn = previous.BasedOn
+		}
+	}
+	catalog.Put(snapshot)
+
+	err = catalog.Save(appConfig.CatalogFilepath())
+	if err != nil {
+		return err
+	}
+	logger.Infow("run recorded in catalog", "path", appConfig.CatalogFilepath(), "runId", snapshot.RunId, "snapshotCount", len(catalog.Snapshots), "meta", domain.Chat)
+
+	err = uploadCatalog(ctx, store, appConfig, catalog)
+	if err != nil {
+		return fmt.Errorf("unable to store catalog in bucket: %s error: %v", appConfig.Bucket(), err)
+	}
+	logger.Infow("catalog stored", "bucketName", appConfig.Bucket(), "key", domain.CatalogKey, "meta", domain.Aws)
+	return nil
+}
+
+//stores the catalog as an object in this run's bucket
+func uploadCatalog(ctx context.Context, store domain.Storage, appConfig domain.Config, catalog *domain.Catalog) error {
+	jsonBytes, err := catalog.Marshal()
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(jsonBytes)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	return putObjectWithRetry(ctx, store, appConfig, &domain.PutObjectRequest{
+		Container:  appConfig.Bucket(),
+		Key:        domain.CatalogKey,
+		Body:       bytes.NewReader(jsonBytes),
+		ContentMD5: contentMD5,
+		Metadata:   map[string]string{domain.MetadataMD5: contentMD5},
+	})
+}
+
+//reads the copy of the catalog stored in a bucket. Returns nil if the bucket has none
+func fetchCatalog(ctx context.Context, store domain.Storage, bucket string) (*domain.Catalog, error) {
+	body, _, err := store.GetObject(ctx, bucket, domain.CatalogKey)
+	if errors.Is(err, domain.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch catalog from bucket: %s error: %v", bucket, err)
+	}
+	defer body.Close()
+
+	jsonBytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch catalog from bucket: %s error: %v", bucket, err)
+	}
+	return domain.ParseCatalog(jsonBytes)
+}
+
+//top-level function for the snapshots command. Lists every run in the catalog or shows the details of one of them
+func showSnapshots(appConfig domain.Config) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	ctx := context.Background()
+
+	catalog, err := domain.ReadCatalog(appConfig.CatalogFilepath())
+	if err != nil {
+		return err
+	}
+
+	//the copy in a fixed bucket also knows about runs made on other machines
+	if appConfig.FixedBucket() != "" {
+		store, err := newStorage(ctx, appConfig)
+		if err != nil {
+			return err
+		}
+		stored, err := fetchCatalog(ctx, store, appConfig.Bucket())
+		if err != nil {
+			logger.Warnw("unable to read the catalog stored in the bucket. Showing the local catalog only", "err", err, "meta", domain.Err)
+		} else if stored != nil {
+			catalog.Merge(stored)
+		}
+	}
+
+	if appConfig.RunId() == "" {
+		fmt.Print(formatSnapshotList(catalog))
+		return nil
+	}
+	snapshot := catalog.Find(appConfig.RunId())
+	if snapshot == nil {
+		return fmt.Errorf("run: %s is not in the catalog", appConfig.RunId())
+	}
+	fmt.Print(formatSnapshot(snapshot))
+	return nil
+}
+
+//lays out the catalog as a table, one run per line, oldest first
+func formatSnapshotList(catalog *domain.Catalog) string {
+	var sb strings.Builder
+	if len(catalog.Snapshots) == 0 {
+		sb.WriteString("The catalog is empty\n")
+		return sb.String()
+	}
+
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN ID\tSTARTED\tDURATION\tFILES\tSIZE\tFAILED\tLOCATION\tBASE PATHS")
+	for _, s := range catalog.Snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n", s.RunId, s.Started.Local().Format("2006-01-02 15:04"),
+			prettyTime(s.Finished.Sub(s.Started)), s.FileCount, prettySize(s.TotalBytes), s.FailureCount,
+			s.Bucket+"/"+s.Prefix, strings.Join(s.BasePaths, " "))
+	}
+	tw.Flush()
+	return sb.String()
+}
+
+//lays out the details of a single run
+func formatSnapshot(s *domain.Snapshot) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("Run Id: %s\n", s.RunId))
+	sb.WriteString(fmt.Sprintf("Bucket: %s\n", s.Bucket))
+	sb.WriteString(fmt.Sprintf("Prefix: %s\n", s.Prefix))
+	sb.WriteString(fmt.Sprintf("Started: %s\n", s.Started.Local().Format(time.RFC1123)))
+	sb.WriteString(fmt.Sprintf("Finished: %s\n", s.Finished.Local().Format(time.RFC1123)))
+	sb.WriteString(fmt.Sprintf("Duration: %s\n", prettyTime(s.Finished.Sub(s.Started))))
+	sb.WriteString(fmt.Sprintf("Incremental: %t\n", s.Incremental))
+	if s.BasedOn != "" {
+		sb.WriteString(fmt.Sprintf("Based On: %s\n", s.BasedOn))
+	}
+	sb.WriteString("Base Paths:\n")
+	for _, p := range s.BasePaths {
+		sb.WriteString(fmt.Sprintf("  %s\n", p))
+	}
+	sb.WriteString(fmt.Sprintf("Exclusions Hash: %s\n", s.ExclusionsHash))
+	sb.WriteString(fmt.Sprintf("Files: %d\n", s.FileCount))
+	sb.WriteString(fmt.Sprintf("Size: %s (%d bytes)\n", prettySize(s.TotalBytes), s.TotalBytes))
+	sb.WriteString(fmt.Sprintf("Failures: %d\n", s.FailureCount))
+	return sb.String()
+}
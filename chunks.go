@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"backup/domain"
+)
+
+//returns true if a file is large enough to be stored in content-defined chunks
+func isChunked(appConfig domain.Config, fi *domain.FileInfo) bool {
+	threshold := appConfig.ChunkThreshold()
+	return threshold > 0 && fi.Size >= threshold
+}
+
+//stores a large file as content-defined chunks, each stored once under its own hash, followed by the file's chunk
+//list under key. Only the chunks around a change to the file need storing again. The chunk list carries the MD5 and
+//size of the whole file so verify treats it as it would the file itself
+func (r *contentRepository) storeChunkedFile(ctx context.Context, fi *domain.FileInfo, key string) error {
+	logger := r.appConfig.Logger()
+	filename := fi.FullName
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for storage: %v", err)
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			logger.Warnw("failed to close file after storing", "path", filename, "meta", domain.Aws)
+		}
+	}()
+
+	//the file is read again to chunk it - make sure it is still what was hashed
+	whole := sha256.New()
+	chunker := domain.NewChunker(io.TeeReader(f, whole))
+	storageClass := storageClassFor(r.appConfig, fi)
+
+	list := &domain.ChunkList{Size: fi.Size, Chunks: make([]*domain.ChunkRef, 0)}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file for chunking: %v", err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		ref := &domain.ChunkRef{Hash: domain.ContentName(r.appConfig.Keyring(), hex.EncodeToString(sum[:])), Size: int64(len(chunk))}
+		list.Chunks = append(list.Chunks, ref)
+
+		stored, err := r.storeOnce(ctx, domain.ContentKey(ref.Hash), func() error {
+			return r.storeChunk(ctx, chunk, ref, storageClass, filename)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to store chunk: %s error: %v", ref.Hash, err)
+		}
+		if !stored {
+			r.mu.Lock()
+			r.chunkDedupCount++
+			r.chunkDedupSize += ref.Size
+			r.mu.Unlock()
+		}
+	}
+	if hex.EncodeToString(whole.Sum(nil)) != fi.ContentHash {
+		return fmt.Errorf("file changed after it was hashed")
+	}
+
+	jsonBytes, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk list: %v", err)
+	}
+	sum := md5.Sum(jsonBytes)
+	logger.Debugw("file chunked", "path", filename, "chunkCount", len(list.Chunks), "meta", domain.Aws)
+
+	return putObjectWithRetry(ctx, r.store, r.appConfig, &domain.PutObjectRequest{
+		Container:  r.appConfig.Bucket(),
+		Key:        key,
+		Body:       bytes.NewReader(jsonBytes),
+		ContentMD5: base64.StdEncoding.EncodeToString(sum[:]),
+		Metadata: map[string]string{
+			domain.MetadataMD5:    fi.Hash,
+			domain.MetadataSize:   strconv.FormatInt(fi.Size, 10),
+			domain.MetadataChunks: strconv.Itoa(len(list.Chunks)),
+		},
+	})
+}
+
+//stores a single chunk of the file named filename, compressing and encrypting it first if configured
+func (r *contentRepository) storeChunk(ctx context.Context, chunk []byte, ref *domain.ChunkRef, storageClass string, filename string) error {
+	sum := md5.Sum(chunk)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+	var body io.ReadSeeker = bytes.NewReader(chunk)
+	req := &domain.PutObjectRequest{
+		Container:    r.appConfig.Bucket(),
+		Key:          domain.ContentKey(ref.Hash),
+		Body:         body,
+		ContentMD5:   contentMD5,
+		Metadata:     map[string]string{domain.MetadataMD5: contentMD5},
+		StorageClass: storageClass,
+	}
+
+	//a chunk is judged on its own sample, so a compressible part of a file is compressed even if the rest is not
+	compressed, _, err := compressRequest(r.appConfig, req, body, ref.Size, filename)
+	if err != nil {
+		return err
+	}
+	if compressed != nil {
+		defer removeTempFile(compressed)
+		body = compressed
+	}
+
+	if keyring := r.appConfig.Keyring(); keyring != nil {
+		encrypted, _, err := encryptRequest(keyring, req, body, ref.Size)
+		if err != nil {
+			return err
+		}
+		defer removeTempFile(encrypted)
+	}
+	return putObjectWithRetry(ctx, r.store, r.appConfig, req)
+}
+
+//reads a chunk list
+func readChunkList(src io.Reader) (*domain.ChunkList, error) {
+	jsonBytes, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read chunk list: %v", err)
+	}
+	var list domain.ChunkList
+	err = json.Unmarshal(jsonBytes, &list)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal chunk list: %v", err)
+	}
+	return &list, nil
+}
+
+//fetches the chunk list stored under key. Returns nil if there is no such chunk list
+func fetchChunkList(ctx context.Context, store domain.Storage, bucket string, key string) (*domain.ChunkList, error) {
+	body, _, err := store.GetObject(ctx, bucket, key)
+	if errors.Is(err, domain.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch chunk list: %s from bucket: %s error: %w", key, bucket, err)
+	}
+	defer body.Close()
+	return readChunkList(body)
+}
+
+//chunkReader returns the content of a chunked file, fetching (and decoding) one chunk at a time
+type chunkReader struct {
+	ctx       context.Context
+	store     domain.Storage
+	appConfig domain.Config
+	bucket    string
+
+	//chunks holds the chunks not yet fetched
+	chunks []*domain.ChunkRef
+
+	//body and content are those of the chunk being read, if any
+	body    io.ReadCloser
+	content io.Reader
+}
+
+//returns a reader of the content of the chunked file whose chunk list is read from src
+func newChunkReader(ctx context.Context, store domain.Storage, appConfig domain.Config, bucket string, src io.Reader) (*chunkReader, error) {
+	list, err := readChunkList(src)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{ctx: ctx, store: store, appConfig: appConfig, bucket: bucket, chunks: list.Chunks}, nil
+}
+
+//Read returns content, fetching the next chunk whenever the previous one has been consumed
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.content == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			err := r.open(r.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.content.Read(p)
+		if err == io.EOF {
+			r.Close()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+//fetches a chunk
+func (r *chunkReader) open(ref *domain.ChunkRef) error {
+	key := domain.ContentKey(ref.Hash)
+	body, info, err := r.store.GetObject(r.ctx, r.bucket, key)
+	if err != nil {
+		return fmt.Errorf("unable to fetch chunk: %s error: %w", key, err)
+	}
+	r.body = body
+	r.content, err = decodeContent(r.appConfig, body, info.Metadata)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	return nil
+}
+
+//Close releases the chunk being read, if any
+func (r *chunkReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body, r.content = nil, nil
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"backup/domain"
+)
+
+const (
+	compressTempPrefix = "backup-gz-"
+)
+
+//switches a request over to the compressed content of src, which holds size bytes, if compression is configured and
+//worth it for the file named filename. It is not for types that are compressed already, content whose sample looks
+//compressed or content that does not shrink. The metadata keeps the original MD5 and size for restore and verify while
+//ContentMD5 switches to the hash of the compressed content. Returns the compressed temp file, which the caller must
+//remove, and its size - or nil with src rewound if the content is stored as it is
+func compressRequest(appConfig domain.Config, req *domain.PutObjectRequest, src io.ReadSeeker, size int64, filename string) (*os.File, int64, error) {
+	if appConfig.Compression() == "" || size < domain.MinCompressSize || domain.IsCompressedType(filename) {
+		return nil, 0, nil
+	}
+
+	sample := make([]byte, domain.CompressSampleSize)
+	n, err := io.ReadFull(src, sample)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("failed to read file for compression: %v", err)
+	}
+	_, err = src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to rewind file for compression: %v", err)
+	}
+	if !domain.IsCompressible(sample[:n]) {
+		return nil, 0, nil
+	}
+
+	tmp, err := os.CreateTemp("", compressTempPrefix+"*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//hash both sides as we go - the original to make sure it is still what was hashed, the compressed content as that
+	//is what storage validates
+	original := md5.New()
+	compressed := md5.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, compressed))
+	_, err = io.Copy(gz, io.TeeReader(src, original))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, 0, fmt.Errorf("failed to compress file: %v", err)
+	}
+	if base64.StdEncoding.EncodeToString(original.Sum(nil)) != req.ContentMD5 {
+		removeTempFile(tmp)
+		return nil, 0, fmt.Errorf("file changed after it was hashed")
+	}
+
+	compressedSize, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, 0, err
+	}
+
+	//content that does not shrink is stored as it is
+	if compressedSize >= size {
+		removeTempFile(tmp)
+		_, err = src.Seek(0, io.SeekStart)
+		return nil, 0, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, 0, err
+	}
+
+	req.Body = tmp
+	req.ContentMD5 = base64.StdEncoding.EncodeToString(compressed.Sum(nil))
+	req.Metadata[domain.MetadataCompression] = domain.CompressionGzip
+	req.Metadata[domain.MetadataSize] = strconv.FormatInt(size, 10)
+	return tmp, compressedSize, nil
+}
+
+//returns the original content of an object read from body, decrypting and then decompressing it as its metadata says
+func decodeContent(appConfig domain.Config, body io.Reader, metadata map[string]string) (io.Reader, error) {
+	content := body
+	if metadata[domain.MetadataEncryption] != "" {
+		decrypted, err := newDecryptReader(appConfig.Keyring(), body, metadata)
+		if err != nil {
+			return nil, err
+		}
+		content = decrypted
+	}
+
+	switch metadata[domain.MetadataCompression] {
+	case "":
+		return content, nil
+	case domain.CompressionGzip:
+		decompressed, err := gzip.NewReader(content)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress object: %v", err)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", metadata[domain.MetadataCompression])
+	}
+}
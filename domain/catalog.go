@@ -0,0 +1,199 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+
+	//ReservedKeyPrefix begins the key of every object the app keeps for itself rather than for a backed up file. No
+	//file key can begin with it as folders starting with '.' are never backed up
+	ReservedKeyPrefix = ".backup/"
+
+	//CatalogKey is the key of the copy of the catalog kept in the destination
+	CatalogKey = ReservedKeyPrefix + "catalog.json"
+)
+
+//Snapshot describes a single backup run
+type Snapshot struct {
+
+	//RunId is the id of the run, given to restore and verify
+	RunId string `json:"runId"`
+
+	//Bucket is the bucket the run stored its objects in
+	Bucket string `json:"bucket"`
+
+	//Prefix is the prefix of every key the run stored, if any
+	Prefix string `json:"prefix,omitempty"`
+
+	//Started and Finished are when the run began and when it last finished (reprocessing finishes a run again)
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	//BasePaths are the folders the run backed up
+	BasePaths []string `json:"basePaths"`
+
+	//ExclusionsHash identifies the exclusion rules the run applied. Runs with the same hash excluded the same files
+	ExclusionsHash string `json:"exclusionsHash"`
+
+	//Incremental is true if the run only stored files that changed since the run named in BasedOn
+	Incremental bool   `json:"incremental"`
+	BasedOn     string `json:"basedOn,omitempty"`
+
+	//FileCount and TotalBytes count the files that are part of the backup, including those an incremental run
+	//left in earlier runs
+	FileCount  int   `json:"fileCount"`
+	TotalBytes int64 `json:"totalBytes"`
+
+	//FailureCount is the number of files that could not be stored
+	FailureCount int `json:"failureCount"`
+}
+
+//Catalog records every backup run, oldest first
+type Catalog struct {
+	Snapshots []*Snapshot `json:"snapshots"`
+
+	//Deleted records when each run prune deleted was removed, by run id, so merging a catalog that still has the run
+	//(eg a stale copy, or one from another machine) never brings it back
+	Deleted map[string]time.Time `json:"deleted,omitempty"`
+}
+
+//ReadCatalog reads a catalog file. A missing file is an empty catalog
+func ReadCatalog(path string) (*Catalog, error) {
+	jsonBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Catalog{Snapshots: make([]*Snapshot, 0)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read catalog file: %s because: %v", path, err)
+	}
+	return ParseCatalog(jsonBytes)
+}
+
+//ParseCatalog parses the json form of a catalog
+func ParseCatalog(jsonBytes []byte) (*Catalog, error) {
+	var catalog Catalog
+	err := json.Unmarshal(jsonBytes, &catalog)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal catalog: %v", err)
+	}
+	if catalog.Snapshots == nil {
+		catalog.Snapshots = make([]*Snapshot, 0)
+	}
+	return &catalog, nil
+}
+
+//Save writes the catalog to a file, replacing it atomically so a failed write never loses the earlier catalog
+func (c *Catalog) Save(path string) error {
+	jsonBytes, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, jsonBytes, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write catalog file: %s err: %v", tmp, err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace catalog file: %s err: %v", path, err)
+	}
+	return nil
+}
+
+//Marshal returns the indented json form of the catalog
+func (c *Catalog) Marshal() ([]byte, error) {
+	jsonBytes, err := json.MarshalIndent(c, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal catalog json structure: %v", err)
+	}
+	return jsonBytes, nil
+}
+
+//Find returns the snapshot of a run or nil if the catalog does not have it
+func (c *Catalog) Find(runId string) *Snapshot {
+	for _, s := range c.Snapshots {
+		if s.RunId == runId {
+			return s
+		}
+	}
+	return nil
+}
+
+//Put adds a snapshot, replacing any earlier snapshot of the same run, and keeps the catalog in start order
+func (c *Catalog) Put(snapshot *Snapshot) {
+	for i, s := range c.Snapshots {
+		if s.RunId == snapshot.RunId {
+			c.Snapshots[i] = snapshot
+			return
+		}
+	}
+	c.Snapshots = append(c.Snapshots, snapshot)
+	sort.SliceStable(c.Snapshots, func(i, j int) bool {
+		return c.Snapshots[i].Started.Before(c.Snapshots[j].Started)
+	})
+}
+
+//Remove drops the snapshot of a run, if the catalog has one, and records that the run was deleted
+func (c *Catalog) Remove(runId string) {
+	if c.Deleted == nil {
+		c.Deleted = make(map[string]time.Time)
+	}
+	c.Deleted[runId] = time.Now().UTC()
+	for i, s := range c.Snapshots {
+		if s.RunId == runId {
+			c.Snapshots = append(c.Snapshots[:i], c.Snapshots[i+1:]...)
+			return
+		}
+	}
+}
+
+//Merge adds the snapshots of another catalog (eg the copy in the destination, written by another machine). Where
+//both have a run, the snapshot that finished last wins. A run either catalog records as deleted stays deleted
+func (c *Catalog) Merge(other *Catalog) {
+	for runId, deleted := range other.Deleted {
+		if mine, found := c.Deleted[runId]; !found || deleted.After(mine) {
+			if c.Deleted == nil {
+				c.Deleted = make(map[string]time.Time)
+			}
+			c.Deleted[runId] = deleted
+		}
+	}
+	for _, s := range other.Snapshots {
+		if _, deleted := c.Deleted[s.RunId]; deleted {
+			continue
+		}
+		mine := c.Find(s.RunId)
+		if mine == nil || s.Finished.After(mine.Finished) {
+			c.Put(s)
+		}
+	}
+
+	//drop any run of our own the other catalog knows was deleted
+	kept := c.Snapshots[:0]
+	for _, s := range c.Snapshots {
+		if _, deleted := c.Deleted[s.RunId]; !deleted {
+			kept = append(kept, s)
+		}
+	}
+	c.Snapshots = kept
+}
+
+//ExclusionsHash returns a short hash of a set of exclusion rules, in order
+func ExclusionsHash(exclusions []*Exclusion) string {
+	rules := make([]string, 0, len(exclusions))
+	for _, ex := range exclusions {
+		rules = append(rules, ex.Raw)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(rules, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
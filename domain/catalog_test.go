@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCatalogMergeKeepsDeletedRunsDeleted(t *testing.T) {
+	start := time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC)
+	snapshot := func(runId string, day int) *Snapshot {
+		return &Snapshot{RunId: runId, Started: start.AddDate(0, 0, day), Finished: start.AddDate(0, 0, day).Add(time.Hour)}
+	}
+
+	tests := []struct {
+		name  string
+		mine  func() *Catalog
+		other func() *Catalog
+		want  []string
+	}{
+		{
+			name: "stale copy does not bring a deleted run back",
+			mine: func() *Catalog {
+				c := &Catalog{Snapshots: []*Snapshot{snapshot("a", 0), snapshot("b", 1)}}
+				c.Remove("a")
+				return c
+			},
+			other: func() *Catalog { return &Catalog{Snapshots: []*Snapshot{snapshot("a", 0), snapshot("b", 1)}} },
+			want:  []string{"b"},
+		},
+		{
+			name: "deletion recorded elsewhere removes the run here",
+			mine: func() *Catalog { return &Catalog{Snapshots: []*Snapshot{snapshot("a", 0), snapshot("b", 1)}} },
+			other: func() *Catalog {
+				c := &Catalog{Snapshots: []*Snapshot{snapshot("a", 0), snapshot("b", 1)}}
+				c.Remove("b")
+				return c
+			},
+			want: []string{"a"},
+		},
+		{
+			name:  "runs of both catalogs are kept in start order",
+			mine:  func() *Catalog { return &Catalog{Snapshots: []*Snapshot{snapshot("b", 1)}} },
+			other: func() *Catalog { return &Catalog{Snapshots: []*Snapshot{snapshot("a", 0), snapshot("c", 2)}} },
+			want:  []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.mine()
+			c.Merge(tt.other())
+			got := make([]string, 0, len(c.Snapshots))
+			for _, s := range c.Snapshots {
+				got = append(got, s.RunId)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("runs = %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("runs = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCatalogDeletedSurvivesJson(t *testing.T) {
+	c := &Catalog{Snapshots: []*Snapshot{{RunId: "a"}}}
+	c.Remove("a")
+	jsonBytes, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	parsed, err := ParseCatalog(jsonBytes)
+	if err != nil {
+		t.Fatalf("ParseCatalog() error = %v", err)
+	}
+	if _, found := parsed.Deleted["a"]; !found {
+		t.Errorf("Deleted = %v, want run a recorded", parsed.Deleted)
+	}
+}
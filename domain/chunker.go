@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"io"
+)
+
+//chunk sizes of the content-defined chunker. A chunk ends where the rolling hash of the last 64 bytes matches the
+//boundary mask, so a boundary only depends on the content near it and an edit only changes the chunks around it.
+//These must never change or files would no longer be cut into the chunks earlier runs stored
+const (
+	ChunkMinSize = 256 * 1024
+	ChunkMaxSize = 4 * 1024 * 1024
+
+	//chunkBoundaryMask gives chunks an average size of about 1MB past the minimum
+	chunkBoundaryMask = uint64(0xFFFFF) << 44
+
+	//gearSeed seeds the generation of gearTable
+	gearSeed = 0x6261636b75702d31
+)
+
+//gearTable maps each byte to a random 64 bit value for the gear rolling hash
+var gearTable = makeGearTable()
+
+//fills the gear table from a fixed seed (splitmix64) so every build cuts files in the same places
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	state := uint64(gearSeed)
+	for i := range table {
+		state += 0x9E3779B97F4A7C15
+		z := state
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+//Chunker cuts content into content-defined chunks of ChunkMinSize to ChunkMaxSize bytes
+type Chunker struct {
+	src io.Reader
+
+	//buf holds content read but not yet returned, from start to end
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+//NewChunker returns a chunker reading content from src
+func NewChunker(src io.Reader) *Chunker {
+	return &Chunker{src: src, buf: make([]byte, ChunkMaxSize)}
+}
+
+//Next returns the next chunk, or io.EOF once the content is exhausted. The chunk is only valid until the next call
+func (c *Chunker) Next() ([]byte, error) {
+
+	//move what is left to the front and top the buffer up
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.src.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.start = chunkBoundary(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+//finds the end of the chunk at the front of data, which holds at most ChunkMaxSize bytes
+func chunkBoundary(data []byte) int {
+	if len(data) <= ChunkMinSize {
+		return len(data)
+	}
+	var h uint64
+	for i := ChunkMinSize; i < len(data); i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// goldenContent returns size bytes of content that is the same on every platform and Go version: the SHA-256 of a
+//counter, block after block
+func goldenContent(size int) []byte {
+	var buf bytes.Buffer
+	var counter [8]byte
+	for i := uint64(0); buf.Len() < size; i++ {
+		binary.BigEndian.PutUint64(counter[:], i)
+		sum := sha256.Sum256(counter[:])
+		buf.Write(sum[:])
+	}
+	return buf.Bytes()[:size]
+}
+
+//chunkSizes returns the sizes of the chunks the chunker cuts content into
+func chunkSizes(t *testing.T, content []byte) []int {
+	sizes := make([]int, 0)
+	chunker := NewChunker(bytes.NewReader(content))
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return sizes
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+//the boundaries must never change or files would no longer be cut into the chunks earlier runs stored
+func TestChunkerGoldenBoundaries(t *testing.T) {
+	want := []int{950663, 979437, 1143640, 1243171, 569197, 689628, 513533, 2097296, 1887457, 1224152, 1284738}
+	got := chunkSizes(t, goldenContent(12*1024*1024))
+	if len(got) != len(want) {
+		t.Fatalf("chunk count = %d, want %d (sizes %v)", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("chunk %d size = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGearTableGolden(t *testing.T) {
+	tests := []struct {
+		index int
+		want  uint64
+	}{
+		{0, 0x11c6ba6c1c08dddb},
+		{1, 0xf94185721b29fdb4},
+		{255, 0x30ae1444ce6a2a30},
+	}
+	for _, tt := range tests {
+		if gearTable[tt.index] != tt.want {
+			t.Errorf("gearTable[%d] = %#x, want %#x", tt.index, gearTable[tt.index], tt.want)
+		}
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want []int
+	}{
+		{"empty", 0, []int{}},
+		{"below the minimum", 1000, []int{1000}},
+		{"exactly the minimum", ChunkMinSize, []int{ChunkMinSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chunkSizes(t, goldenContent(tt.size))
+			if len(got) != len(tt.want) {
+				t.Fatalf("chunk sizes = %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("chunk sizes = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+//a chunk never exceeds the maximum, even in content with no boundary at all
+func TestChunkerMaxSize(t *testing.T) {
+	content := make([]byte, 3*ChunkMaxSize+10)
+	for _, size := range chunkSizes(t, content) {
+		if size > ChunkMaxSize {
+			t.Errorf("chunk size = %d, exceeds maximum %d", size, ChunkMaxSize)
+		}
+	}
+}
@@ -1,8 +1,34 @@
 package domain
 
+//commands that may be given ahead of any flags. A run without a command performs a backup
+const (
+
+	//CommandRestore downloads the objects of an earlier run to a local directory
+	CommandRestore = "restore"
+
+	//CommandVerify audits the objects of an earlier run against the local filesystem
+	CommandVerify = "verify"
+
+	//CommandSnapshots lists the runs in the catalog or shows one of them
+	CommandSnapshots = "snapshots"
+
+	//CommandPrune deletes the runs that fall outside the retention policy
+	CommandPrune = "prune"
+
+	//SnapshotsList and SnapshotsShow are the actions of CommandSnapshots
+	SnapshotsList = "list"
+	SnapshotsShow = "show"
+)
+
 //CommandOpts holds command line options to override default config
 type CommandOpts struct {
 
+	//Command is the command to run instead of a backup, if any
+	Command string
+
+	//CommandArgs holds any arguments given to the command other than flags (eg snapshots show <run id>)
+	CommandArgs []string
+
 	//UseDebugLogger should be set true when debug-level logging is needed
 	UseDebugLogger bool
 
@@ -12,6 +38,66 @@ type CommandOpts struct {
 	//Reprocess should be set true to reprocess a JSON file of previously-failed files
 	Reprocess bool
 
-	//NoConfirm should be set trueif, during Reprocessing, the confirmation menu should be skipped
+	//NoConfirm should be set trueif, during Reprocessing or pruning, the confirmation menu should be skipped
 	NoConfirm bool
+
+	//Resume should be set true to continue the interrupted run recorded in the journal
+	Resume bool
+
+	//Rehash should be set true to hash every file even if its hash is cached
+	Rehash bool
+
+	//Incremental should be set true to only store files that changed since the latest manifest
+	Incremental bool
+
+	//RunId names the run to read from when restoring or verifying
+	RunId string
+
+	//RestoreTarget is the directory files are restored into
+	RestoreTarget string
+
+	//RestoreIncludes holds regexes limiting a restore to keys matching at least one of them
+	RestoreIncludes []string
+
+	//KeyFile, when set, is a file holding the key used to encrypt objects before they are stored
+	KeyFile string
+
+	//FixedBucket, when set, overrides the long-lived bucket every run is stored in
+	FixedBucket string
+
+	//SkipExisting, when set, overrides how files already in the destination are found and skipped
+	SkipExisting string
+
+	//LocalDestination, when set, is a directory objects are written to instead of AWS S3
+	LocalDestination string
+
+	//ConfigFile names the config file to read. When empty the default config file is read if it exists
+	ConfigFile string
+
+	//AwsProfile, when set, overrides the AWS shared profile
+	AwsProfile string
+
+	//AwsRegion, when set, overrides the AWS region
+	AwsRegion string
+
+	//S3Endpoint, when set, overrides the URL of the S3 service
+	S3Endpoint string
+
+	//S3PathStyle, when set true, addresses buckets in the URL path rather than the host name
+	S3PathStyle bool
+
+	//HashRoutines, when non-zero, overrides the number of hashing routines
+	HashRoutines int
+
+	//StorageRoutines, when non-zero, overrides the number of storage routines
+	StorageRoutines int
+
+	//StorageRetryCount, when non-zero, overrides the number of attempts made to store each object
+	StorageRetryCount int
+
+	//KeepLast, KeepDaily, KeepWeekly and KeepMonthly, when non-zero, override the retention rules used by prune
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
 }
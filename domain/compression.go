@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+//compression is skipped for files that are too small to gain from it and for content that is already compressed
+const (
+	MinCompressSize = 1024
+
+	//CompressSampleSize is the number of bytes sampled from the start of a file to judge its entropy
+	CompressSampleSize = 64 * 1024
+
+	//maxSampleEntropy is the entropy in bits per byte above which a sample is taken to be compressed already
+	maxSampleEntropy = 7.5
+)
+
+//compressedExtensions are the extensions of file types that are compressed already
+var compressedExtensions = map[string]bool{
+	".7z": true, ".aac": true, ".apk": true, ".avi": true, ".avif": true, ".br": true, ".bz2": true, ".cab": true,
+	".deb": true, ".docx": true, ".epub": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz": true, ".lz4": true, ".lzma": true, ".m4a": true, ".m4v": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".odp": true, ".ods": true, ".odt": true, ".ogg": true, ".opus": true,
+	".png": true, ".pptx": true, ".rar": true, ".rpm": true, ".tgz": true, ".txz": true, ".webm": true, ".webp": true,
+	".wma": true, ".wmv": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+//IsCompressedType returns true if a file's extension marks it as a type that is compressed already
+func IsCompressedType(filename string) bool {
+	return compressedExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+//IsCompressible returns true unless a sample of a file's content looks compressed (or encrypted) already, judged by
+//the entropy of its bytes
+func IsCompressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	entropy := 0.0
+	total := float64(len(sample))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy < maxSampleEntropy
+}
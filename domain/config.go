@@ -2,6 +2,7 @@ package domain
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -15,12 +16,18 @@ import (
 )
 
 const (
-	defaultDryrunBucket         = "dryrun-2155"
-	defaultExclusionsFile       = "exclusions.txt"
-	defaultBackupDirectivesFile = "backup.txt"
-	defaultFailureOutputFile    = "failures.json"
-	defaultSharedProfile        = "s3-only"
-	defaultAwsRegion            = "us-east-2"
+	defaultDryrunBucket          = "dryrun-2155"
+	defaultExclusionsFile        = "exclusions.txt"
+	defaultStorageClassRulesFile = "storageclasses.txt"
+	defaultBackupDirectivesFile  = "backup.txt"
+	defaultFailureOutputFile     = "failures.json"
+	defaultManifestDir           = "manifests"
+	defaultJournalFile           = "journal.jsonl"
+	defaultHashCacheFile         = "hashcache.db"
+	defaultCatalogFile           = "catalog.json"
+	defaultVerifyOutputFile      = "verify.json"
+	defaultSharedProfile         = "s3-only"
+	defaultAwsRegion             = "us-east-2"
 
 	defaultFileCountEstimate = 25000
 
@@ -31,6 +38,16 @@ const (
 	defaultStorageRoutines            = 100
 	defaultStorageChannelMaxErrorRate = 25
 	defaultStorageRetryCount          = 5
+
+	defaultMultipartThresholdMB = 100
+	defaultMultipartPartSizeMB  = 64
+	defaultMultipartRoutines    = 4
+
+	defaultPackSegmentSizeMB = 16
+
+	//passphraseEnvVar names the environment variable holding the encryption passphrase. It is deliberately not a
+	//command line option as those are visible to every user of the machine
+	passphraseEnvVar = "BACKUP_PASSPHRASE"
 )
 
 //Config holds core info about the app
@@ -38,16 +55,42 @@ type Config interface {
 	DryrunBucket() string
 	Region() string
 	AwsProfile() string
+	S3Endpoint() string
+	S3PathStyle() bool
 	Bucket() string
+	FixedBucket() string
+	Prefix() string
+	RunName() string
+	LocateRun(runId string) (string, string)
+	BucketSettings() *BucketSettings
+	Retention() *RetentionSettings
+	LocalDestination() string
 
 	FailuresFilepath() string
+	VerifyFilepath() string
+	ManifestDir() string
+	JournalFilepath() string
+	HashCacheFilepath() string
+	CatalogFilepath() string
+
+	Command() string
+	RunId() string
+	RestoreTarget() string
+	RestoreIncludes() []*regexp.Regexp
 
 	Dryrun() bool
 	Reprocess() bool
+	Resume() bool
+	Rehash() bool
 	NoConfirm() bool
+	Incremental() bool
 	Logger() *zap.SugaredLogger
+	Keyring() *Keyring
+	SkipExisting() string
+	Repository() bool
 
 	Exclusions() []*Exclusion
+	StorageClassRules() []*StorageClassRule
 	BasePaths() []string
 	FileCountEstimate() int
 
@@ -59,6 +102,17 @@ type Config interface {
 	MaxStorageChannelErrorCount() int
 	StorageRetryCount() int
 
+	MultipartThreshold() int64
+	MultipartPartSize() int64
+	MultipartRoutinesCount() int
+
+	ChunkThreshold() int64
+
+	PackThreshold() int64
+	PackSegmentSize() int64
+
+	Compression() string
+
 	String() string
 }
 
@@ -66,15 +120,42 @@ type appConfig struct {
 	dryrunBucket                  string
 	region                        string
 	awsProfile                    string
+	s3Endpoint                    string
+	s3PathStyle                   bool
 	bucket                        string
+	fixedBucket                   string
+	runPrefix                     string
+	prefix                        string
+	runName                       string
+	bucketSettings                *BucketSettings
+	retention                     *RetentionSettings
+	localDestination              string
+	configFile                    string
+	command                       string
+	runId                         string
+	restoreTarget                 string
+	restoreIncludes               []*regexp.Regexp
 	dryrun                        bool
 	reprocess                     bool
+	resume                        bool
+	rehash                        bool
 	noConfirm                     bool
+	incremental                   bool
 	logger                        *zap.SugaredLogger
+	keyring                       *Keyring
+	skipExisting                  string
+	repository                    bool
 	exclusionsFile                string
+	storageClassRulesFile         string
 	backupFile                    string
 	failuresFile                  string
+	verifyFile                    string
+	manifestDir                   string
+	journalFile                   string
+	hashCacheFile                 string
+	catalogFile                   string
 	exclusions                    []*Exclusion
+	storageClassRules             []*StorageClassRule
 	basePaths                     []string
 	fileCountEstimate             int
 	hashRoutines                  int
@@ -83,6 +164,13 @@ type appConfig struct {
 	storageRoutines               int
 	maxStorageChannelErrorAllowed int
 	storageRetryCount             int
+	multipartThreshold            int64
+	chunkThreshold                int64
+	packThreshold                 int64
+	packSegmentSize               int64
+	compression                   string
+	multipartPartSize             int64
+	multipartRoutines             int
 }
 
 //NewConfig does just what it says on the tin
@@ -105,11 +193,85 @@ func (ac *appConfig) AwsProfile() string {
 	return ac.awsProfile
 }
 
+//S3Endpoint returns the URL of an S3-compatible service to use instead of AWS. Empty to use AWS itself
+func (ac *appConfig) S3Endpoint() string {
+	return ac.s3Endpoint
+}
+
+//S3PathStyle returns true if buckets are addressed in the URL path (http://host/bucket) rather than the host name
+func (ac *appConfig) S3PathStyle() bool {
+	return ac.s3PathStyle
+}
+
 //Bucket returns the name of the bucket to which all objects will be stored
 func (ac *appConfig) Bucket() string {
 	return ac.bucket
 }
 
+//FixedBucket returns the long-lived bucket every run is stored in. Empty when each run creates a bucket of its own
+func (ac *appConfig) FixedBucket() string {
+	return ac.fixedBucket
+}
+
+//Prefix returns the prefix of every key this run stores. Empty when each run creates a bucket of its own
+func (ac *appConfig) Prefix() string {
+	return ac.prefix
+}
+
+//RunName returns the id of this run, which names its manifest and is given to restore and verify. It is the name of
+//the run's bucket unless a fixed bucket is used
+func (ac *appConfig) RunName() string {
+	return ac.runName
+}
+
+//LocateRun returns the bucket and key prefix holding the objects of a run as far as the configuration can tell. The
+//run's manifest, when there is one, is the better guide
+func (ac *appConfig) LocateRun(runId string) (string, string) {
+	switch {
+	case ac.fixedBucket == "":
+		return runId, ""
+	case ac.runPrefix == RunPrefixCurrent || runId == RunPrefixCurrent:
+		return ac.fixedBucket, RunPrefixCurrent + "/"
+	default:
+		return ac.fixedBucket, RunPrefixRuns + "/" + runId + "/"
+	}
+}
+
+//BucketSettings returns the settings applied to the bucket once it is created
+func (ac *appConfig) BucketSettings() *BucketSettings {
+	return ac.bucketSettings
+}
+
+//Retention returns the rules deciding which runs prune keeps
+func (ac *appConfig) Retention() *RetentionSettings {
+	return ac.retention
+}
+
+//LocalDestination returns the directory objects are written to or an empty string when storing to AWS S3
+func (ac *appConfig) LocalDestination() string {
+	return ac.localDestination
+}
+
+//Command returns the command to run instead of a backup or an empty string for a backup
+func (ac *appConfig) Command() string {
+	return ac.command
+}
+
+//RunId returns the run to read from when restoring or verifying
+func (ac *appConfig) RunId() string {
+	return ac.runId
+}
+
+//RestoreTarget returns the directory files are restored into
+func (ac *appConfig) RestoreTarget() string {
+	return ac.restoreTarget
+}
+
+//RestoreIncludes returns the regexes limiting which keys are restored. Empty means restore everything
+func (ac *appConfig) RestoreIncludes() []*regexp.Regexp {
+	return ac.restoreIncludes
+}
+
 //Dryrun returns true if the user is asking for a dry run
 func (ac *appConfig) Dryrun() bool {
 	return ac.dryrun
@@ -120,26 +282,87 @@ func (ac *appConfig) Reprocess() bool {
 	return ac.reprocess
 }
 
-//NoConfirm returns true if, during reprocessing, the confirmationmenu should be skipped
+//Resume returns true if the user is asking to continue an interrupted run
+func (ac *appConfig) Resume() bool {
+	return ac.resume
+}
+
+//Rehash returns true if every file should be hashed even if its hash is cached
+func (ac *appConfig) Rehash() bool {
+	return ac.rehash
+}
+
+//NoConfirm returns true if, during reprocessing or pruning, the confirmationmenu should be skipped
 func (ac *appConfig) NoConfirm() bool {
 	return ac.noConfirm
 }
 
+//Incremental returns true if only files changed since the latest manifest should be stored
+func (ac *appConfig) Incremental() bool {
+	return ac.incremental
+}
+
 //Logger returns the logger
 func (ac *appConfig) Logger() *zap.SugaredLogger {
 	return ac.logger
 }
 
+//Keyring returns the keys used for client-side encryption or nil when encryption is not configured
+func (ac *appConfig) Keyring() *Keyring {
+	return ac.keyring
+}
+
+//SkipExisting returns how files already in the destination are found (SkipExistingList or SkipExistingHead) so they
+//are not stored again. Empty when every file is stored
+func (ac *appConfig) SkipExisting() string {
+	return ac.skipExisting
+}
+
+//Repository returns true if file content is stored once, under its hash, and shared by every run
+func (ac *appConfig) Repository() bool {
+	return ac.repository
+}
+
 //FailuresFilename returns the path  of the file where failures will be stored
 func (ac *appConfig) FailuresFilepath() string {
 	return ac.failuresFile
 }
 
+//VerifyFilepath returns the path of the file where verify reports are written
+func (ac *appConfig) VerifyFilepath() string {
+	return ac.verifyFile
+}
+
+//ManifestDir returns the directory where a manifest is written for every run
+func (ac *appConfig) ManifestDir() string {
+	return ac.manifestDir
+}
+
+//JournalFilepath returns the path of the journal recording the progress of a backup
+func (ac *appConfig) JournalFilepath() string {
+	return ac.journalFile
+}
+
+//HashCacheFilepath returns the path of the file caching the hashes of unchanged files. Empty if there is no cache
+func (ac *appConfig) HashCacheFilepath() string {
+	return ac.hashCacheFile
+}
+
+//CatalogFilepath returns the path of the file cataloging every run
+func (ac *appConfig) CatalogFilepath() string {
+	return ac.catalogFile
+}
+
 //Exclusions returns all exclusions in the exclusions file
 func (ac *appConfig) Exclusions() []*Exclusion {
 	return ac.exclusions
 }
 
+//StorageClassRules returns the rules in the storage class rules file, in file order
+func (ac *appConfig) StorageClassRules() []*StorageClassRule {
+	return ac.storageClassRules
+}
+
 //BasePaths returns the base drive and directory where backups begin
 func (ac *appConfig) BasePaths() []string {
 	return ac.basePaths
@@ -180,6 +403,42 @@ func (ac *appConfig) StorageRetryCount() int {
 	return ac.storageRetryCount
 }
 
+//MultipartThreshold returns the size in bytes at and above which objects are stored in parts
+func (ac *appConfig) MultipartThreshold() int64 {
+	return ac.multipartThreshold
+}
+
+//ChunkThreshold returns the size in bytes at and above which files are stored in content-defined chunks. Zero when
+//files are never chunked
+func (ac *appConfig) ChunkThreshold() int64 {
+	return ac.chunkThreshold
+}
+
+//PackThreshold returns the size in bytes below which files are packed into segments. Zero when files are never packed
+func (ac *appConfig) PackThreshold() int64 {
+	return ac.packThreshold
+}
+
+//PackSegmentSize returns the size in bytes at which a segment of packed files is stored and a new one begun
+func (ac *appConfig) PackSegmentSize() int64 {
+	return ac.packSegmentSize
+}
+
+//Compression returns how files are compressed before they are stored: CompressionGzip, or empty when they are not
+func (ac *appConfig) Compression() string {
+	return ac.compression
+}
+
+//MultipartPartSize returns the size in bytes of each part of an object stored in parts
+func (ac *appConfig) MultipartPartSize() int64 {
+	return ac.multipartPartSize
+}
+
+//MultipartRoutinesCount returns the number of go routines each storage routine uses to upload the parts of an object
+func (ac *appConfig) MultipartRoutinesCount() int {
+	return ac.multipartRoutines
+}
+
 //Reads exclusions from a flat file. Each line is a regex indicating a location in the basedir
 //to be excluded
 func (ac *appConfig) readExclusions() ([]*Exclusion, error) {
@@ -234,6 +493,58 @@ func (ac *appConfig) readExclusions() ([]*Exclusion, error) {
 	return exclusions, nil
 }
 
+//Reads storage class rules from a flat file. Each line is a storage class followed by a regex or size threshold. The
+//file is optional - without it every object is stored as STANDARD
+func (ac *appConfig) readStorageClassRules() ([]*StorageClassRule, error) {
+
+	logger := ac.logger
+	defer logger.Sync()
+
+	if ac.storageClassRulesFile == "" {
+		return nil, nil
+	}
+	file, err := os.Open(ac.storageClassRulesFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Infow("no storage class rules file. Objects are stored as STANDARD", "path", ac.storageClassRulesFile, "meta", Chat)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to open storage class rules file: %s", ac.storageClassRulesFile)
+	}
+	defer func() {
+		if err = file.Close(); err != nil {
+			logger.Errorw("failed to close storage class rules file on deferred close\n", "path", ac.storageClassRulesFile, "meta", Core)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	rules := make([]*StorageClassRule, 0)
+
+	index := 0
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		//skip comments and blank lines, as with exclusions
+		if strings.HasPrefix(line, "#") || len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		//assign this rule an index
+		index++
+
+		rule, err := ParseStorageClassRule(index, line)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debugw("adding storage class rule", "id", index, "rule", line, "meta", Chat)
+		rules = append(rules, rule)
+	}
+
+	logger.Infow("added storage class rules from storage class rules file", "ruleCount", len(rules), "path", ac.storageClassRulesFile, "meta", Chat)
+	return rules, nil
+}
+
 //reads which directories to backup from a file
 func (ac *appConfig) readBackupDirectives() error {
 	logger := ac.logger
@@ -249,10 +560,6 @@ func (ac *appConfig) readBackupDirectives() error {
 		}
 	}()
 
-	//create a regex for validating the file contents - checks for drive letter and proper slash (eg C:\)
-	const drivePattern = `^[A-Z]:\\.*`
-	regx := regexp.MustCompile(drivePattern)
-
 	paths := make([]string, 0)
 
 	index := 0
@@ -271,18 +578,13 @@ func (ac *appConfig) readBackupDirectives() error {
 		}
 		index++
 
-		//ensure drive letter, colon and double slashes
-		if !regx.MatchString(line) {
+		//ensure an absolute path this OS understands
+		err = ValidateBackupPath(line)
+		if err != nil {
 			fmt.Println(line)
-			return fmt.Errorf(`%s line: %d defines invalid backup location. Must be of the format: C:\... `, ac.backupFile, index)
+			return fmt.Errorf("%s line: %d defines invalid backup location: %v", ac.backupFile, index, err)
 		}
 
-		//check to make sure slashes are always in pairs
-		// slashCount := strings.Count(line, `\`)
-		// if (slashCount % 2) != 0 {
-		// 	return fmt.Errorf(`%s line: %d defines invalid backup location. All slashes must be double slashes (\\ not \)`, ac.backupFile, index)
-		// }
-
 		paths = append(paths, line)
 	}
 
@@ -297,48 +599,257 @@ func (ac *appConfig) readBackupDirectives() error {
 	return nil
 }
 
+//checks the command is known and has the options it requires
+func (ac *appConfig) readCommandOpts(cmdOpts *CommandOpts) error {
+	if cmdOpts.Command != CommandSnapshots && len(cmdOpts.CommandArgs) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", cmdOpts.CommandArgs)
+	}
+
+	switch cmdOpts.Command {
+	case "":
+		return nil
+	case CommandSnapshots:
+
+		//the run to show is given as an argument rather than with -run
+		args := cmdOpts.CommandArgs
+		switch {
+		case len(args) == 1 && args[0] == SnapshotsList && cmdOpts.RunId == "":
+		case len(args) == 2 && args[0] == SnapshotsShow && cmdOpts.RunId == "":
+			ac.runId = args[1]
+		default:
+			return fmt.Errorf("the %s command is either '%s %s' or '%s %s <run id>'", cmdOpts.Command, cmdOpts.Command, SnapshotsList, cmdOpts.Command, SnapshotsShow)
+		}
+		return nil
+	case CommandPrune:
+		if !ac.retention.IsSet() {
+			return fmt.Errorf("the %s command requires a retention policy - set keep_last, keep_daily, keep_weekly or keep_monthly", cmdOpts.Command)
+		}
+		if ac.fixedBucket != "" && ac.runPrefix == RunPrefixCurrent {
+			return fmt.Errorf("the %s command only deletes runs stored below their own prefix, not below %s/", cmdOpts.Command, RunPrefixCurrent)
+		}
+		return nil
+	case CommandVerify:
+		if cmdOpts.RunId == "" {
+			return fmt.Errorf("the %s command requires a run id", cmdOpts.Command)
+		}
+	case CommandRestore:
+		if cmdOpts.RunId == "" {
+			return fmt.Errorf("the %s command requires a run id", cmdOpts.Command)
+		}
+		if cmdOpts.RestoreTarget == "" {
+			return fmt.Errorf("the %s command requires a target directory", cmdOpts.Command)
+		}
+	default:
+		return fmt.Errorf("unknown command: %s", cmdOpts.Command)
+	}
+
+	//compile any include filters
+	includes := make([]*regexp.Regexp, 0, len(cmdOpts.RestoreIncludes))
+	for _, raw := range cmdOpts.RestoreIncludes {
+		rgx, err := regexp.Compile(raw)
+		if err != nil {
+			return fmt.Errorf("failed to compile include filter: '%s' with error: %v", raw, err)
+		}
+		includes = append(includes, rgx)
+	}
+	ac.restoreIncludes = includes
+
+	return nil
+}
+
+//when resuming, takes the run id, bucket, prefix and incremental mode from the journal of the interrupted run
+func (ac *appConfig) readJournalHeader() error {
+	if !ac.resume {
+		return nil
+	}
+	if ac.reprocess || ac.dryrun || ac.command != "" {
+		return fmt.Errorf("resume cannot be combined with reprocess, dryrun or a command")
+	}
+
+	header, _, err := ReadJournal(ac.journalFile)
+	if err != nil {
+		return err
+	}
+	ac.bucket = header.Bucket
+	ac.prefix = header.Prefix
+	ac.runName = header.RunId
+	if ac.runName == "" { //written before runs had ids of their own
+		ac.runName = header.Bucket
+	}
+	ac.incremental = header.Incremental
+
+	ac.logger.Infow("resuming interrupted run", "runId", ac.runName, "bucketName", header.Bucket, "prefix", header.Prefix, "started", header.Created, "incremental", header.Incremental, "meta", Chat)
+	return nil
+}
+
+//when reprocessing, takes the run id, bucket and prefix from the failures file so failed files are stored alongside the rest of their
+//run. A missing or empty failures file simply leaves nothing to reprocess, which is reported later
+func (ac *appConfig) readFailuresBucket() error {
+	if !ac.reprocess {
+		return nil
+	}
+
+	failures, err := ReadFailureFile(ac.failuresFile)
+	if err != nil || !failures.HasFailures {
+		return nil
+	}
+	if failures.Bucket == "" {
+		return fmt.Errorf("failures file: %s does not record the bucket of the failed run", ac.failuresFile)
+	}
+	ac.bucket = failures.Bucket
+	ac.prefix = failures.Prefix
+	ac.runName = failures.RunId
+	if ac.runName == "" { //written before runs had ids of their own
+		ac.runName = failures.Bucket
+	}
+
+	ac.logger.Infow("reprocessing failures of earlier run", "runId", ac.runName, "bucketName", failures.Bucket, "prefix", failures.Prefix, "meta", Chat)
+	return nil
+}
+
+//creates the keyring from a key file or a passphrase. Encryption stays disabled if neither is given
+func (ac *appConfig) readEncryptionSecret(keyFile string, passphrase string) error {
+	var err error
+	source := ""
+	switch {
+	case keyFile != "" && passphrase != "":
+		return fmt.Errorf("use either a key file or the %s environment variable for encryption, not both", passphraseEnvVar)
+	case keyFile != "":
+		source = "key file"
+		ac.keyring, err = NewKeyFileKeyring(keyFile)
+	case passphrase != "":
+		source = "passphrase"
+		ac.keyring, err = NewPassphraseKeyring(passphrase)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ac.logger.Infow("client-side encryption enabled", "source", source, "meta", Chat)
+	return nil
+}
+
 //stringify the config for display
 func (ac *appConfig) String() string {
 	var sb strings.Builder
 
+	sb.WriteString(fmt.Sprintf("Config File: %s\n", ac.configFile))
 	sb.WriteString(fmt.Sprintf("Dryrun Bucket: %s\n", ac.dryrunBucket))
 	sb.WriteString(fmt.Sprintf("Dryrun Enabled: %t\n", ac.dryrun))
 	sb.WriteString(fmt.Sprintf("Exclusions File: %s\n", ac.exclusionsFile))
 	sb.WriteString(fmt.Sprintf("Failures File: %s\n", ac.failuresFile))
+	sb.WriteString(fmt.Sprintf("Manifest Directory: %s\n", ac.manifestDir))
+	sb.WriteString(fmt.Sprintf("Journal File: %s\n", ac.journalFile))
+	sb.WriteString(fmt.Sprintf("Resume Enabled: %t\n", ac.resume))
+	sb.WriteString(fmt.Sprintf("Hash Cache File: %s\n", ac.hashCacheFile))
+	sb.WriteString(fmt.Sprintf("Catalog File: %s\n", ac.catalogFile))
+	sb.WriteString(fmt.Sprintf("Rehash Enabled: %t\n", ac.rehash))
+	sb.WriteString(fmt.Sprintf("Incremental Enabled: %t\n", ac.incremental))
 	sb.WriteString(fmt.Sprintf("Exclusions Count: %d\n", len(ac.exclusions)))
+	sb.WriteString(fmt.Sprintf("Storage Class Rules File: %s\n", ac.storageClassRulesFile))
+	sb.WriteString(fmt.Sprintf("Storage Class Rules Count: %d\n", len(ac.storageClassRules)))
 	sb.WriteString(fmt.Sprintf("Base Paths: %s\n", ac.basePaths))
+	sb.WriteString(fmt.Sprintf("Local Destination: %s\n", ac.localDestination))
+	sb.WriteString(fmt.Sprintf("Encryption Enabled: %t\n", ac.keyring != nil))
+	sb.WriteString(fmt.Sprintf("Skip Existing Objects: %s\n", ac.skipExisting))
+	sb.WriteString(fmt.Sprintf("Repository Mode: %t\n", ac.repository))
 	sb.WriteString(fmt.Sprintf("AWS Profile: %s\n", ac.awsProfile))
 	sb.WriteString(fmt.Sprintf("AWS Region: %s\n", ac.region))
+	sb.WriteString(fmt.Sprintf("S3 Endpoint: %s\n", ac.s3Endpoint))
+	sb.WriteString(fmt.Sprintf("S3 Path Style Addressing: %t\n", ac.s3PathStyle))
 	sb.WriteString(fmt.Sprintf("Target Bucket: %s\n", ac.bucket))
+	sb.WriteString(fmt.Sprintf("Fixed Bucket: %t\n", ac.fixedBucket != ""))
+	sb.WriteString(fmt.Sprintf("Run Id: %s\n", ac.runName))
+	sb.WriteString(fmt.Sprintf("Key Prefix: %s\n", ac.prefix))
+	sb.WriteString(fmt.Sprintf("Bucket Versioning: %t\n", ac.bucketSettings.Versioning))
+	sb.WriteString(fmt.Sprintf("Bucket Encryption: %s\n", ac.bucketSettings.Encryption))
+	sb.WriteString(fmt.Sprintf("Bucket Public Access Blocked: %t\n", ac.bucketSettings.BlockPublicAccess))
+	sb.WriteString(fmt.Sprintf("Bucket Tags: %t\n", ac.bucketSettings.Tags))
+	sb.WriteString(fmt.Sprintf("Bucket Transition: %d days to %s\n", ac.bucketSettings.TransitionDays, ac.bucketSettings.TransitionStorageClass))
+	sb.WriteString(fmt.Sprintf("Bucket Expiration: %d days\n", ac.bucketSettings.ExpirationDays))
+	sb.WriteString(fmt.Sprintf("Retention: last %d, daily %d, weekly %d, monthly %d\n", ac.retention.KeepLast, ac.retention.KeepDaily, ac.retention.KeepWeekly, ac.retention.KeepMonthly))
 	sb.WriteString(fmt.Sprintf("Number of Hash Routines: %d\n", ac.hashRoutines))
 	sb.WriteString(fmt.Sprintf("Number of Storage Routines: %d\n", ac.storageRoutines))
 	sb.WriteString(fmt.Sprintf("Storage Retry Count: %d\n", ac.storageRetryCount))
+	sb.WriteString(fmt.Sprintf("Multipart Threshold: %d bytes\n", ac.multipartThreshold))
+	sb.WriteString(fmt.Sprintf("Chunk Threshold: %d bytes\n", ac.chunkThreshold))
+	sb.WriteString(fmt.Sprintf("Pack Threshold: %d bytes\n", ac.packThreshold))
+	sb.WriteString(fmt.Sprintf("Pack Segment Size: %d bytes\n", ac.packSegmentSize))
+	sb.WriteString(fmt.Sprintf("Compression: %s\n", ac.compression))
+	sb.WriteString(fmt.Sprintf("Multipart Part Size: %d bytes\n", ac.multipartPartSize))
+	sb.WriteString(fmt.Sprintf("Number of Routines per Multipart Upload: %d\n", ac.multipartRoutines))
 
 	return sb.String()
 }
 
-//create a config based on defaults then override those defaults with sommand line opts
+//create a config based on defaults overridden by the config file, the environment and finally command line opts
 func newConfig(cmdOpts *CommandOpts) (*appConfig, error) {
 
-	//create default config
+	//layer the settings - see Settings for the order
+	settings, configFile, err := loadSettings(cmdOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	//create the config
 	c := &appConfig{
-		dryrunBucket:                  defaultDryrunBucket,
-		region:                        defaultAwsRegion,
-		awsProfile:                    defaultSharedProfile,
-		bucket:                        makeUniqueBucketName(),
+		dryrunBucket:                  settings.DryrunBucket,
+		region:                        settings.AwsRegion,
+		awsProfile:                    settings.AwsProfile,
+		s3Endpoint:                    settings.S3Endpoint,
+		s3PathStyle:                   settings.S3PathStyle,
+		fixedBucket:                   settings.FixedBucket,
+		runPrefix:                     settings.RunPrefix,
+		runName:                       makeRunName(),
+		bucketSettings:                &settings.Bucket,
+		retention:                     &settings.Retention,
+		localDestination:              settings.LocalDestination,
+		skipExisting:                  settings.SkipExisting,
+		repository:                    settings.Repository,
+		configFile:                    configFile,
+		command:                       cmdOpts.Command,
+		runId:                         cmdOpts.RunId,
+		restoreTarget:                 cmdOpts.RestoreTarget,
 		dryrun:                        cmdOpts.Dryrun,
 		reprocess:                     cmdOpts.Reprocess,
+		resume:                        cmdOpts.Resume,
+		rehash:                        cmdOpts.Rehash,
 		noConfirm:                     cmdOpts.NoConfirm,
-		exclusionsFile:                defaultExclusionsFile,
-		backupFile:                    defaultBackupDirectivesFile,
-		failuresFile:                  defaultFailureOutputFile,
-		fileCountEstimate:             defaultFileCountEstimate,
-		hashRoutines:                  defaultHashRoutines,
-		maxHashChannelErrorAllowed:    defaultHashEffortChannelMaxErrorCount,
-		allowedHashFailCount:          defaultAllowedFailedHashCount,
-		storageRoutines:               defaultStorageRoutines,
-		maxStorageChannelErrorAllowed: defaultStorageChannelMaxErrorRate,
-		storageRetryCount:             defaultStorageRetryCount,
+		incremental:                   cmdOpts.Incremental,
+		exclusionsFile:                settings.ExclusionsFile,
+		storageClassRulesFile:         settings.StorageClassRulesFile,
+		backupFile:                    settings.BackupDirectivesFile,
+		failuresFile:                  settings.FailuresFile,
+		verifyFile:                    settings.VerifyFile,
+		manifestDir:                   settings.ManifestDir,
+		journalFile:                   settings.JournalFile,
+		hashCacheFile:                 settings.HashCacheFile,
+		catalogFile:                   settings.CatalogFile,
+		fileCountEstimate:             settings.FileCountEstimate,
+		hashRoutines:                  settings.HashRoutines,
+		maxHashChannelErrorAllowed:    settings.HashRoutineMaxErrors,
+		allowedHashFailCount:          settings.MaxFailedHashes,
+		storageRoutines:               settings.StorageRoutines,
+		maxStorageChannelErrorAllowed: settings.StorageRoutineMaxErrors,
+		storageRetryCount:             settings.StorageRetryCount,
+		multipartThreshold:            int64(settings.MultipartThresholdMB) * bytesPerMB,
+		chunkThreshold:                int64(settings.ChunkThresholdMB) * bytesPerMB,
+		packThreshold:                 int64(settings.PackThresholdKB) * bytesPerKB,
+		packSegmentSize:               int64(settings.PackSegmentSizeMB) * bytesPerMB,
+		compression:                   settings.Compression,
+		multipartPartSize:             int64(settings.MultipartPartSizeMB) * bytesPerMB,
+		multipartRoutines:             settings.MultipartRoutines,
+	}
+
+	//each run creates a bucket named after it unless a fixed bucket holds every run, each below a prefix
+	c.bucket, c.prefix = c.LocateRun(c.runName)
+
+	//validate the command and the options it needs
+	err = c.readCommandOpts(cmdOpts)
+	if err != nil {
+		return nil, err
 	}
 
 	//create logger with INFO level enabled
@@ -368,6 +879,9 @@ func newConfig(cmdOpts *CommandOpts) (*appConfig, error) {
 	c.logger = zapLogger.Sugar()
 	defer c.logger.Sync()
 	c.logger.Infow("zap logger configured and available", "meta", Chat)
+	if configFile != "" {
+		c.logger.Infow("settings read from config file", "path", configFile, "meta", Chat)
+	}
 
 	//read and compile regex exclusions from flat file
 	exclusions, err := c.readExclusions()
@@ -376,17 +890,75 @@ func newConfig(cmdOpts *CommandOpts) (*appConfig, error) {
 	}
 	c.exclusions = exclusions
 
+	//read the rules picking the storage class of each object, if any
+	storageClassRules, err := c.readStorageClassRules()
+	if err != nil {
+		return nil, err
+	}
+	c.storageClassRules = storageClassRules
+
 	//read backup directives from file
 	err = c.readBackupDirectives()
 	if err != nil {
 		return nil, err
 	}
 
+	//a resumed run continues in the bucket of the run it resumes and reprocessing finishes the run that failed
+	err = c.readJournalHeader()
+	if err != nil {
+		return nil, err
+	}
+	err = c.readFailuresBucket()
+	if err != nil {
+		return nil, err
+	}
+
+	//load the encryption key or passphrase, if any
+	err = c.readEncryptionSecret(settings.KeyFile, os.Getenv(passphraseEnvVar))
+	if err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
-//create a new bucket name based on date and UUID
-func makeUniqueBucketName() string {
+//builds the settings from the defaults, the config file, the environment and the command line. Also returns the
+//path of the config file that was read, if any
+func loadSettings(cmdOpts *CommandOpts) (*Settings, string, error) {
+	settings := DefaultSettings()
+
+	//a config file named on the command line or in the environment must exist - the default one need not
+	configFile, required := DefaultConfigFile, false
+	if env := os.Getenv(ConfigFileEnvVar); env != "" {
+		configFile, required = env, true
+	}
+	if cmdOpts.ConfigFile != "" {
+		configFile, required = cmdOpts.ConfigFile, true
+	}
+
+	loaded, err := settings.LoadFile(configFile, required)
+	if err != nil {
+		return nil, "", err
+	}
+	if !loaded {
+		configFile = ""
+	}
+
+	err = settings.ApplyEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	settings.ApplyCommandOpts(cmdOpts)
+
+	err = settings.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+	return settings, configFile, nil
+}
+
+//create a new run id based on date and UUID. It doubles as the bucket name unless a fixed bucket is used
+func makeRunName() string {
 	dateName := time.Now().Format("02Jan2006")
 	dateName = strings.ToLower(dateName)
 	uid := uuid.New()
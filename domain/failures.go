@@ -1,17 +1,44 @@
 package domain
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
 //BackupFailures holds information about failed file transfers for a given transfer/backup attempt
 type BackupFailures struct {
 
 	//DateCreated is the creation date and time of this struct
 	DateCreated string
 
+	//RunId is the id of the run. Empty in files written when the bucket doubled as the run id
+	RunId string `json:"runId,omitempty"`
+
 	//Bucket is the name of the bucket to which the files should have been transferred
 	Bucket string `json:"bucket"`
 
+	//Prefix is the prefix of every key the run stores, if any
+	Prefix string `json:"prefix,omitempty"`
+
 	//HasFailures is true when there is at least one failure
 	HasFailures bool `json:"hasFailures"`
 
 	//FailedPaths contains the information about each failed file
 	FailedPaths []*FileInfo
 }
+
+//ReadFailureFile reads a failures file written by an earlier run
+func ReadFailureFile(path string) (*BackupFailures, error) {
+	jsonBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JSON failures file: %s because: %v", path, err)
+	}
+
+	var failures BackupFailures
+	err = json.Unmarshal(jsonBytes, &failures)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal JSON failures file: %s because: %v", path, err)
+	}
+	return &failures, nil
+}
@@ -1,5 +1,9 @@
 package domain
 
+import (
+	"time"
+)
+
 //FileInfo holds data about a single file that might be transfered
 type FileInfo struct {
 
@@ -9,17 +13,34 @@ type FileInfo struct {
 	//Size is the size in bytes of the file
 	Size int64
 
+	//ModTime is the last modification time of the file as reported by the filesystem
+	ModTime time.Time
+
 	//Excluded is true if a rule has excluded this object from backup
 	Excluded bool
 
 	//Hash is set to the MD5 hash of the object. Used to confirm the object was sent to AWS as expected
 	Hash string
 
+	//ContentHash is the hex SHA-256 of the object. Only set in repository mode, where it names the content object
+	ContentHash string
+
+	//Packed is set true if the file was packed into the segment stored under Key rather than given an object of its
+	//own. Offset is then the position of the file's content within the segment
+	Packed bool
+	Offset int64
+
 	//HashSuccess is set true if the local object has been hashed without error
 	HashSuccess bool
 
 	//StorageSuccess is set true if the local object has been confirmed to be stored in AWS S3
 	StorageSuccess bool
+
+	//Bucket is the bucket holding the stored object. During an incremental backup this is the bucket of an earlier run for unchanged files
+	Bucket string
+
+	//Key is the key of the stored object within Bucket
+	Key string
 }
 
 //Copy returns a deep copy of the current FileINfo object
@@ -27,9 +48,15 @@ func (fi FileInfo) Copy() *FileInfo {
 	return &FileInfo{
 		FullName:       fi.FullName,
 		Size:           fi.Size,
+		ModTime:        fi.ModTime,
 		Excluded:       fi.Excluded,
 		Hash:           fi.Hash,
+		ContentHash:    fi.ContentHash,
+		Packed:         fi.Packed,
+		Offset:         fi.Offset,
 		HashSuccess:    fi.HashSuccess,
 		StorageSuccess: fi.StorageSuccess,
+		Bucket:         fi.Bucket,
+		Key:            fi.Key,
 	}
 }
@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+//JournalHeader is the first line of a journal and describes the run it belongs to
+type JournalHeader struct {
+
+	//Created is when the run began
+	Created time.Time `json:"created"`
+
+	//RunId is the id of the run. Empty in journals written when the bucket doubled as the run id
+	RunId string `json:"runId,omitempty"`
+
+	//Bucket is the bucket the run stores objects in
+	Bucket string `json:"bucket"`
+
+	//Prefix is the prefix of every key the run stores, if any
+	Prefix string `json:"prefix,omitempty"`
+
+	//Incremental is true if the run only stores files changed since the latest manifest
+	Incremental bool `json:"incremental"`
+
+	//BasedOn is the id of the run an incremental backup was compared against
+	BasedOn string `json:"basedOn,omitempty"`
+}
+
+//JournalEntry records the hash and storage outcome of a single file. A file may appear more than once (eg when a
+//resumed run retries it) in which case the last entry wins
+type JournalEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash,omitempty"`
+	Hashed  bool      `json:"hashed"`
+	Stored  bool      `json:"stored"`
+	Bucket  string    `json:"bucket,omitempty"`
+	Key     string    `json:"key,omitempty"`
+
+	//ContentHash is the hex SHA-256 of the file, only recorded in repository mode
+	ContentHash string `json:"contentHash,omitempty"`
+
+	//Packed is set true if the file was packed into a segment. Offset is then the position of its content within it
+	Packed bool  `json:"packed,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+}
+
+//Journal is an append-only record of a run, one json document per line, written as files finish so an interrupted
+//run can be resumed. It is not safe for concurrent use
+type Journal struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+//CreateJournal starts a new journal for a run, replacing any earlier journal at path
+func CreateJournal(path string, header *JournalHeader) (*Journal, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create journal file: %s error: %v", path, err)
+	}
+	j := &Journal{file: file, encoder: json.NewEncoder(file)}
+
+	err = j.encoder.Encode(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to write journal header: %s error: %v", path, err)
+	}
+	return j, nil
+}
+
+//AppendJournal reopens an existing journal so a resumed run can add to it. A final entry cut short when the earlier
+//run died is dropped first so the new entries do not run on from it
+func AppendJournal(path string) (*Journal, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read journal file: %s error: %v", path, err)
+	}
+	complete := bytes.LastIndexByte(raw, '\n') + 1
+	if complete < len(raw) {
+		err = os.Truncate(path, int64(complete))
+		if err != nil {
+			return nil, fmt.Errorf("unable to truncate journal file: %s error: %v", path, err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal file: %s error: %v", path, err)
+	}
+	return &Journal{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+//Record appends the outcome of a single file. Each entry is a single write so a crash can at worst lose or cut
+//short the entry being written
+func (j *Journal) Record(fi *FileInfo) error {
+	return j.encoder.Encode(&JournalEntry{
+		Path:    fi.FullName,
+		Size:    fi.Size,
+		ModTime: fi.ModTime,
+		Hash:    fi.Hash,
+		Hashed:  fi.HashSuccess,
+		Stored:  fi.StorageSuccess,
+		Bucket:  fi.Bucket,
+		Key:     fi.Key,
+
+		ContentHash: fi.ContentHash,
+		Packed:      fi.Packed,
+		Offset:      fi.Offset,
+	})
+}
+
+//Close closes the journal file
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+//ReadJournal reads a journal, returning its header and the latest entry for each file keyed by path. A damaged final
+//line - the run died while writing it - is ignored
+func ReadJournal(path string) (*JournalHeader, map[string]*JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open journal file: %s error: %v", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("journal file: %s is empty", path)
+	}
+	var header JournalHeader
+	err = json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil || header.Bucket == "" {
+		return nil, nil, fmt.Errorf("journal file: %s has an invalid header", path)
+	}
+
+	entries := make(map[string]*JournalEntry)
+	line := 1
+	var badLine error
+	for scanner.Scan() {
+		line++
+
+		//a bad line is only acceptable if it is the last one
+		if badLine != nil {
+			return nil, nil, badLine
+		}
+		var e JournalEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			badLine = fmt.Errorf("journal file: %s line: %d is invalid: %v", path, line, err)
+			continue
+		}
+		entries[e.Path] = &e
+	}
+	if scanner.Err() != nil {
+		return nil, nil, fmt.Errorf("unable to read journal file: %s error: %v", path, scanner.Err())
+	}
+	return &header, entries, nil
+}
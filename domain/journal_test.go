@@ -0,0 +1,105 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	header := `{"created":"2026-10-16T10:00:00Z","runId":"run","bucket":"nightly","prefix":"runs/run/","incremental":false}`
+	entryA := `{"path":"/a","size":1,"modTime":"2026-10-16T09:00:00Z","hash":"h1","hashed":true,"stored":false}`
+	entryB := `{"path":"/b","size":2,"modTime":"2026-10-16T09:00:00Z","hash":"h2","hashed":true,"stored":true,"bucket":"nightly","key":"runs/run/b"}`
+	entryA2 := `{"path":"/a","size":1,"modTime":"2026-10-16T09:00:00Z","hash":"h1","hashed":true,"stored":true,"bucket":"nightly","key":"runs/run/a"}`
+
+	tests := []struct {
+		name        string
+		content     string
+		wantErr     bool
+		wantEntries []string
+		wantStoredA bool
+	}{
+		{"header only", header + "\n", false, []string{}, false},
+		{"complete journal", header + "\n" + entryA + "\n" + entryB + "\n", false, []string{"/a", "/b"}, false},
+		{"last entry wins", header + "\n" + entryA + "\n" + entryB + "\n" + entryA2 + "\n", false, []string{"/a", "/b"}, true},
+		{"last line cut short", header + "\n" + entryA + "\n" + entryB[:30], false, []string{"/a"}, false},
+		{"last line cut short with newline", header + "\n" + entryA + "\n" + entryB[:30] + "\n", false, []string{"/a"}, false},
+		{"last line without newline is kept", header + "\n" + entryA + "\n" + entryB, false, []string{"/a", "/b"}, false},
+		{"damaged line before the last", header + "\n" + entryA[:30] + "\n" + entryB + "\n", true, nil, false},
+		{"empty file", "", true, nil, false},
+		{"damaged header", header[:20] + "\n" + entryA + "\n", true, nil, false},
+		{"header without bucket", `{"created":"2026-10-16T10:00:00Z"}` + "\n", true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.jsonl")
+			err := os.WriteFile(path, []byte(tt.content), 0664)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotHeader, entries, err := ReadJournal(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadJournal() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if gotHeader.RunId != "run" || gotHeader.Bucket != "nightly" || gotHeader.Prefix != "runs/run/" {
+				t.Errorf("ReadJournal() header = %+v", gotHeader)
+			}
+			paths := make([]string, 0, len(entries))
+			for p := range entries {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			if strings.Join(paths, ",") != strings.Join(tt.wantEntries, ",") {
+				t.Errorf("ReadJournal() entries = %v, want %v", paths, tt.wantEntries)
+			}
+			if a, found := entries["/a"]; found && a.Stored != tt.wantStoredA {
+				t.Errorf("ReadJournal() entry /a stored = %t, want %t", a.Stored, tt.wantStoredA)
+			}
+		})
+	}
+}
+
+func TestAppendJournalDropsCutShortEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	journal, err := CreateJournal(path, &JournalHeader{RunId: "run", Bucket: "nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Record(&FileInfo{FullName: "/a", Size: 1, Hash: "h1", HashSuccess: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	//the run died part way through writing an entry
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"/b","si`)
+	f.Close()
+
+	journal, err = AppendJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Record(&FileInfo{FullName: "/c", Size: 3, Hash: "h3", HashSuccess: true, StorageSuccess: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	_, entries, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries["/a"] == nil || entries["/c"] == nil || !entries["/c"].Stored {
+		t.Errorf("ReadJournal() after resume = %v, want /a and a stored /c", entries)
+	}
+}
@@ -0,0 +1,179 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+
+	//KeyLength is the length in bytes of every encryption key (AES-256)
+	KeyLength = 32
+
+	//KdfKeyFile names keys read directly from a key file
+	KdfKeyFile = "keyfile"
+
+	//scrypt cost parameters used for new backups. They are recorded with each object so they can change later
+	scryptN        = 32768
+	scryptR        = 8
+	scryptP        = 1
+	scryptSaltSize = 16
+	scryptPrefix   = "scrypt"
+
+	//the largest cost parameters accepted from an object's metadata, so a damaged or hostile value cannot exhaust
+	//memory or hang a restore. scrypt needs 128*N*r bytes
+	maxScryptN      = 1 << 20
+	maxScryptRP     = 32
+	maxScryptMemory = 1 << 30
+
+	//namingLabel and namingSalt derive the key content names are keyed with. A passphrase needs a fixed salt (and
+	//fixed scrypt parameters) as every run must derive the same names. None of these may ever change
+	namingLabel   = "backup content names"
+	namingSalt    = "backup-content-names"
+	namingScryptN = 32768
+	namingScryptR = 8
+	namingScryptP = 1
+)
+
+//Keyring holds the secret used for client-side encryption - either a raw key from a key file or a passphrase - and
+//derives (and caches) the keys used to encrypt this run and decrypt earlier ones
+type Keyring struct {
+	fileKey    []byte
+	passphrase []byte
+
+	//a single salt is generated per run so the (deliberately slow) key derivation happens once per run
+	runSaltOnce sync.Once
+	runSalt     []byte
+	runSaltErr  error
+
+	mu      sync.Mutex
+	derived map[string][]byte
+
+	//namingKey keys the names content is stored under in a repository
+	namingKey []byte
+}
+
+//NewKeyFileKeyring creates a keyring from a key file holding either 32 raw bytes or 64 hex characters
+func NewKeyFileKeyring(keyFile string) (*Keyring, error) {
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %s error: %v", keyFile, err)
+	}
+
+	key := raw
+	if len(raw) != KeyLength {
+		key, err = hex.DecodeString(string(bytes.TrimSpace(raw)))
+		if err != nil || len(key) != KeyLength {
+			return nil, fmt.Errorf("key file: %s must hold %d raw bytes or %d hex characters", keyFile, KeyLength, KeyLength*2)
+		}
+	}
+	return &Keyring{fileKey: key, derived: make(map[string][]byte), namingKey: deriveNamingKey(key)}, nil
+}
+
+//NewPassphraseKeyring creates a keyring that derives keys from a passphrase using scrypt
+func NewPassphraseKeyring(passphrase string) (*Keyring, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("encryption passphrase must not be empty")
+	}
+	secret, err := scrypt.Key([]byte(passphrase), []byte(namingSalt), namingScryptN, namingScryptR, namingScryptP, KeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key: %v", err)
+	}
+	return &Keyring{passphrase: []byte(passphrase), derived: make(map[string][]byte), namingKey: deriveNamingKey(secret)}, nil
+}
+
+//derives the key content names are keyed with from a secret, keeping it apart from any key used for encryption
+func deriveNamingKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(namingLabel))
+	return mac.Sum(nil)
+}
+
+//ContentName returns the name content with the given hex SHA-256 is stored under in a repository. With encryption
+//it is the HMAC-SHA256 of the hash keyed from the keyring instead, so object names never reveal which content the
+//repository holds to anyone without the key file or passphrase
+func ContentName(keyring *Keyring, contentHash string) string {
+	if keyring == nil {
+		return contentHash
+	}
+	mac := hmac.New(sha256.New, keyring.namingKey)
+	mac.Write([]byte(contentHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//RunKey returns the key the keys of objects encrypted during this run are derived from, along with the name of the
+//key derivation function and the salt, both of which must be stored with each object to derive the key again on
+//restore
+func (k *Keyring) RunKey() ([]byte, string, []byte, error) {
+	if k.fileKey != nil {
+		return k.fileKey, KdfKeyFile, nil, nil
+	}
+
+	k.runSaltOnce.Do(func() {
+		k.runSalt = make([]byte, scryptSaltSize)
+		_, k.runSaltErr = rand.Read(k.runSalt)
+	})
+	if k.runSaltErr != nil {
+		return nil, "", nil, fmt.Errorf("unable to generate salt: %v", k.runSaltErr)
+	}
+
+	kdf := fmt.Sprintf("%s-%d-%d-%d", scryptPrefix, scryptN, scryptR, scryptP)
+	key, err := k.Key(kdf, k.runSalt)
+	return key, kdf, k.runSalt, err
+}
+
+//Key returns the key for a key derivation function name and salt as recorded with an object
+func (k *Keyring) Key(kdf string, salt []byte) ([]byte, error) {
+	if kdf == KdfKeyFile {
+		if k.fileKey == nil {
+			return nil, fmt.Errorf("object was encrypted with a key file but no key file is configured")
+		}
+		return k.fileKey, nil
+	}
+
+	//eg scrypt-32768-8-1
+	parts := strings.Split(kdf, "-")
+	if len(parts) != 4 || parts[0] != scryptPrefix {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", kdf)
+	}
+	if k.passphrase == nil {
+		return nil, fmt.Errorf("object was encrypted with a passphrase but no passphrase is configured")
+	}
+	params := make([]int, 3)
+	for i, p := range parts[1:] {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key derivation function: %s", kdf)
+		}
+		params[i] = v
+	}
+	n, r, p := params[0], params[1], params[2]
+	if n <= 1 || n > maxScryptN || r < 1 || p < 1 || r > maxScryptRP || p > maxScryptRP || r*p > maxScryptRP ||
+		128*n*r > maxScryptMemory {
+		return nil, fmt.Errorf("key derivation function parameters out of range: %s", kdf)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cacheKey := kdf + "/" + hex.EncodeToString(salt)
+	if key, found := k.derived[cacheKey]; found {
+		return key, nil
+	}
+	key, err := scrypt.Key(k.passphrase, salt, n, r, p, KeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key: %v", err)
+	}
+	k.derived[cacheKey] = key
+	return key, nil
+}
@@ -0,0 +1,97 @@
+package domain
+
+import (
+	"time"
+)
+
+const (
+
+	//indexName is the name of the object, below a run's prefix, holding the run's index
+	indexName = "index.json"
+
+	//segmentDir and segmentExtension place each segment of packed files below a run's prefix. Segments are tar files
+	segmentDir       = "segments/"
+	segmentExtension = ".tar"
+)
+
+//Manifest records every file held by a single backup run
+type Manifest struct {
+
+	//Created is the time the manifest was written at the end of the run
+	Created time.Time `json:"created"`
+
+	//RunId is the id of the run. Empty in manifests written when the bucket doubled as the run id - see Id
+	RunId string `json:"runId,omitempty"`
+
+	//Bucket is the name of the bucket the run stored its objects in
+	Bucket string `json:"bucket"`
+
+	//Prefix is the prefix of every key the run stored, if any
+	Prefix string `json:"prefix,omitempty"`
+
+	//Destination names where the run's objects were stored: the local destination directory, or the S3 endpoint
+	//(s3 for AWS itself)
+	Destination string `json:"destination,omitempty"`
+
+	//Repository is true if the run stored its files' content in repository mode
+	Repository bool `json:"repository,omitempty"`
+
+	//BasePaths are the base paths the run backed up
+	BasePaths []string `json:"basePaths,omitempty"`
+
+	//Incremental is true if the run only stored files that changed since the run named in BasedOn
+	Incremental bool `json:"incremental"`
+
+	//BasedOn is the id of the run whose manifest an incremental run was compared against, if any
+	BasedOn string `json:"basedOn,omitempty"`
+
+	//Entries holds one entry for every file that is part of this backup
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+//Id returns the id of the run that wrote the manifest
+func (m *Manifest) Id() string {
+	if m.RunId == "" {
+		return m.Bucket
+	}
+	return m.RunId
+}
+
+//ManifestEntry describes one file in a manifest and where its content is stored
+type ManifestEntry struct {
+
+	//Path is the full name of the file on the local filesystem
+	Path string `json:"path"`
+
+	//Size is the size in bytes of the file
+	Size int64 `json:"size"`
+
+	//ModTime is the last modification time of the file
+	ModTime time.Time `json:"modTime"`
+
+	//Hash is the base64-encoded MD5 hash of the file
+	Hash string `json:"hash"`
+
+	//Bucket is the bucket holding the file's object. Unchanged files of an incremental run point at an earlier run's bucket
+	Bucket string `json:"bucket"`
+
+	//Key is the key of the file's object within Bucket
+	Key string `json:"key"`
+
+	//Packed is set true if the file was packed into the segment stored under Key. Offset is then the position of the
+	//file's content within the segment, which is Size bytes long
+	Packed bool  `json:"packed,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+}
+
+//IndexKey returns the key of the copy of a run's manifest stored with the run, given the run's prefix. In repository
+//mode, or when small files are packed, the keys of a run's objects no longer say which file each one holds - the
+//index does
+func IndexKey(prefix string) string {
+	return prefix + ReservedKeyPrefix + indexName
+}
+
+//SegmentKey returns the key of a segment of packed files, given the prefix of the run storing it and the segment's id
+func SegmentKey(prefix string, id string) string {
+	return prefix + ReservedKeyPrefix + segmentDir + id + segmentExtension
+}
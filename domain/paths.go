@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+//paths accepted in the backup directives file
+var (
+	windowsDrivePathRegex = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+	windowsUNCPathRegex   = regexp.MustCompile(`^(\\\\|//)[^\\/]+[\\/][^\\/]+`)
+)
+
+//UNCKeyPrefix leads every key made from a UNC path (eg \\server\share\foo becomes UNC/server/share/foo)
+const UNCKeyPrefix = "UNC"
+
+//isWindows is true when paths use Windows conventions (drive letters, UNC paths and backslash separators)
+var isWindows = runtime.GOOS == "windows"
+
+//ValidateBackupPath checks that a backup directive is an absolute path for this OS: a drive path (C:\...) or a UNC
+//path (\\server\share\...) on Windows and a path starting with / everywhere else
+func ValidateBackupPath(p string) error {
+	return validateBackupPath(p, isWindows)
+}
+
+func validateBackupPath(p string, windows bool) error {
+	if windows {
+		if windowsDrivePathRegex.MatchString(p) || windowsUNCPathRegex.MatchString(p) {
+			return nil
+		}
+		return fmt.Errorf(`must be of the format: C:\... or \\server\share\...`)
+	}
+	if strings.HasPrefix(p, "/") {
+		return nil
+	}
+	return fmt.Errorf("must be an absolute path of the format: /...")
+}
+
+//NormalizePath returns a path with forward slash separators, the form exclusion rules may be written against
+//on any OS. Paths are already in that form everywhere but Windows
+func NormalizePath(p string) string {
+	return normalizePath(p, isWindows)
+}
+
+func normalizePath(p string, windows bool) string {
+	if windows {
+		return strings.ReplaceAll(p, `\`, "/")
+	}
+	return p
+}
+
+//KeyForPath converts a local path to its object key. The layout is the same whichever OS made the backup:
+//E:\foo\bar becomes E:/foo/bar, \\server\share\foo becomes UNC/server/share/foo and /home/foo becomes home/foo
+func KeyForPath(p string) string {
+	return keyForPath(p, isWindows)
+}
+
+//KeyForRecordedPath converts a path recorded by a backup (eg in a manifest) to its object key. The backup may have run
+//on another OS, so whether the path is a Windows one is told by its own syntax rather than by this OS
+func KeyForRecordedPath(p string) string {
+	return keyForPath(p, windowsDrivePathRegex.MatchString(p) || windowsUNCPathRegex.MatchString(p))
+}
+
+func keyForPath(p string, windows bool) string {
+	p = normalizePath(p, windows)
+	if windows && strings.HasPrefix(p, "//") {
+		return UNCKeyPrefix + "/" + strings.TrimLeft(p, "/")
+	}
+	return strings.TrimLeft(p, "/")
+}
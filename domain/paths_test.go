@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestValidateBackupPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		windows bool
+		wantErr bool
+	}{
+		{"drive path", `E:\Misc\foo`, true, false},
+		{"drive path with forward slashes", `E:/Misc/foo`, true, false},
+		{"drive without separator", `E:Misc`, true, true},
+		{"UNC path", `\\server\share\foo`, true, false},
+		{"UNC path with forward slashes", `//server/share/foo`, true, false},
+		{"UNC server without share", `\\server`, true, true},
+		{"POSIX path on windows", `/home/foo`, true, true},
+		{"POSIX path", `/home/foo`, false, false},
+		{"relative POSIX path", `home/foo`, false, true},
+		{"drive path on POSIX", `E:\Misc\foo`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackupPath(tt.path, tt.windows)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBackupPath(%q, %t) error = %v, wantErr %t", tt.path, tt.windows, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		windows bool
+		want    string
+	}{
+		{"drive path", `E:\Misc\foo`, true, "E:/Misc/foo"},
+		{"UNC path", `\\server\share\foo`, true, "//server/share/foo"},
+		{"POSIX path", `/home/foo`, false, "/home/foo"},
+		{"POSIX backslash is part of the name", `/home/a\b`, false, `/home/a\b`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizePath(tt.path, tt.windows)
+			if got != tt.want {
+				t.Errorf("normalizePath(%q, %t) = %q, want %q", tt.path, tt.windows, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyForPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		windows bool
+		want    string
+	}{
+		{"drive path", `E:\Misc\foo`, true, "E:/Misc/foo"},
+		{"UNC path", `\\server\share\foo`, true, "UNC/server/share/foo"},
+		{"UNC path with forward slashes", `//server/share/foo`, true, "UNC/server/share/foo"},
+		{"POSIX path", `/home/foo`, false, "home/foo"},
+		{"POSIX backslash is part of the name", `/home/a\b`, false, `home/a\b`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keyForPath(tt.path, tt.windows)
+			if got != tt.want {
+				t.Errorf("keyForPath(%q, %t) = %q, want %q", tt.path, tt.windows, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyForRecordedPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"drive path", `E:\Misc\foo`, "E:/Misc/foo"},
+		{"UNC path", `\\server\share\foo`, "UNC/server/share/foo"},
+		{"POSIX path", `/home/foo`, "home/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := KeyForRecordedPath(tt.path)
+			if got != tt.want {
+				t.Errorf("KeyForRecordedPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
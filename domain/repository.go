@@ -0,0 +1,52 @@
+package domain
+
+import (
+	"strings"
+)
+
+const (
+
+	//RepositoryDataPrefix begins the key of every content object in a repository. The rest of the key is the
+	//content's name (see ContentName), so identical files share a single object
+	RepositoryDataPrefix = "data/"
+
+	//chunkListSuffix ends the key of a chunked file's chunk list, which is stored in place of the file's content
+	chunkListSuffix = ".chunks"
+)
+
+//ContentKey returns the key a repository stores content under, given the content's name
+func ContentKey(name string) string {
+	return RepositoryDataPrefix + name
+}
+
+//ChunkListKey returns the key a repository stores the chunk list of a chunked file under, given the name of the
+//whole file's content
+func ChunkListKey(name string) string {
+	return ContentKey(name) + chunkListSuffix
+}
+
+//IsChunkListKey returns true if the key is that of a chunk list rather than of content
+func IsChunkListKey(key string) bool {
+	return strings.HasPrefix(key, RepositoryDataPrefix) && strings.HasSuffix(key, chunkListSuffix)
+}
+
+//ChunkList is stored in place of the content of a chunked file. Each chunk is stored as content in its own right,
+//so chunks shared by files, or by versions of the same file, are stored once
+type ChunkList struct {
+
+	//Size is the size in bytes of the whole file
+	Size int64 `json:"size"`
+
+	//Chunks lists the file's chunks in order
+	Chunks []*ChunkRef `json:"chunks"`
+}
+
+//ChunkRef is a single chunk of a chunked file
+type ChunkRef struct {
+
+	//Hash is the chunk's name (see ContentName), which it is stored under as ContentKey(Hash)
+	Hash string `json:"hash"`
+
+	//Size is the size in bytes of the chunk
+	Size int64 `json:"size"`
+}
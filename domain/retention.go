@@ -0,0 +1,132 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+//reasons a run is kept by prune
+const (
+	KeepReasonLast    = "last"
+	KeepReasonDaily   = "daily"
+	KeepReasonWeekly  = "weekly"
+	KeepReasonMonthly = "monthly"
+
+	//KeepReasonBase is followed by the id of a kept incremental run whose unchanged files are stored in the run
+	KeepReasonBase = "base of "
+
+	//KeepReasonJournal and KeepReasonFailures keep the runs a resume or reprocess would continue
+	KeepReasonJournal  = "journal"
+	KeepReasonFailures = "failures"
+)
+
+//runNamePattern matches the ids made by makeRunName: the date the run began followed by a uuid
+var runNamePattern = regexp.MustCompile(`^(\d{2}[a-z]{3}\d{4})-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+//IsRunName returns true if a bucket name or prefix element is the id of a run made by this app
+func IsRunName(name string) bool {
+	return runNamePattern.MatchString(name)
+}
+
+//RunNameDate returns the date a run began according to its id, at midnight local time. Only used when nothing better
+//(the catalog or the run's manifest) says when the run began
+func RunNameDate(name string) (time.Time, error) {
+	match := runNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("not a run id: %s", name)
+	}
+	return time.ParseInLocation("02Jan2006", match[1], time.Local)
+}
+
+//RetentionSettings decide which runs the prune command keeps. A run is kept if any rule keeps it. Zero disables a rule
+type RetentionSettings struct {
+
+	//KeepLast keeps this many of the most recent runs
+	KeepLast int `yaml:"keep_last"`
+
+	//KeepDaily, KeepWeekly and KeepMonthly keep the most recent run of each of this many days, weeks and months
+	//that have a run (grandfather-father-son rotation)
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+}
+
+//IsSet returns true if any rule is enabled
+func (r *RetentionSettings) IsSet() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0
+}
+
+//checks the retention settings make sense
+func (r *RetentionSettings) validate() error {
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 {
+		return fmt.Errorf("retention counts must not be negative")
+	}
+	return nil
+}
+
+//RetainedRun is a run considered by prune
+type RetainedRun struct {
+
+	//RunId is the id of the run
+	RunId string
+
+	//Bucket and Prefix locate the run's objects. An empty prefix means the run has a bucket of its own
+	Bucket string
+	Prefix string
+
+	//Started is when the run began
+	Started time.Time
+
+	//BasedOn is the id of the run an incremental run was based on, if known. Its objects are still in use
+	BasedOn string
+
+	//Reasons lists why the run is kept. A run without any is deleted
+	Reasons []string
+}
+
+//Keep returns true if the run is to be kept
+func (r *RetainedRun) Keep() bool {
+	return len(r.Reasons) > 0
+}
+
+//Apply sorts runs newest first and adds the reasons each run is kept by the retention rules
+func (r *RetentionSettings) Apply(runs []*RetainedRun) {
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Started.After(runs[j].Started)
+	})
+
+	for i, run := range runs {
+		if i < r.KeepLast {
+			run.Reasons = append(run.Reasons, KeepReasonLast)
+		}
+	}
+	keepNewestPerPeriod(runs, r.KeepDaily, KeepReasonDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewestPerPeriod(runs, r.KeepWeekly, KeepReasonWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepNewestPerPeriod(runs, r.KeepMonthly, KeepReasonMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+}
+
+//keeps the newest run of each of the count most recent periods that have a run. Runs must be sorted newest first
+func keepNewestPerPeriod(runs []*RetainedRun, count int, reason string, period func(time.Time) string) {
+	last := ""
+	for _, run := range runs {
+		if count == 0 {
+			return
+		}
+		p := period(run.Started.Local())
+		if p == last {
+			continue
+		}
+		last = p
+		run.Reasons = append(run.Reasons, reason)
+		count--
+	}
+}
@@ -0,0 +1,116 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionSettingsApply(t *testing.T) {
+
+	//runs are named by when they began, local time, so the periods they fall in do not depend on the time zone
+	tests := []struct {
+		name      string
+		retention RetentionSettings
+		runs      []string
+		want      map[string][]string
+	}{
+		{
+			"nothing set keeps nothing",
+			RetentionSettings{},
+			[]string{"2026-10-14 12:00", "2026-10-15 12:00"},
+			map[string][]string{},
+		},
+		{
+			"keep last, whatever order the runs come in",
+			RetentionSettings{KeepLast: 2},
+			[]string{"2026-10-13 12:00", "2026-10-15 12:00", "2026-10-12 12:00", "2026-10-14 12:00"},
+			map[string][]string{
+				"2026-10-15 12:00": {KeepReasonLast},
+				"2026-10-14 12:00": {KeepReasonLast},
+			},
+		},
+		{
+			"keep last more than there are runs",
+			RetentionSettings{KeepLast: 5},
+			[]string{"2026-10-14 12:00"},
+			map[string][]string{"2026-10-14 12:00": {KeepReasonLast}},
+		},
+		{
+			"daily keeps the newest run of each day",
+			RetentionSettings{KeepDaily: 2},
+			[]string{"2026-10-13 09:00", "2026-10-14 09:00", "2026-10-14 18:00", "2026-10-15 09:00", "2026-10-15 18:00"},
+			map[string][]string{
+				"2026-10-15 18:00": {KeepReasonDaily},
+				"2026-10-14 18:00": {KeepReasonDaily},
+			},
+		},
+		{
+			"daily skips days without a run",
+			RetentionSettings{KeepDaily: 2},
+			[]string{"2026-10-01 12:00", "2026-10-08 12:00", "2026-10-15 12:00"},
+			map[string][]string{
+				"2026-10-15 12:00": {KeepReasonDaily},
+				"2026-10-08 12:00": {KeepReasonDaily},
+			},
+		},
+		{
+			"weekly keeps the newest run of each ISO week",
+			RetentionSettings{KeepWeekly: 2},
+			[]string{"2026-10-05 12:00", "2026-10-07 12:00", "2026-10-11 12:00", "2026-10-12 12:00"},
+			map[string][]string{
+				"2026-10-12 12:00": {KeepReasonWeekly},
+				"2026-10-11 12:00": {KeepReasonWeekly},
+			},
+		},
+		{
+			"monthly keeps the newest run of each month",
+			RetentionSettings{KeepMonthly: 2},
+			[]string{"2026-08-15 12:00", "2026-09-01 12:00", "2026-09-30 12:00", "2026-10-03 12:00"},
+			map[string][]string{
+				"2026-10-03 12:00": {KeepReasonMonthly},
+				"2026-09-30 12:00": {KeepReasonMonthly},
+			},
+		},
+		{
+			"reasons add up",
+			RetentionSettings{KeepLast: 1, KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 2},
+			[]string{"2026-09-20 12:00", "2026-10-05 12:00", "2026-10-14 12:00", "2026-10-15 09:00", "2026-10-15 12:00"},
+			map[string][]string{
+				"2026-10-15 12:00": {KeepReasonLast, KeepReasonDaily, KeepReasonWeekly, KeepReasonMonthly},
+				"2026-10-14 12:00": {KeepReasonDaily},
+				"2026-10-05 12:00": {KeepReasonWeekly},
+				"2026-09-20 12:00": {KeepReasonMonthly},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := make([]*RetainedRun, 0, len(tt.runs))
+			for _, name := range tt.runs {
+				started, err := time.ParseInLocation("2006-01-02 15:04", name, time.Local)
+				if err != nil {
+					t.Fatal(err)
+				}
+				runs = append(runs, &RetainedRun{RunId: name, Started: started})
+			}
+
+			tt.retention.Apply(runs)
+
+			for i := 1; i < len(runs); i++ {
+				if runs[i].Started.After(runs[i-1].Started) {
+					t.Fatalf("Apply() did not sort runs newest first: %s before %s", runs[i-1].RunId, runs[i].RunId)
+				}
+			}
+			got := make(map[string][]string)
+			for _, run := range runs {
+				if run.Keep() {
+					got[run.RunId] = run.Reasons
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+
+	//DefaultConfigFile is read when no config file is named. Unlike a named file, it is not an error for it to be missing
+	DefaultConfigFile = "backup.yaml"
+
+	//ConfigFileEnvVar names the environment variable that may name the config file
+	ConfigFileEnvVar = "BACKUP_CONFIG"
+
+	//MinMultipartPartSizeMB is the smallest part S3 accepts (other than the last part of an object)
+	MinMultipartPartSizeMB = 5
+
+	//SkipExistingList skips files already stored by listing the bucket once, checking individual objects only when
+	//the listing cannot tell
+	SkipExistingList = "list"
+
+	//SkipExistingHead skips files already stored by checking each object individually
+	SkipExistingHead = "head"
+
+	//BucketEncryptionS3 encrypts objects at rest with keys managed by S3 (SSE-S3)
+	BucketEncryptionS3 = "sse-s3"
+
+	//BucketEncryptionKMS encrypts objects at rest with a KMS key (SSE-KMS)
+	BucketEncryptionKMS = "sse-kms"
+
+	//CompressionGzip compresses each file with gzip before it is stored
+	CompressionGzip = "gzip"
+
+	defaultTransitionStorageClass = "DEEP_ARCHIVE"
+
+	bytesPerKB = 1024
+	bytesPerMB = 1024 * bytesPerKB
+)
+
+const (
+
+	//RunPrefixRuns stores each run below a prefix of its own (runs/<date>-<uuid>/) in a fixed bucket
+	RunPrefixRuns = "runs"
+
+	//RunPrefixCurrent stores every run below the same current/ prefix in a fixed bucket, replacing the objects of
+	//earlier runs
+	RunPrefixCurrent = "current"
+)
+
+//storage classes a lifecycle rule may move objects to
+var transitionStorageClasses = []string{"STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"}
+
+//Settings holds every value that can be changed without recompiling. Values are layered in this order, each
+//overriding the one before: built-in defaults, the config file, BACKUP_* environment variables, command line flags
+type Settings struct {
+	AwsProfile       string `yaml:"aws_profile"`
+	AwsRegion        string `yaml:"aws_region"`
+	S3Endpoint       string `yaml:"s3_endpoint"`
+	S3PathStyle      bool   `yaml:"s3_path_style"`
+	DryrunBucket     string `yaml:"dryrun_bucket"`
+	FixedBucket      string `yaml:"fixed_bucket"`
+	RunPrefix        string `yaml:"run_prefix"`
+	LocalDestination string `yaml:"local_destination"`
+	KeyFile          string `yaml:"key_file"`
+	SkipExisting     string `yaml:"skip_existing"`
+	Repository       bool   `yaml:"repository"`
+
+	ExclusionsFile        string `yaml:"exclusions_file"`
+	StorageClassRulesFile string `yaml:"storage_class_rules_file"`
+	BackupDirectivesFile  string `yaml:"backup_directives_file"`
+	FailuresFile          string `yaml:"failures_file"`
+	VerifyFile            string `yaml:"verify_file"`
+	ManifestDir           string `yaml:"manifest_dir"`
+	JournalFile           string `yaml:"journal_file"`
+	HashCacheFile         string `yaml:"hash_cache_file"`
+	CatalogFile           string `yaml:"catalog_file"`
+
+	FileCountEstimate int `yaml:"file_count_estimate"`
+
+	HashRoutines            int `yaml:"hash_routines"`
+	HashRoutineMaxErrors    int `yaml:"hash_routine_max_errors"`
+	MaxFailedHashes         int `yaml:"max_failed_hashes"`
+	StorageRoutines         int `yaml:"storage_routines"`
+	StorageRoutineMaxErrors int `yaml:"storage_routine_max_errors"`
+	StorageRetryCount       int `yaml:"storage_retry_count"`
+
+	MultipartThresholdMB int `yaml:"multipart_threshold_mb"`
+	MultipartPartSizeMB  int `yaml:"multipart_part_size_mb"`
+	MultipartRoutines    int `yaml:"multipart_routines"`
+
+	ChunkThresholdMB int `yaml:"chunk_threshold_mb"`
+
+	PackThresholdKB   int `yaml:"pack_threshold_kb"`
+	PackSegmentSizeMB int `yaml:"pack_segment_size_mb"`
+
+	Compression string `yaml:"compression"`
+
+	Bucket BucketSettings `yaml:"bucket"`
+
+	Retention RetentionSettings `yaml:"retention"`
+}
+
+//BucketSettings are applied to each bucket right after it is created. Only S3 supports them - a local destination
+//ignores them
+type BucketSettings struct {
+
+	//Versioning keeps earlier versions of overwritten objects
+	Versioning bool `yaml:"versioning"`
+
+	//Encryption is the default encryption at rest: BucketEncryptionS3, BucketEncryptionKMS or empty to leave it to S3
+	Encryption string `yaml:"encryption"`
+
+	//KmsKeyId is the KMS key used with BucketEncryptionKMS. Empty to use the AWS managed key
+	KmsKeyId string `yaml:"kms_key_id"`
+
+	//BlockPublicAccess blocks every form of public access to the bucket
+	BlockPublicAccess bool `yaml:"block_public_access"`
+
+	//Tags tags the bucket with the run id, host name and base paths
+	Tags bool `yaml:"tags"`
+
+	//TransitionDays, when non-zero, moves objects to TransitionStorageClass this many days after they are stored
+	TransitionDays         int    `yaml:"transition_days"`
+	TransitionStorageClass string `yaml:"transition_storage_class"`
+
+	//ExpirationDays, when non-zero, deletes objects this many days after they are stored
+	ExpirationDays int `yaml:"expiration_days"`
+
+	//AbortIncompleteUploadDays, when non-zero, discards the parts of multipart uploads left incomplete this long
+	AbortIncompleteUploadDays int `yaml:"abort_incomplete_upload_days"`
+}
+
+//HasLifecycle returns true if any lifecycle rule is configured
+func (b *BucketSettings) HasLifecycle() bool {
+	return b.TransitionDays > 0 || b.ExpirationDays > 0 || b.AbortIncompleteUploadDays > 0
+}
+
+//DefaultSettings returns the built-in settings used when nothing overrides them
+func DefaultSettings() *Settings {
+	return &Settings{
+		AwsProfile:              defaultSharedProfile,
+		AwsRegion:               defaultAwsRegion,
+		DryrunBucket:            defaultDryrunBucket,
+		RunPrefix:               RunPrefixRuns,
+		ExclusionsFile:          defaultExclusionsFile,
+		StorageClassRulesFile:   defaultStorageClassRulesFile,
+		BackupDirectivesFile:    defaultBackupDirectivesFile,
+		FailuresFile:            defaultFailureOutputFile,
+		VerifyFile:              defaultVerifyOutputFile,
+		ManifestDir:             defaultManifestDir,
+		JournalFile:             defaultJournalFile,
+		HashCacheFile:           defaultHashCacheFile,
+		CatalogFile:             defaultCatalogFile,
+		FileCountEstimate:       defaultFileCountEstimate,
+		HashRoutines:            defaultHashRoutines,
+		HashRoutineMaxErrors:    defaultHashEffortChannelMaxErrorCount,
+		MaxFailedHashes:         defaultAllowedFailedHashCount,
+		StorageRoutines:         defaultStorageRoutines,
+		StorageRoutineMaxErrors: defaultStorageChannelMaxErrorRate,
+		StorageRetryCount:       defaultStorageRetryCount,
+		MultipartThresholdMB:    defaultMultipartThresholdMB,
+		MultipartPartSizeMB:     defaultMultipartPartSizeMB,
+		MultipartRoutines:       defaultMultipartRoutines,
+		PackSegmentSizeMB:       defaultPackSegmentSizeMB,
+		Bucket: BucketSettings{
+			TransitionStorageClass: defaultTransitionStorageClass,
+		},
+	}
+}
+
+//LoadFile overrides settings with those found in a YAML config file. Only keys present in the file are changed
+//and unknown keys are an error so a typo does not silently fall back to a default. A missing file is only an
+//error when required is set
+func (s *Settings) LoadFile(path string, required bool) (bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !required {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to read config file: %s error: %v", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	err = decoder.Decode(s)
+	if err != nil && err != io.EOF { //EOF means the file is empty or entirely commented out
+		return false, fmt.Errorf("unable to parse config file: %s error: %v", path, err)
+	}
+	return true, nil
+}
+
+//ApplyEnv overrides settings with any BACKUP_* environment variables that are set
+func (s *Settings) ApplyEnv() error {
+	strs := map[string]*string{
+		"BACKUP_AWS_PROFILE":                     &s.AwsProfile,
+		"BACKUP_AWS_REGION":                      &s.AwsRegion,
+		"BACKUP_S3_ENDPOINT":                     &s.S3Endpoint,
+		"BACKUP_DRYRUN_BUCKET":                   &s.DryrunBucket,
+		"BACKUP_FIXED_BUCKET":                    &s.FixedBucket,
+		"BACKUP_RUN_PREFIX":                      &s.RunPrefix,
+		"BACKUP_LOCAL_DESTINATION":               &s.LocalDestination,
+		"BACKUP_KEY_FILE":                        &s.KeyFile,
+		"BACKUP_SKIP_EXISTING":                   &s.SkipExisting,
+		"BACKUP_EXCLUSIONS_FILE":                 &s.ExclusionsFile,
+		"BACKUP_STORAGE_CLASS_RULES_FILE":        &s.StorageClassRulesFile,
+		"BACKUP_DIRECTIVES_FILE":                 &s.BackupDirectivesFile,
+		"BACKUP_FAILURES_FILE":                   &s.FailuresFile,
+		"BACKUP_VERIFY_FILE":                     &s.VerifyFile,
+		"BACKUP_MANIFEST_DIR":                    &s.ManifestDir,
+		"BACKUP_BUCKET_ENCRYPTION":               &s.Bucket.Encryption,
+		"BACKUP_BUCKET_KMS_KEY_ID":               &s.Bucket.KmsKeyId,
+		"BACKUP_BUCKET_TRANSITION_STORAGE_CLASS": &s.Bucket.TransitionStorageClass,
+		"BACKUP_JOURNAL_FILE":                    &s.JournalFile,
+		"BACKUP_HASH_CACHE_FILE":                 &s.HashCacheFile,
+		"BACKUP_CATALOG_FILE":                    &s.CatalogFile,
+		"BACKUP_COMPRESSION":                     &s.Compression,
+	}
+	for name, target := range strs {
+		if v, found := os.LookupEnv(name); found && v != "" {
+			*target = v
+		}
+	}
+
+	ints := map[string]*int{
+		"BACKUP_FILE_COUNT_ESTIMATE":                 &s.FileCountEstimate,
+		"BACKUP_HASH_ROUTINES":                       &s.HashRoutines,
+		"BACKUP_HASH_ROUTINE_MAX_ERRORS":             &s.HashRoutineMaxErrors,
+		"BACKUP_MAX_FAILED_HASHES":                   &s.MaxFailedHashes,
+		"BACKUP_STORAGE_ROUTINES":                    &s.StorageRoutines,
+		"BACKUP_STORAGE_ROUTINE_MAX_ERRORS":          &s.StorageRoutineMaxErrors,
+		"BACKUP_STORAGE_RETRY_COUNT":                 &s.StorageRetryCount,
+		"BACKUP_MULTIPART_THRESHOLD_MB":              &s.MultipartThresholdMB,
+		"BACKUP_MULTIPART_PART_SIZE_MB":              &s.MultipartPartSizeMB,
+		"BACKUP_MULTIPART_ROUTINES":                  &s.MultipartRoutines,
+		"BACKUP_CHUNK_THRESHOLD_MB":                  &s.ChunkThresholdMB,
+		"BACKUP_PACK_THRESHOLD_KB":                   &s.PackThresholdKB,
+		"BACKUP_PACK_SEGMENT_SIZE_MB":                &s.PackSegmentSizeMB,
+		"BACKUP_BUCKET_TRANSITION_DAYS":              &s.Bucket.TransitionDays,
+		"BACKUP_BUCKET_EXPIRATION_DAYS":              &s.Bucket.ExpirationDays,
+		"BACKUP_BUCKET_ABORT_INCOMPLETE_UPLOAD_DAYS": &s.Bucket.AbortIncompleteUploadDays,
+		"BACKUP_RETENTION_KEEP_LAST":                 &s.Retention.KeepLast,
+		"BACKUP_RETENTION_KEEP_DAILY":                &s.Retention.KeepDaily,
+		"BACKUP_RETENTION_KEEP_WEEKLY":               &s.Retention.KeepWeekly,
+		"BACKUP_RETENTION_KEEP_MONTHLY":              &s.Retention.KeepMonthly,
+	}
+	for name, target := range ints {
+		v, found := os.LookupEnv(name)
+		if !found || v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("environment variable %s must be a whole number, not: %s", name, v)
+		}
+		*target = n
+	}
+
+	bools := map[string]*bool{
+		"BACKUP_S3_PATH_STYLE":              &s.S3PathStyle,
+		"BACKUP_REPOSITORY":                 &s.Repository,
+		"BACKUP_BUCKET_VERSIONING":          &s.Bucket.Versioning,
+		"BACKUP_BUCKET_BLOCK_PUBLIC_ACCESS": &s.Bucket.BlockPublicAccess,
+		"BACKUP_BUCKET_TAGS":                &s.Bucket.Tags,
+	}
+	for name, target := range bools {
+		v, found := os.LookupEnv(name)
+		if !found || v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("environment variable %s must be true or false, not: %s", name, v)
+		}
+		*target = b
+	}
+	return nil
+}
+
+//ApplyCommandOpts overrides settings with those given on the command line. Empty or zero options were not given
+func (s *Settings) ApplyCommandOpts(cmdOpts *CommandOpts) {
+	if cmdOpts.AwsProfile != "" {
+		s.AwsProfile = cmdOpts.AwsProfile
+	}
+	if cmdOpts.AwsRegion != "" {
+		s.AwsRegion = cmdOpts.AwsRegion
+	}
+	if cmdOpts.S3Endpoint != "" {
+		s.S3Endpoint = cmdOpts.S3Endpoint
+	}
+	if cmdOpts.S3PathStyle {
+		s.S3PathStyle = true
+	}
+	if cmdOpts.FixedBucket != "" {
+		s.FixedBucket = cmdOpts.FixedBucket
+	}
+	if cmdOpts.LocalDestination != "" {
+		s.LocalDestination = cmdOpts.LocalDestination
+	}
+	if cmdOpts.KeyFile != "" {
+		s.KeyFile = cmdOpts.KeyFile
+	}
+	if cmdOpts.SkipExisting != "" {
+		s.SkipExisting = cmdOpts.SkipExisting
+	}
+	if cmdOpts.HashRoutines != 0 {
+		s.HashRoutines = cmdOpts.HashRoutines
+	}
+	if cmdOpts.StorageRoutines != 0 {
+		s.StorageRoutines = cmdOpts.StorageRoutines
+	}
+	if cmdOpts.StorageRetryCount != 0 {
+		s.StorageRetryCount = cmdOpts.StorageRetryCount
+	}
+	if cmdOpts.KeepLast != 0 {
+		s.Retention.KeepLast = cmdOpts.KeepLast
+	}
+	if cmdOpts.KeepDaily != 0 {
+		s.Retention.KeepDaily = cmdOpts.KeepDaily
+	}
+	if cmdOpts.KeepWeekly != 0 {
+		s.Retention.KeepWeekly = cmdOpts.KeepWeekly
+	}
+	if cmdOpts.KeepMonthly != 0 {
+		s.Retention.KeepMonthly = cmdOpts.KeepMonthly
+	}
+}
+
+//Validate checks the final settings make sense
+func (s *Settings) Validate() error {
+	if s.AwsRegion == "" {
+		return fmt.Errorf("an AWS region is required")
+	}
+	if s.S3Endpoint != "" {
+		endpoint, err := url.Parse(s.S3Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("S3 endpoint must be an http or https URL, not: %s", s.S3Endpoint)
+		}
+	}
+	if s.RunPrefix != RunPrefixRuns && s.RunPrefix != RunPrefixCurrent {
+		return fmt.Errorf("run prefix must be %s or %s, not: %s", RunPrefixRuns, RunPrefixCurrent, s.RunPrefix)
+	}
+	if s.SkipExisting != "" && s.SkipExisting != SkipExistingList && s.SkipExisting != SkipExistingHead {
+		return fmt.Errorf("skip existing must be %s, %s or empty, not: %s", SkipExistingList, SkipExistingHead, s.SkipExisting)
+	}
+	if s.Repository {
+
+		//content objects are shared by every run so they need a bucket that outlives the runs - and as content is
+		//never stored twice there is nothing left for skip existing to do
+		if s.FixedBucket == "" || s.RunPrefix != RunPrefixRuns {
+			return fmt.Errorf("repository mode requires a fixed bucket with a run prefix of %s", RunPrefixRuns)
+		}
+		if s.SkipExisting != "" {
+			return fmt.Errorf("skip existing cannot be used in repository mode, which never stores the same content twice")
+		}
+	}
+	if s.HashRoutines < 1 {
+		return fmt.Errorf("hash routines must be at least 1, not: %d", s.HashRoutines)
+	}
+	if s.StorageRoutines < 1 {
+		return fmt.Errorf("storage routines must be at least 1, not: %d", s.StorageRoutines)
+	}
+	if s.StorageRetryCount < 1 {
+		return fmt.Errorf("storage retry count must be at least 1, not: %d", s.StorageRetryCount)
+	}
+	if s.MultipartThresholdMB < 1 {
+		return fmt.Errorf("multipart threshold must be at least 1 MB, not: %d", s.MultipartThresholdMB)
+	}
+	if s.MultipartPartSizeMB < MinMultipartPartSizeMB {
+		return fmt.Errorf("multipart part size must be at least %d MB, not: %d", MinMultipartPartSizeMB, s.MultipartPartSizeMB)
+	}
+	if s.MultipartRoutines < 1 {
+		return fmt.Errorf("multipart routines must be at least 1, not: %d", s.MultipartRoutines)
+	}
+	if s.ChunkThresholdMB < 0 {
+		return fmt.Errorf("chunk threshold must not be negative, not: %d", s.ChunkThresholdMB)
+	}
+	if s.ChunkThresholdMB > 0 && !s.Repository {
+		return fmt.Errorf("chunking requires repository mode, which stores the chunks")
+	}
+	if s.PackThresholdKB < 0 {
+		return fmt.Errorf("pack threshold must not be negative, not: %d", s.PackThresholdKB)
+	}
+	if s.PackSegmentSizeMB < 1 {
+		return fmt.Errorf("pack segment size must be at least 1 MB, not: %d", s.PackSegmentSizeMB)
+	}
+	if int64(s.PackThresholdKB)*bytesPerKB > int64(s.PackSegmentSizeMB)*bytesPerMB {
+		return fmt.Errorf("pack threshold must not exceed the pack segment size")
+	}
+	if s.PackThresholdKB > 0 && s.Repository {
+		return fmt.Errorf("small files cannot be packed in repository mode, which stores each file's content on its own")
+	}
+
+	//every run stored below current/ repacks its small files into new segments, and as prune never touches current/
+	//the segments of earlier runs would pile up for good
+	if s.PackThresholdKB > 0 && s.FixedBucket != "" && s.RunPrefix == RunPrefixCurrent {
+		return fmt.Errorf("small files cannot be packed with a run prefix of %s, which would never delete replaced segments", RunPrefixCurrent)
+	}
+	switch s.Compression {
+	case "", CompressionGzip:
+	default:
+		return fmt.Errorf("compression must be %s or empty, not: %s", CompressionGzip, s.Compression)
+	}
+	err := s.Bucket.validate()
+	if err != nil {
+		return err
+	}
+
+	//the lifecycle rule covers the whole bucket. A fixed bucket also holds the catalog, the run indexes and (in
+	//repository mode) content every run shares, which must neither expire nor be archived out of reach
+	if s.FixedBucket != "" && (s.Bucket.TransitionDays > 0 || s.Bucket.ExpirationDays > 0) {
+		return fmt.Errorf("bucket transition and expiration days cannot be used with a fixed bucket. Use prune to delete old runs")
+	}
+	err = s.Retention.validate()
+	if err != nil {
+		return err
+	}
+	if s.FileCountEstimate < 0 || s.HashRoutineMaxErrors < 0 || s.MaxFailedHashes < 0 || s.StorageRoutineMaxErrors < 0 {
+		return fmt.Errorf("file count estimate and error limits must not be negative")
+	}
+	return nil
+}
+
+//checks the bucket settings make sense
+func (b *BucketSettings) validate() error {
+	switch b.Encryption {
+	case "", BucketEncryptionS3, BucketEncryptionKMS:
+	default:
+		return fmt.Errorf("bucket encryption must be %s, %s or empty, not: %s", BucketEncryptionS3, BucketEncryptionKMS, b.Encryption)
+	}
+	if b.KmsKeyId != "" && b.Encryption != BucketEncryptionKMS {
+		return fmt.Errorf("a KMS key id is only used with %s bucket encryption", BucketEncryptionKMS)
+	}
+	if b.TransitionDays < 0 || b.ExpirationDays < 0 || b.AbortIncompleteUploadDays < 0 {
+		return fmt.Errorf("bucket lifecycle days must not be negative")
+	}
+	if b.TransitionDays > 0 && b.ExpirationDays > 0 && b.ExpirationDays <= b.TransitionDays {
+		return fmt.Errorf("bucket expiration days: %d must be later than transition days: %d", b.ExpirationDays, b.TransitionDays)
+	}
+	for _, class := range transitionStorageClasses {
+		if b.TransitionStorageClass == class {
+			return nil
+		}
+	}
+	return fmt.Errorf("bucket transition storage class must be one of %v, not: %s", transitionStorageClasses, b.TransitionStorageClass)
+}
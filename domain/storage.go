@@ -0,0 +1,179 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+//user metadata keys stored with each object. S3 lower-cases metadata keys so these must be lower case too
+const (
+
+	//MetadataMD5 holds the base64-encoded MD5 hash of the original file
+	MetadataMD5 = "md5"
+
+	//MetadataSize holds the size in bytes of the original file when the stored content differs from it
+	MetadataSize = "size"
+
+	//MetadataEncryption names the encryption scheme applied to the content, if any
+	MetadataEncryption = "enc-alg"
+
+	//MetadataKdf names the key derivation function (and its parameters) of an encrypted object
+	MetadataKdf = "enc-kdf"
+
+	//MetadataSalt holds the base64-encoded key derivation salt of an encrypted object
+	MetadataSalt = "enc-salt"
+
+	//MetadataObjectSalt holds the base64-encoded salt the key of an encrypted object is derived with
+	MetadataObjectSalt = "enc-object-salt"
+
+	//MetadataNonce holds the base64-encoded nonce prefix of an encrypted object
+	MetadataNonce = "enc-nonce"
+
+	//MetadataSegmentSize holds the plaintext size of each encrypted segment
+	MetadataSegmentSize = "enc-segment"
+
+	//MetadataChunks holds the number of chunks of a chunked file. It marks an object holding a ChunkList rather than
+	//the file's content
+	MetadataChunks = "chunks"
+
+	//MetadataFiles holds the number of files packed into a segment
+	MetadataFiles = "files"
+
+	//MetadataCompression names the compression applied to the content before any encryption, if any
+	MetadataCompression = "compression"
+)
+
+//ErrObjectNotFound is returned (possibly wrapped) by a Storage when a requested object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+//ErrObjectArchived is returned (possibly wrapped) by a Storage when an object cannot be read because it is archived
+//(eg in Glacier or Deep Archive) and must be restored within the storage (S3 RestoreObject) first
+var ErrObjectArchived = errors.New("object is archived and must be restored in storage before it can be read")
+
+//Storage abstracts the destination objects are written to. A container is the top-level grouping
+//of objects (a bucket in S3) and each object is addressed by its key within a container
+type Storage interface {
+
+	//Name returns a short, human-readable name of the storage backend
+	Name() string
+
+	//ListContainers returns the names of all containers visible to the backend
+	ListContainers(ctx context.Context) ([]string, error)
+
+	//ContainerExists returns true if a container exists and is accessible
+	ContainerExists(ctx context.Context, container string) (bool, error)
+
+	//CreateContainer creates a new, empty container
+	CreateContainer(ctx context.Context, container string) error
+
+	//ConfigureContainer applies settings (and tags) to a newly created container. Backends ignore settings they have
+	//no equivalent for
+	ConfigureContainer(ctx context.Context, container string, settings *BucketSettings, tags map[string]string) error
+
+	//PutObject stores a single object. The backend must reject content that does not match the request's MD5
+	PutObject(ctx context.Context, req *PutObjectRequest) error
+
+	//HeadObject returns details about a single object or an error wrapping ErrObjectNotFound
+	HeadObject(ctx context.Context, container string, key string) (*ObjectInfo, error)
+
+	//ListObjects returns details about every object in a container whose key begins with prefix
+	ListObjects(ctx context.Context, container string, prefix string) ([]*ObjectInfo, error)
+
+	//GetObject opens a single object for reading. The caller must close the returned reader
+	GetObject(ctx context.Context, container string, key string) (io.ReadCloser, *ObjectInfo, error)
+
+	//CreateMultipartUpload begins an object that is stored in parts. The request's Body and ContentMD5 are not used
+	CreateMultipartUpload(ctx context.Context, req *PutObjectRequest) (*MultipartUpload, error)
+
+	//UploadPart stores one part of a multipart upload and returns its ETag. As with PutObject, the backend must
+	//reject content that does not match the part's MD5
+	UploadPart(ctx context.Context, upload *MultipartUpload, part *UploadPartRequest) (string, error)
+
+	//CompleteMultipartUpload assembles the uploaded parts, in part number order, into the object
+	CompleteMultipartUpload(ctx context.Context, upload *MultipartUpload, parts []*CompletedPart) error
+
+	//AbortMultipartUpload discards an incomplete upload along with any parts already stored
+	AbortMultipartUpload(ctx context.Context, upload *MultipartUpload) error
+
+	//DeleteObjects deletes objects from a container. Keys that do not exist are ignored
+	DeleteObjects(ctx context.Context, container string, keys []string) error
+
+	//DeleteContainer deletes a container along with every object (and every version of an object) in it
+	DeleteContainer(ctx context.Context, container string) error
+}
+
+//PutObjectRequest holds everything needed to store a single object
+type PutObjectRequest struct {
+
+	//Container is the name of the container (bucket) the object is stored in
+	Container string
+
+	//Key is the object's key within the container
+	Key string
+
+	//Body is the content of the object. Callers rewind it before retrying a failed store
+	Body io.ReadSeeker
+
+	//ContentMD5 is the base64-encoded MD5 hash of Body
+	ContentMD5 string
+
+	//Metadata holds user metadata to store with the object
+	Metadata map[string]string
+
+	//StorageClass is the S3 storage class of the object. Empty for the backend's default. Backends without storage
+	//classes ignore it
+	StorageClass string
+}
+
+//ObjectInfo holds data about a single stored object
+type ObjectInfo struct {
+
+	//Key is the object's key within its container
+	Key string
+
+	//Size is the size in bytes of the stored object
+	Size int64
+
+	//ETag is the entity tag reported by the backend with any surrounding quotes removed
+	ETag string
+
+	//Metadata holds any user metadata stored with the object. Only populated by HeadObject and GetObject
+	Metadata map[string]string
+}
+
+//MultipartUpload identifies an object being stored in parts
+type MultipartUpload struct {
+
+	//Container is the name of the container (bucket) the object is stored in
+	Container string
+
+	//Key is the object's key within the container
+	Key string
+
+	//UploadId is assigned by the backend when the upload is created
+	UploadId string
+}
+
+//UploadPartRequest holds a single part of a multipart upload
+type UploadPartRequest struct {
+
+	//PartNumber orders the parts of an upload, starting with 1
+	PartNumber int32
+
+	//Body is the content of the part. Callers rewind it before retrying a failed upload
+	Body io.ReadSeeker
+
+	//ContentMD5 is the base64-encoded MD5 hash of Body
+	ContentMD5 string
+}
+
+//CompletedPart records a part that was uploaded successfully
+type CompletedPart struct {
+
+	//PartNumber is the number the part was uploaded with
+	PartNumber int32
+
+	//ETag is the entity tag returned when the part was uploaded
+	ETag string
+}
@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+
+	//StorageClassStandard is the storage class objects are stored in when no rule says otherwise
+	StorageClassStandard = "STANDARD"
+
+	sizeAtLeastPrefix = "size>="
+	sizeBelowPrefix   = "size<"
+)
+
+//storage classes an object may be stored in
+var storageClasses = append([]string{StorageClassStandard}, transitionStorageClasses...)
+
+//units a size threshold may be given in
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+	"TB": 1024 * 1024 * 1024 * 1024,
+}
+
+//StorageClassRule picks the storage class of files whose path matches a regex or whose size is within a threshold
+type StorageClassRule struct {
+
+	//Id is the rule id
+	Id int
+
+	//Raw is the rule as read from the storage class rules file
+	Raw string
+
+	//StorageClass is the storage class of matching files
+	StorageClass string
+
+	//Regex, when set, is matched against the file's path
+	Regex *regexp.Regexp
+
+	//MinSize, when non-zero, matches files of at least this many bytes
+	MinSize int64
+
+	//MaxSize, when non-zero, matches files of fewer than this many bytes
+	MaxSize int64
+}
+
+//ParseStorageClassRule parses a single rule: a storage class followed by a regex or a size threshold, eg
+//"DEEP_ARCHIVE .*\\Camera\\.*", "GLACIER_IR size>=1GB" or "STANDARD size<128KB"
+func ParseStorageClassRule(id int, line string) (*StorageClassRule, error) {
+	trimmed := strings.TrimSpace(line)
+	split := strings.IndexAny(trimmed, " \t")
+	if split < 0 || strings.TrimSpace(trimmed[split:]) == "" {
+		return nil, fmt.Errorf("storage class rule: '%s' must be a storage class followed by a regex or size", line)
+	}
+	rule := &StorageClassRule{Id: id, Raw: line, StorageClass: strings.ToUpper(trimmed[:split])}
+
+	valid := false
+	for _, class := range storageClasses {
+		valid = valid || rule.StorageClass == class
+	}
+	if !valid {
+		return nil, fmt.Errorf("storage class rule: '%s' has unknown storage class: %s. Use one of %v", line, trimmed[:split], storageClasses)
+	}
+
+	condition := strings.TrimSpace(trimmed[split:])
+	var err error
+	switch {
+	case strings.HasPrefix(condition, sizeAtLeastPrefix):
+		rule.MinSize, err = parseSize(strings.TrimPrefix(condition, sizeAtLeastPrefix))
+	case strings.HasPrefix(condition, sizeBelowPrefix):
+		rule.MaxSize, err = parseSize(strings.TrimPrefix(condition, sizeBelowPrefix))
+	default:
+		rule.Regex, err = regexp.Compile(condition)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage class rule: '%s' is invalid: %v", line, err)
+	}
+	return rule, nil
+}
+
+//Matches returns true if the rule applies to a file. Like exclusions, a regex may be written against the native path
+//or its forward slash form
+func (r *StorageClassRule) Matches(path string, size int64) bool {
+	switch {
+	case r.Regex != nil:
+		return r.Regex.MatchString(path) || r.Regex.MatchString(NormalizePath(path))
+	case r.MinSize > 0:
+		return size >= r.MinSize
+	default:
+		return size < r.MaxSize
+	}
+}
+
+//parses a size such as 512KB or 1GB
+func parseSize(raw string) (int64, error) {
+	raw = strings.ToUpper(strings.TrimSpace(raw))
+	digits := strings.TrimRight(raw, "BKMGT")
+	multiplier, found := sizeUnits[raw[len(digits):]]
+	if !found {
+		return 0, fmt.Errorf("unknown size unit in: %s", raw)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(digits), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size must be a positive whole number, not: %s", raw)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestParseStorageClassRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantClass string
+		wantMin   int64
+		wantMax   int64
+		wantRegex string
+		wantErr   bool
+	}{
+		{"regex", `DEEP_ARCHIVE .*\\[Aa]rchive\\.*`, "DEEP_ARCHIVE", 0, 0, `.*\\[Aa]rchive\\.*`, false},
+		{"tab separated, lower case class", "glacier\t.*/Camera/.*", "GLACIER", 0, 0, ".*/Camera/.*", false},
+		{"surrounding space", "  GLACIER_IR   .*\\.iso  ", "GLACIER_IR", 0, 0, `.*\.iso`, false},
+		{"size at least", "GLACIER_IR size>=1GB", "GLACIER_IR", 1 << 30, 0, "", false},
+		{"size below", "STANDARD size<128KB", "STANDARD", 0, 128 << 10, "", false},
+		{"size without unit", "STANDARD size<128", "STANDARD", 0, 128, "", false},
+		{"class only", "GLACIER", "", 0, 0, "", true},
+		{"class and blanks only", "GLACIER   ", "", 0, 0, "", true},
+		{"blank line", "   ", "", 0, 0, "", true},
+		{"unknown class", "FOO .*", "", 0, 0, "", true},
+		{"invalid regex", "GLACIER ([", "", 0, 0, "", true},
+		{"invalid size", "GLACIER size>=lots", "", 0, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseStorageClassRule(1, tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseStorageClassRule(%q) error = %v, wantErr %t", tt.line, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			regex := ""
+			if rule.Regex != nil {
+				regex = rule.Regex.String()
+			}
+			if rule.StorageClass != tt.wantClass || rule.MinSize != tt.wantMin || rule.MaxSize != tt.wantMax || regex != tt.wantRegex {
+				t.Errorf("ParseStorageClassRule(%q) = %s min %d max %d regex %q, want %s min %d max %d regex %q", tt.line,
+					rule.StorageClass, rule.MinSize, rule.MaxSize, regex, tt.wantClass, tt.wantMin, tt.wantMax, tt.wantRegex)
+			}
+		})
+	}
+}
+
+func TestStorageClassRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		path string
+		size int64
+		want bool
+	}{
+		{"native windows path", `DEEP_ARCHIVE .*\\Archive\\.*`, `E:\Misc\Archive\a.txt`, 1, true},
+		{"regex does not match", "DEEP_ARCHIVE .*/Archive/.*", "/home/me/a.txt", 1, false},
+		{"at the minimum size", "GLACIER_IR size>=1MB", "a", 1 << 20, true},
+		{"below the minimum size", "GLACIER_IR size>=1MB", "a", 1<<20 - 1, false},
+		{"below the maximum size", "STANDARD size<1KB", "a", 1023, true},
+		{"at the maximum size", "STANDARD size<1KB", "a", 1024, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseStorageClassRule(1, tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.Matches(tt.path, tt.size); got != tt.want {
+				t.Errorf("%q Matches(%q, %d) = %t, want %t", tt.line, tt.path, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"1KB", 1 << 10, false},
+		{"128kb", 128 << 10, false},
+		{" 2 MB ", 2 << 20, false},
+		{"1GB", 1 << 30, false},
+		{"3TB", 3 << 40, false},
+		{"", 0, true},
+		{"KB", 0, true},
+		{"0KB", 0, true},
+		{"-1KB", 0, true},
+		{"1.5GB", 0, true},
+		{"1XB", 0, true},
+		{"1KBB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, wantErr %t", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
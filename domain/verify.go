@@ -0,0 +1,54 @@
+package domain
+
+//VerifyReport holds the results of auditing a stored backup against the local filesystem
+type VerifyReport struct {
+
+	//DateCreated is the creation date and time of this struct
+	DateCreated string
+
+	//RunId is the id of the run that was audited
+	RunId string `json:"runId"`
+
+	//Bucket is the name of the bucket holding the audited run
+	Bucket string `json:"bucket"`
+
+	//Prefix is the prefix of every key of the audited run, if any
+	Prefix string `json:"prefix,omitempty"`
+
+	//HasProblems is true when at least one difference was found
+	HasProblems bool `json:"hasProblems"`
+
+	//MissingObjects lists local files that have no stored object
+	MissingObjects []*FileInfo
+
+	//ExtraObjects lists stored objects that no longer have a local file
+	ExtraObjects []*ObjectInfo
+
+	//SizeMismatches lists files whose stored size differs from the local size
+	SizeMismatches []*VerifyMismatch
+
+	//HashMismatches lists files whose stored MD5 differs from the local MD5
+	HashMismatches []*VerifyMismatch
+
+	//UnverifiedFiles lists local files that could not be hashed or whose object could not be examined
+	UnverifiedFiles []*FileInfo
+}
+
+//VerifyMismatch holds the local and stored details of a file that differs from its object
+type VerifyMismatch struct {
+
+	//Path is the full name of the local file
+	Path string
+
+	//Bucket and Key locate the stored object
+	Bucket string
+	Key    string
+
+	//LocalSize and StoredSize are the sizes in bytes of the file and of the stored object's content
+	LocalSize  int64
+	StoredSize int64
+
+	//LocalHash and StoredHash are the base64-encoded MD5 hashes of the file and of the stored object's content
+	LocalHash  string
+	StoredHash string
+}
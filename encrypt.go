@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"backup/domain"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+//Objects are encrypted with AES-256-GCM in fixed-size segments so that files of any size can be streamed with
+//bounded memory. Each object has a key of its own, derived with HKDF-SHA256 from the run key and a random salt, so
+//no two objects ever share a key and nonce however many are stored with one key file. Each segment is sealed with a
+//nonce built from a random per-object prefix, the segment counter and a flag marking the final segment, which stops
+//segments from being reordered, dropped or truncated unnoticed
+const (
+	encryptionAlgorithm       = "aes-256-gcm-hkdf-stream"
+	encryptionSegmentSize     = 64 * 1024
+	encryptionNoncePrefixSize = 7
+	encryptionObjectSaltSize  = 32
+	encryptionKeyInfo         = "backup object key"
+	encryptTempPrefix         = "backup-enc-"
+
+	//legacyEncryptionAlgorithm objects were sealed with the run key itself. They can still be decrypted
+	legacyEncryptionAlgorithm = "aes-256-gcm-stream"
+)
+
+//encrypts src into a temp file and returns the file (rewound and ready for upload), the base64 MD5 of the encrypted
+//content and the metadata needed to decrypt it again. The caller must remove the temp file
+func encryptToTempFile(keyring *domain.Keyring, src io.Reader) (*os.File, string, map[string]string, error) {
+	runKey, kdf, salt, err := keyring.RunKey()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	objectSalt := make([]byte, encryptionObjectSaltSize)
+	_, err = rand.Read(objectSalt)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to generate salt: %v", err)
+	}
+	key, err := deriveObjectKey(runKey, objectSalt)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	_, err = rand.Read(prefix)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+
+	tmp, err := os.CreateTemp("", encryptTempPrefix+"*")
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	//hash the encrypted content as we write it - storage validates what is actually sent
+	h := md5.New()
+	err = sealSegments(aead, prefix, src, io.MultiWriter(tmp, h))
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, "", nil, err
+	}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, "", nil, err
+	}
+
+	metadata := map[string]string{
+		domain.MetadataEncryption:  encryptionAlgorithm,
+		domain.MetadataKdf:         kdf,
+		domain.MetadataSalt:        base64.StdEncoding.EncodeToString(salt),
+		domain.MetadataObjectSalt:  base64.StdEncoding.EncodeToString(objectSalt),
+		domain.MetadataNonce:       base64.StdEncoding.EncodeToString(prefix),
+		domain.MetadataSegmentSize: strconv.Itoa(encryptionSegmentSize),
+	}
+	return tmp, base64.StdEncoding.EncodeToString(h.Sum(nil)), metadata, nil
+}
+
+//seals src segment by segment and writes the sealed segments to out
+func sealSegments(aead cipher.AEAD, prefix []byte, src io.Reader, out io.Writer) error {
+	plain := make([]byte, encryptionSegmentSize)
+	sealed := make([]byte, 0, encryptionSegmentSize+aead.Overhead())
+	var counter uint32
+	for {
+		//a short (possibly empty) read marks the final segment - a file that is an exact multiple of the segment
+		//size therefore ends with an empty final segment
+		n, err := io.ReadFull(src, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("failed to read file for encryption: %v", err)
+		}
+
+		sealed = aead.Seal(sealed[:0], segmentNonce(prefix, counter, last), plain[:n], nil)
+		_, err = out.Write(sealed)
+		if err != nil {
+			return fmt.Errorf("failed to write encrypted file: %v", err)
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return fmt.Errorf("file too large to encrypt")
+		}
+		counter++
+	}
+}
+
+//derives the key of a single object from the run key and the object's salt
+func deriveObjectKey(runKey []byte, objectSalt []byte) ([]byte, error) {
+	key := make([]byte, domain.KeyLength)
+	_, err := io.ReadFull(hkdf.New(sha256.New, runKey, objectSalt, []byte(encryptionKeyInfo)), key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive object key: %v", err)
+	}
+	return key, nil
+}
+
+//decryptReader reverses encryptToTempFile one segment at a time
+type decryptReader struct {
+	aead    cipher.AEAD
+	src     io.Reader
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	pending []byte
+	done    bool
+}
+
+//wraps src with a reader returning the decrypted content of an object, based on the object's metadata
+func newDecryptReader(keyring *domain.Keyring, src io.Reader, metadata map[string]string) (io.Reader, error) {
+	alg := metadata[domain.MetadataEncryption]
+	if alg != encryptionAlgorithm && alg != legacyEncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm: %s", alg)
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("object is encrypted but no key file or passphrase is configured")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(metadata[domain.MetadataSalt])
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption salt: %v", err)
+	}
+	prefix, err := base64.StdEncoding.DecodeString(metadata[domain.MetadataNonce])
+	if err != nil || len(prefix) != encryptionNoncePrefixSize {
+		return nil, fmt.Errorf("invalid encryption nonce")
+	}
+
+	//segments are always written at the one size - anything else is damaged metadata and must not size the buffers
+	segmentSize, err := strconv.Atoi(metadata[domain.MetadataSegmentSize])
+	if err != nil || segmentSize != encryptionSegmentSize {
+		return nil, fmt.Errorf("invalid encryption segment size: %s", metadata[domain.MetadataSegmentSize])
+	}
+
+	key, err := keyring.Key(metadata[domain.MetadataKdf], salt)
+	if err != nil {
+		return nil, err
+	}
+	if alg == encryptionAlgorithm {
+		objectSalt, err := base64.StdEncoding.DecodeString(metadata[domain.MetadataObjectSalt])
+		if err != nil || len(objectSalt) != encryptionObjectSaltSize {
+			return nil, fmt.Errorf("invalid encryption object salt")
+		}
+		key, err = deriveObjectKey(key, objectSalt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newSegmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		aead:   aead,
+		src:    src,
+		prefix: prefix,
+		sealed: make([]byte, segmentSize+aead.Overhead()),
+		plain:  make([]byte, 0, segmentSize),
+	}, nil
+}
+
+//Read returns decrypted content, opening the next segment whenever the previous one has been consumed
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		//only the final segment may be short
+		n, err := io.ReadFull(r.src, r.sealed)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if last && n < r.aead.Overhead() {
+			return 0, fmt.Errorf("encrypted content is truncated")
+		}
+
+		r.pending, err = r.aead.Open(r.plain[:0], segmentNonce(r.prefix, r.counter, last), r.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("unable to decrypt segment %d: %v", r.counter, err)
+		}
+		r.done = last
+		r.counter++
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func newSegmentAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//builds the 12 byte nonce of a segment: the object's random prefix, the segment counter and the final segment flag
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, encryptionNoncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = append(nonce, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefixSize:], counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+//closes and deletes a temp file
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
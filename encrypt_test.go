@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backup/domain"
+)
+
+//creates a keyring from a key file holding random bytes
+func newTestKeyring(t *testing.T) *domain.Keyring {
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	key := make([]byte, domain.KeyLength)
+	rand.Read(key)
+	err := os.WriteFile(keyFile, key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := domain.NewKeyFileKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+//encrypts content, returning the encrypted bytes and the metadata needed to decrypt them
+func encryptForTest(t *testing.T, keyring *domain.Keyring, content []byte) ([]byte, map[string]string) {
+	tmp, _, metadata, err := encryptToTempFile(keyring, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTempFile(tmp)
+	sealed, err := io.ReadAll(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed, metadata
+}
+
+//decrypts content, returning the first error met
+func decryptForTest(keyring *domain.Keyring, sealed []byte, metadata map[string]string) ([]byte, error) {
+	r, err := newDecryptReader(keyring, bytes.NewReader(sealed), metadata)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	passphraseKeyring, err := domain.NewPassphraseKeyring("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyrings := map[string]*domain.Keyring{"key file": newTestKeyring(t), "passphrase": passphraseKeyring}
+
+	sizes := []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, 3*encryptionSegmentSize + 5}
+	for name, keyring := range keyrings {
+		for _, size := range sizes {
+			content := make([]byte, size)
+			rand.Read(content)
+
+			sealed, metadata := encryptForTest(t, keyring, content)
+			got, err := decryptForTest(keyring, sealed, metadata)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: decrypt error = %v", name, size, err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("%s, %d bytes: decrypted content differs", name, size)
+			}
+		}
+	}
+}
+
+func TestEncryptUsesKeyPerObject(t *testing.T) {
+	keyring := newTestKeyring(t)
+	content := bytes.Repeat([]byte("same content "), 100)
+
+	sealedA, metadataA := encryptForTest(t, keyring, content)
+	sealedB, metadataB := encryptForTest(t, keyring, content)
+	if metadataA[domain.MetadataObjectSalt] == metadataB[domain.MetadataObjectSalt] {
+		t.Errorf("two objects share the object salt: %s", metadataA[domain.MetadataObjectSalt])
+	}
+	if bytes.Equal(sealedA, sealedB) {
+		t.Errorf("the same content encrypted twice gives the same bytes")
+	}
+
+	//an object cannot be opened with another object's salt, which means its key is its own
+	metadataA[domain.MetadataObjectSalt] = metadataB[domain.MetadataObjectSalt]
+	_, err := decryptForTest(keyring, sealedA, metadataA)
+	if err == nil {
+		t.Errorf("object decrypted with another object's salt")
+	}
+}
+
+func TestDecryptLegacyObject(t *testing.T) {
+	keyring := newTestKeyring(t)
+	content := bytes.Repeat([]byte("stored before objects had keys of their own "), 2000)
+
+	//objects were once sealed with the run key itself
+	runKey, kdf, salt, err := keyring.RunKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newSegmentAEAD(runKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := make([]byte, encryptionNoncePrefixSize)
+	rand.Read(prefix)
+	var sealed bytes.Buffer
+	err = sealSegments(aead, prefix, bytes.NewReader(content), &sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]string{
+		domain.MetadataEncryption:  legacyEncryptionAlgorithm,
+		domain.MetadataKdf:         kdf,
+		domain.MetadataSalt:        base64.StdEncoding.EncodeToString(salt),
+		domain.MetadataNonce:       base64.StdEncoding.EncodeToString(prefix),
+		domain.MetadataSegmentSize: "65536",
+	}
+
+	got, err := decryptForTest(keyring, sealed.Bytes(), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("decrypted content differs")
+	}
+}
+
+func TestDecryptDamagedContent(t *testing.T) {
+	keyring := newTestKeyring(t)
+	content := make([]byte, 3*encryptionSegmentSize+100)
+	rand.Read(content)
+	sealed, metadata := encryptForTest(t, keyring, content)
+	sealedSegmentSize := encryptionSegmentSize + 16
+
+	tests := []struct {
+		name   string
+		damage func([]byte) []byte
+	}{
+		{"tampered first segment", func(b []byte) []byte {
+			b[10] ^= 1
+			return b
+		}},
+		{"tampered last segment", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"last segment dropped", func(b []byte) []byte {
+			return b[:3*sealedSegmentSize]
+		}},
+		{"last segment truncated", func(b []byte) []byte {
+			return b[:len(b)-10]
+		}},
+		{"cut within a segment", func(b []byte) []byte {
+			return b[:sealedSegmentSize+100]
+		}},
+		{"cut shorter than a tag", func(b []byte) []byte {
+			return b[:sealedSegmentSize+5]
+		}},
+		{"segments reordered", func(b []byte) []byte {
+			reordered := append([]byte{}, b[sealedSegmentSize:2*sealedSegmentSize]...)
+			reordered = append(reordered, b[:sealedSegmentSize]...)
+			return append(reordered, b[2*sealedSegmentSize:]...)
+		}},
+		{"segment appended", func(b []byte) []byte {
+			return append(b, b[:sealedSegmentSize]...)
+		}},
+		{"empty", func(b []byte) []byte {
+			return b[:0]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			damaged := tt.damage(append([]byte{}, sealed...))
+			_, err := decryptForTest(keyring, damaged, metadata)
+			if err == nil {
+				t.Errorf("damaged content decrypted without error")
+			}
+		})
+	}
+}
+
+func TestDecryptBadMetadata(t *testing.T) {
+	keyring := newTestKeyring(t)
+	sealed, metadata := encryptForTest(t, keyring, []byte("some content"))
+
+	tests := []struct {
+		name    string
+		keyring *domain.Keyring
+		key     string
+		value   string
+	}{
+		{"unknown algorithm", keyring, domain.MetadataEncryption, "rot13"},
+		{"missing algorithm", keyring, domain.MetadataEncryption, ""},
+		{"no keyring", nil, "", ""},
+		{"another key file", newTestKeyring(t), "", ""},
+		{"unknown key derivation", keyring, domain.MetadataKdf, "md5"},
+		{"passphrase key derivation with a key file", keyring, domain.MetadataKdf, "scrypt-32768-8-1"},
+		{"salt not base64", keyring, domain.MetadataSalt, "!!"},
+		{"missing object salt", keyring, domain.MetadataObjectSalt, ""},
+		{"short object salt", keyring, domain.MetadataObjectSalt, base64.StdEncoding.EncodeToString(make([]byte, 8))},
+		{"other object salt", keyring, domain.MetadataObjectSalt, base64.StdEncoding.EncodeToString(make([]byte, encryptionObjectSaltSize))},
+		{"missing nonce", keyring, domain.MetadataNonce, ""},
+		{"short nonce", keyring, domain.MetadataNonce, base64.StdEncoding.EncodeToString(make([]byte, 4))},
+		{"other nonce", keyring, domain.MetadataNonce, base64.StdEncoding.EncodeToString(make([]byte, encryptionNoncePrefixSize))},
+		{"missing segment size", keyring, domain.MetadataSegmentSize, ""},
+		{"other segment size", keyring, domain.MetadataSegmentSize, "1024"},
+		{"huge segment size", keyring, domain.MetadataSegmentSize, "4294967296"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := make(map[string]string, len(metadata))
+			for k, v := range metadata {
+				bad[k] = v
+			}
+			if tt.key != "" {
+				bad[tt.key] = tt.value
+			}
+			_, err := decryptForTest(tt.keyring, sealed, bad)
+			if err == nil {
+				t.Errorf("decrypted with bad metadata")
+			}
+		})
+	}
+}
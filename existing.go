@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"backup/domain"
+)
+
+//existingObjects finds files that are already stored in the bucket with the same size and MD5, so a rerun into an
+//existing bucket does not store them again
+type existingObjects struct {
+	store     domain.Storage
+	appConfig domain.Config
+	bucket    string
+
+	//listed holds every object in the bucket keyed by key. Nil when each object is checked individually
+	listed map[string]*domain.ObjectInfo
+}
+
+//creates the check for files already stored, listing the bucket up front if configured to. Returns nil if files are
+//always stored
+func newExistingObjects(ctx context.Context, store domain.Storage, appConfig domain.Config) (*existingObjects, error) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	existing := &existingObjects{store: store, appConfig: appConfig, bucket: appConfig.Bucket()}
+	switch appConfig.SkipExisting() {
+	case domain.SkipExistingList:
+		objects, err := store.ListObjects(ctx, existing.bucket, appConfig.Prefix())
+		if err != nil {
+			return nil, fmt.Errorf("unable to list bucket: %s error: %v", existing.bucket, err)
+		}
+		existing.listed = make(map[string]*domain.ObjectInfo, len(objects))
+		for _, o := range objects {
+			existing.listed[o.Key] = o
+		}
+		logger.Infow("listed objects already stored", "bucketName", existing.bucket, "prefix", appConfig.Prefix(), "count", len(objects), "meta", domain.Aws)
+	case domain.SkipExistingHead:
+	default:
+		return nil, nil
+	}
+	return existing, nil
+}
+
+//checks whether a hashed file is already stored with the same size and MD5. The listing holds no metadata so an
+//object that does not obviously match (eg it is encrypted or was stored in parts) is checked individually
+func (e *existingObjects) matches(ctx context.Context, fi *domain.FileInfo) (bool, error) {
+	key := objectKey(e.appConfig, fi)
+	if e.listed != nil {
+		listed, found := e.listed[key]
+		if !found {
+			return false, nil
+		}
+		if listed.Size == fi.Size && storedHash("", listed) == fi.Hash {
+			return true, nil
+		}
+	}
+
+	info, err := e.store.HeadObject(ctx, e.bucket, key)
+	if errors.Is(err, domain.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return storedSize(info) == fi.Size && storedHash("", info) == fi.Hash, nil
+}
@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+)
+
+//returns the NTFS file index of a file - the Windows equivalent of an inode. Together with size and modification time
+//it tells us whether a file has changed
+func fileId(path string) (uint64, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	//no access rights are needed just to query the file's information
+	handle, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(handle)
+
+	var data syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(handle, &data)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(data.FileIndexHigh)<<32 | uint64(data.FileIndexLow), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -32,7 +33,7 @@ func hashAllFiles(appConfig domain.Config, objectsList []*domain.FileInfo) {
 	var wg sync.WaitGroup
 	for i := 0; i < appConfig.HashRoutinesCount(); i++ {
 		wg.Add(1)
-		go hashFilesInChannel(appConfig, channel, &wg)
+		go hashFilesInChannel(context.Background(), appConfig, nil, channel, nil, &wg)
 	}
 
 	logger.Infow("waiting for hashing to complete...", "meta", domain.Chat)
@@ -42,8 +43,10 @@ func hashAllFiles(appConfig domain.Config, objectsList []*domain.FileInfo) {
 	logger.Infow("hashing is complete", "hashTotalTime", hashTime, "meta", domain.Chat)
 }
 
-//routine to hash files in the channel
-func hashFilesInChannel(appConfig domain.Config, ch chan *domain.FileInfo, wg *sync.WaitGroup) {
+//routine to hash files in the channel and pass them on, hashed or not, to the out channel unless it is nil. Once ctx
+//is cancelled files are passed on without being hashed. Files unchanged since they were cached take their hash from cache, which may be nil.
+//In repository mode each file's SHA-256 is found as well
+func hashFilesInChannel(ctx context.Context, appConfig domain.Config, cache *hashCache, ch <-chan *domain.FileInfo, out chan<- *domain.FileInfo, wg *sync.WaitGroup) {
 	logger := appConfig.Logger()
 	defer logger.Sync()
 	defer wg.Done()
@@ -56,22 +59,58 @@ func hashFilesInChannel(appConfig domain.Config, ch chan *domain.FileInfo, wg *s
 	errCount := 0
 	maxAllowedErrors := appConfig.MaxHashChannelErrorCount()
 
+	//files are only passed on if something downstream wants them
+	passOn := func(fi *domain.FileInfo) {
+		if out != nil {
+			out <- fi
+		}
+	}
+
 	filesProcessed := 0
 	for fi := range ch {
 
 		filesProcessed++
 		filename := fi.FullName
 
-		hash, err := hashFile(filename)
+		if ctx.Err() != nil {
+			passOn(fi)
+			continue
+		}
+
+		var id uint64
+		if cache != nil {
+			entry, fileId, found := cache.lookup(fi)
+			if found {
+				logger.Debugw("hash taken from cache", "path", filename, "meta", domain.Hash)
+				fi.Hash = entry.Hash
+				fi.ContentHash = entry.ContentHash
+				fi.HashSuccess = true
+				passOn(fi)
+				continue
+			}
+			id = fileId
+		}
+
+		hash, contentHash, err := hashFile(filename, appConfig.Repository())
 		if err != nil {
 			errCount++
 			logger.Errorw("failed to hash file", "path", filename, "err", err, "meta", domain.Err)
 			fi.HashSuccess = false
 		} else {
 			fi.Hash = hash
+			fi.ContentHash = contentHash
 			fi.HashSuccess = true
 		}
 
+		//a file that cannot be cached is simply hashed again next time
+		if cache != nil && fi.HashSuccess {
+			err = cache.record(fi, id)
+			if err != nil {
+				logger.Warnw("failed to cache file hash", "path", filename, "err", err, "meta", domain.Hash)
+			}
+		}
+		passOn(fi)
+
 		//exit on excessive errors
 		if errCount > maxAllowedErrors {
 			logger.Errorw("hash routine exceeded max error count. Shutting it down", "maxAllowedErrors", maxAllowedErrors, "meta", domain.Hash)
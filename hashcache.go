@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"backup/domain"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	hashCacheBucket      = "hashes"
+	hashCacheOpenTimeout = 5 * time.Second
+)
+
+//hashCache remembers the MD5 of every file hashed so an unchanged file need not be read again on the next run. A file
+//is unchanged if its size, modification time and file id (inode) all match. Safe for concurrent use
+type hashCache struct {
+	db *bolt.DB
+
+	//rehash ignores what is cached, though the cache is still updated with the new hashes
+	rehash bool
+
+	//contentHash is set in repository mode. Entries cached without a SHA-256 must then be hashed again
+	contentHash bool
+}
+
+//hashCacheEntry is the cached value of a single file, keyed by path
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	FileId  uint64 `json:"fileId"`
+	Hash    string `json:"hash"`
+
+	//ContentHash is the hex SHA-256 of the file, only cached in repository mode
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+//opens (creating if needed) the hash cache. Returns nil if the cache is disabled
+func openHashCache(appConfig domain.Config) (*hashCache, error) {
+	path := appConfig.HashCacheFilepath()
+	if path == "" {
+		return nil, nil
+	}
+
+	//the timeout stops a second run sharing the cache from waiting forever on the first
+	db, err := bolt.Open(path, 0664, &bolt.Options{Timeout: hashCacheOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open hash cache: %s error: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(hashCacheBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to prepare hash cache: %s error: %v", path, err)
+	}
+
+	appConfig.Logger().Infow("hash cache opened", "path", path, "rehash", appConfig.Rehash(), "meta", domain.Hash)
+	return &hashCache{db: db, rehash: appConfig.Rehash(), contentHash: appConfig.Repository()}, nil
+}
+
+//returns the cached hashes of a file if it has not changed since it was cached. Also returns the file's id, which
+//must be passed on to record
+func (c *hashCache) lookup(fi *domain.FileInfo) (*hashCacheEntry, uint64, bool) {
+	id, err := fileId(fi.FullName)
+	if err != nil || c.rehash {
+		return nil, id, false
+	}
+
+	var entry hashCacheEntry
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket([]byte(hashCacheBucket)).Get([]byte(fi.FullName))
+		found = raw != nil && json.Unmarshal(raw, &entry) == nil
+		return nil
+	})
+	if !found || entry.Size != fi.Size || entry.ModTime != fi.ModTime.UnixNano() || entry.FileId != id {
+		return nil, id, false
+	}
+	if c.contentHash && entry.ContentHash == "" {
+		return nil, id, false
+	}
+	return &entry, id, true
+}
+
+//caches the hash of a file. Writes from many routines are batched into a single transaction
+func (c *hashCache) record(fi *domain.FileInfo, id uint64) error {
+	raw, err := json.Marshal(&hashCacheEntry{
+		Size:    fi.Size,
+		ModTime: fi.ModTime.UnixNano(),
+		FileId:  id,
+		Hash:    fi.Hash,
+
+		ContentHash: fi.ContentHash,
+	})
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hashCacheBucket)).Put([]byte(fi.FullName), raw)
+	})
+}
+
+//closes the cache
+func (c *hashCache) close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	"backup/domain"
+)
+
+//reads back the journal of the interrupted run being resumed. Returns the latest entry for each file, keyed by path,
+//and the bucket the run's incremental backup was based on, if any
+func loadResumeJournal(appConfig domain.Config) (map[string]*domain.JournalEntry, string, error) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	header, entries, err := domain.ReadJournal(appConfig.JournalFilepath())
+	if err != nil {
+		return nil, "", err
+	}
+
+	logger.Infow("journal of interrupted run loaded", "path", appConfig.JournalFilepath(), "entryCount", len(entries), "meta", domain.Chat)
+	return entries, header.BasedOn, nil
+}
+
+//opens the journal this run records its progress in. A resumed run carries on appending to the interrupted run's
+//journal - anything else starts a new one
+func openJournal(appConfig domain.Config, basedOn string) (*domain.Journal, error) {
+	if appConfig.Resume() {
+		return domain.AppendJournal(appConfig.JournalFilepath())
+	}
+	return domain.CreateJournal(appConfig.JournalFilepath(), &domain.JournalHeader{
+		Created:     time.Now(),
+		RunId:       appConfig.RunName(),
+		Bucket:      appConfig.Bucket(),
+		Prefix:      appConfig.Prefix(),
+		Incremental: appConfig.Incremental(),
+		BasedOn:     basedOn,
+	})
+}
+
+//checks a file against the journal of an interrupted run. A file the journal has as stored is marked as such and true
+//is returned. A file that was only hashed keeps that hash so it need not be hashed again. Either way the file must
+//not have changed since
+func applyJournalEntry(fi *domain.FileInfo, entries map[string]*domain.JournalEntry) bool {
+	e, found := entries[fi.FullName]
+	if !found || !e.Hashed || e.Size != fi.Size || !e.ModTime.Equal(fi.ModTime) {
+		return false
+	}
+
+	fi.Hash = e.Hash
+	fi.ContentHash = e.ContentHash
+	fi.HashSuccess = true
+	if !e.Stored {
+		return false
+	}
+	fi.StorageSuccess = true
+	fi.Bucket = e.Bucket
+	fi.Key = e.Key
+	fi.Packed = e.Packed
+	fi.Offset = e.Offset
+	return true
+}
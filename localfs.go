@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"backup/domain"
+
+	"github.com/google/uuid"
+)
+
+const (
+	localMetaDir        = ".meta"
+	localMetaSuffix     = ".json"
+	localUploadPrefix   = ".upload-"
+	localMultipartDir   = ".multipart"
+	localMultipartMeta  = "upload.json"
+	localPartNameFormat = "part-%05d"
+)
+
+//localStorage is a domain.Storage that writes objects to a local or mounted directory. Each container is a
+//directory below root and each object a file below its container, laid out exactly as its key. Object details
+//that S3 would keep for us (the ETag) are stored in a small json sidecar under the container's .meta directory
+type localStorage struct {
+	root string
+}
+
+//localObjectMeta is the json sidecar stored alongside each object
+type localObjectMeta struct {
+	ETag     string            `json:"etag"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+//creates a storage that writes below root, which must be an existing directory
+func newLocalStorage(root string) (*localStorage, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access local destination: %s error: %v", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local destination: %s is not a directory", root)
+	}
+	return &localStorage{root: root}, nil
+}
+
+//Name returns the name of this storage backend
+func (s *localStorage) Name() string {
+	return "local"
+}
+
+//ListContainers lists each directory directly below root
+func (s *localStorage) ListContainers(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+//ContainerExists returns true if a directory of the container's name exists below root
+func (s *localStorage) ContainerExists(ctx context.Context, container string) (bool, error) {
+	info, err := os.Stat(filepath.Join(s.root, container))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+//CreateContainer creates a new directory below root. Like S3, it is an error if the container already exists
+func (s *localStorage) CreateContainer(ctx context.Context, container string) error {
+	return os.Mkdir(filepath.Join(s.root, container), 0775)
+}
+
+//ConfigureContainer does nothing - versioning, encryption at rest, access and lifecycle of a local directory are up
+//to the filesystem
+func (s *localStorage) ConfigureContainer(ctx context.Context, container string, settings *domain.BucketSettings, tags map[string]string) error {
+	return nil
+}
+
+//PutObject copies the body to a temporary file while hashing it and only moves it into place if the MD5 matches
+func (s *localStorage) PutObject(ctx context.Context, req *domain.PutObjectRequest) error {
+	target, err := s.objectPath(req.Container, req.Key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0775)
+	if err != nil {
+		return err
+	}
+
+	//write to a temp file in the same directory so the final rename cannot cross filesystems
+	tmpName, sum, err := writeLocalTempFile(filepath.Dir(target), req.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write object: %s error: %v", req.Key, err)
+	}
+	defer os.Remove(tmpName) //no-op once the file has been renamed into place
+
+	//same guarantee S3 gives us with ContentMD5 - never keep content that differs from what was hashed
+	if base64.StdEncoding.EncodeToString(sum) != req.ContentMD5 {
+		return fmt.Errorf("content MD5 mismatch for object: %s expected: %s", req.Key, req.ContentMD5)
+	}
+
+	return s.moveIntoPlace(tmpName, target, req.Container, req.Key, &localObjectMeta{ETag: hex.EncodeToString(sum), Metadata: req.Metadata})
+}
+
+//HeadObject returns details of a single object
+func (s *localStorage) HeadObject(ctx context.Context, container string, key string) (*domain.ObjectInfo, error) {
+	target, err := s.objectPath(container, key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s/%s", domain.ErrObjectNotFound, container, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := s.readMeta(container, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.ObjectInfo{
+		Key:      key,
+		Size:     info.Size(),
+		ETag:     meta.ETag,
+		Metadata: meta.Metadata,
+	}, nil
+}
+
+//GetObject opens the file holding a single object
+func (s *localStorage) GetObject(ctx context.Context, container string, key string) (io.ReadCloser, *domain.ObjectInfo, error) {
+	info, err := s.HeadObject(ctx, container, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := s.objectPath(container, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+//ListObjects walks the container directory and returns every object whose key begins with prefix
+func (s *localStorage) ListObjects(ctx context.Context, container string, prefix string) ([]*domain.ObjectInfo, error) {
+	containerDir := filepath.Join(s.root, container)
+	objects := make([]*domain.ObjectInfo, 0)
+
+	err := filepath.WalkDir(containerDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		//sidecars, multipart uploads in progress and abandoned temp files are not objects
+		if d.IsDir() && (p == filepath.Join(containerDir, localMetaDir) || p == filepath.Join(containerDir, localMultipartDir)) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localUploadPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(containerDir, p)
+		if err != nil {
+			return err
+		}
+		key := pathToLocalKey(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		meta, err := s.readMeta(container, key)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &domain.ObjectInfo{
+			Key:  key,
+			Size: info.Size(),
+			ETag: meta.ETag,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+//CreateMultipartUpload creates a directory below the container's .multipart directory to collect the parts in
+func (s *localStorage) CreateMultipartUpload(ctx context.Context, req *domain.PutObjectRequest) (*domain.MultipartUpload, error) {
+	_, err := localKeyToPath(req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &domain.MultipartUpload{
+		Container: req.Container,
+		Key:       req.Key,
+		UploadId:  uuid.New().String(),
+	}
+	uploadDir := s.uploadPath(upload)
+	err = os.MkdirAll(uploadDir, 0775)
+	if err != nil {
+		return nil, err
+	}
+
+	//the metadata is only stored with the object once the upload completes
+	jsonBytes, err := json.Marshal(&localObjectMeta{Metadata: req.Metadata})
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(uploadDir, localMultipartMeta), jsonBytes, 0664)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+//UploadPart writes a single part into the upload's directory if its MD5 matches
+func (s *localStorage) UploadPart(ctx context.Context, upload *domain.MultipartUpload, part *domain.UploadPartRequest) (string, error) {
+	uploadDir := s.uploadPath(upload)
+	_, err := os.Stat(uploadDir)
+	if err != nil {
+		return "", fmt.Errorf("unknown multipart upload: %s error: %v", upload.UploadId, err)
+	}
+
+	tmpName, sum, err := writeLocalTempFile(uploadDir, part.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to write part: %d of object: %s error: %v", part.PartNumber, upload.Key, err)
+	}
+	defer os.Remove(tmpName) //no-op once the file has been renamed into place
+
+	if base64.StdEncoding.EncodeToString(sum) != part.ContentMD5 {
+		return "", fmt.Errorf("content MD5 mismatch for part: %d of object: %s expected: %s", part.PartNumber, upload.Key, part.ContentMD5)
+	}
+
+	err = os.Rename(tmpName, filepath.Join(uploadDir, fmt.Sprintf(localPartNameFormat, part.PartNumber)))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+//CompleteMultipartUpload concatenates the parts into the object. The ETag is built the way S3 builds it for
+//multipart objects: the MD5 of the parts' MD5s followed by the number of parts
+func (s *localStorage) CompleteMultipartUpload(ctx context.Context, upload *domain.MultipartUpload, parts []*domain.CompletedPart) error {
+	uploadDir := s.uploadPath(upload)
+	jsonBytes, err := os.ReadFile(filepath.Join(uploadDir, localMultipartMeta))
+	if err != nil {
+		return fmt.Errorf("unknown multipart upload: %s error: %v", upload.UploadId, err)
+	}
+	var meta localObjectMeta
+	err = json.Unmarshal(jsonBytes, &meta)
+	if err != nil {
+		return err
+	}
+
+	target, err := s.objectPath(upload.Container, upload.Key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0775)
+	if err != nil {
+		return err
+	}
+
+	//open every part up front, checking each is the part that was uploaded
+	readers := make([]io.Reader, 0, len(parts))
+	partSums := md5.New()
+	for i, p := range parts {
+		if i > 0 && p.PartNumber <= parts[i-1].PartNumber {
+			return fmt.Errorf("parts of object: %s must be in ascending part number order", upload.Key)
+		}
+		partSum, err := hex.DecodeString(p.ETag)
+		if err != nil {
+			return fmt.Errorf("invalid ETag for part: %d of object: %s", p.PartNumber, upload.Key)
+		}
+		partSums.Write(partSum)
+
+		f, err := os.Open(filepath.Join(uploadDir, fmt.Sprintf(localPartNameFormat, p.PartNumber)))
+		if err != nil {
+			return fmt.Errorf("missing part: %d of object: %s error: %v", p.PartNumber, upload.Key, err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	tmpName, _, err := writeLocalTempFile(filepath.Dir(target), io.MultiReader(readers...))
+	if err != nil {
+		return fmt.Errorf("failed to assemble object: %s error: %v", upload.Key, err)
+	}
+	defer os.Remove(tmpName) //no-op once the file has been renamed into place
+
+	meta.ETag = fmt.Sprintf("%s-%d", hex.EncodeToString(partSums.Sum(nil)), len(parts))
+	err = s.moveIntoPlace(tmpName, target, upload.Container, upload.Key, &meta)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(uploadDir)
+}
+
+//AbortMultipartUpload removes the upload's directory and every part in it
+func (s *localStorage) AbortMultipartUpload(ctx context.Context, upload *domain.MultipartUpload) error {
+	return os.RemoveAll(s.uploadPath(upload))
+}
+
+//DeleteObjects removes each object along with its sidecar, then any directories left empty
+func (s *localStorage) DeleteObjects(ctx context.Context, container string, keys []string) error {
+	for _, key := range keys {
+		target, err := s.objectPath(container, key)
+		if err != nil {
+			return err
+		}
+		metaFile, err := s.metaPath(container, key)
+		if err != nil {
+			return err
+		}
+		for _, p := range []string{target, metaFile} {
+			err = os.Remove(p)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			s.removeEmptyDirs(container, filepath.Dir(p))
+		}
+	}
+	return nil
+}
+
+//DeleteContainer removes the container's directory and everything in it
+func (s *localStorage) DeleteContainer(ctx context.Context, container string) error {
+	if container == "" || strings.ContainsAny(container, `/\`) || container == "." || container == ".." {
+		return fmt.Errorf("invalid container: %s", container)
+	}
+	return os.RemoveAll(filepath.Join(s.root, container))
+}
+
+//removes dir and its parents for as long as they are empty, stopping at the container's directory
+func (s *localStorage) removeEmptyDirs(container string, dir string) {
+	containerDir := filepath.Join(s.root, container)
+	for dir != containerDir && strings.HasPrefix(dir, containerDir) {
+		if os.Remove(dir) != nil { //fails once a directory still holds something
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+//maps an upload to the directory collecting its parts
+func (s *localStorage) uploadPath(upload *domain.MultipartUpload) string {
+	return filepath.Join(s.root, upload.Container, localMultipartDir, upload.UploadId)
+}
+
+//maps a key to the file that holds the object
+func (s *localStorage) objectPath(container string, key string) (string, error) {
+	rel, err := localKeyToPath(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, container, rel), nil
+}
+
+//maps a key to the file that holds the object's sidecar
+func (s *localStorage) metaPath(container string, key string) (string, error) {
+	rel, err := localKeyToPath(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, container, localMetaDir, rel+localMetaSuffix), nil
+}
+
+//moves a temp file holding an object's content into place along with its sidecar. The sidecar is written to a temp
+//file first and an object being replaced is moved aside until both renames succeed, so a failed put leaves the earlier
+//object and its sidecar as they were
+func (s *localStorage) moveIntoPlace(tmpName string, target string, container string, key string, meta *localObjectMeta) error {
+	metaFile, err := s.metaPath(container, key)
+	if err != nil {
+		return err
+	}
+	metaTmpName, err := writeMetaTempFile(metaFile, meta)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(metaTmpName) //no-op once the sidecar has been renamed into place
+
+	//an object being replaced is kept until the new one is in place. Its name carries the upload prefix so it is never
+	//listed as an object
+	aside := ""
+	_, err = os.Stat(target)
+	if err == nil {
+		aside = filepath.Join(filepath.Dir(target), localUploadPrefix+uuid.New().String())
+		err = os.Rename(target, aside)
+		if err != nil {
+			return err
+		}
+	}
+	restore := func() {
+		if aside != "" {
+			os.Rename(aside, target)
+		} else {
+			os.Remove(target)
+		}
+	}
+
+	err = os.Rename(tmpName, target)
+	if err != nil {
+		restore()
+		return err
+	}
+	err = os.Rename(metaTmpName, metaFile)
+	if err != nil {
+		restore()
+		return err
+	}
+	if aside != "" {
+		os.Remove(aside)
+	}
+	return nil
+}
+
+//writes an object's sidecar to a temp file beside where it belongs, returning the temp file's name
+func writeMetaTempFile(metaFile string, meta *localObjectMeta) (string, error) {
+	err := os.MkdirAll(filepath.Dir(metaFile), 0775)
+	if err != nil {
+		return "", err
+	}
+	jsonBytes, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	tmpName, _, err := writeLocalTempFile(filepath.Dir(metaFile), bytes.NewReader(jsonBytes))
+	return tmpName, err
+}
+
+func (s *localStorage) readMeta(container string, key string) (*localObjectMeta, error) {
+	metaFile, err := s.metaPath(container, key)
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object metadata: %s error: %v", metaFile, err)
+	}
+	var meta localObjectMeta
+	err = json.Unmarshal(jsonBytes, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal object metadata: %s error: %v", metaFile, err)
+	}
+	return &meta, nil
+}
+
+//copies content into a new temp file in dir while hashing it. Returns the temp file's name and the MD5 of the content.
+//The temp file is removed on error - otherwise it is up to the caller
+func writeLocalTempFile(dir string, content io.Reader) (string, []byte, error) {
+	tmp, err := os.CreateTemp(dir, localUploadPrefix+"*")
+	if err != nil {
+		return "", nil, err
+	}
+	tmpName := tmp.Name()
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return "", nil, err
+	}
+	return tmpName, h.Sum(nil), nil
+}
+
+//converts a key into a relative OS path. Colons (eg the E: of a drive letter) are not legal in a Windows path
+//element so they - and the escape character itself - are percent-encoded to keep one layout on every OS
+func localKeyToPath(key string) (string, error) {
+	elements := strings.Split(key, "/")
+	for i, e := range elements {
+		if e == "" || e == "." || e == ".." {
+			return "", fmt.Errorf("invalid object key: %s", key)
+		}
+		e = strings.ReplaceAll(e, "%", "%25")
+		elements[i] = strings.ReplaceAll(e, ":", "%3A")
+	}
+	return filepath.Join(elements...), nil
+}
+
+//reverses localKeyToPath
+func pathToLocalKey(rel string) string {
+	key := filepath.ToSlash(rel)
+	key = strings.ReplaceAll(key, "%3A", ":")
+	return strings.ReplaceAll(key, "%25", "%")
+}
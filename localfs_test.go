@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backup/domain"
+)
+
+func TestLocalKeyToPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{"POSIX key", "home/me/notes.txt", filepath.Join("home", "me", "notes.txt"), false},
+		{"drive letter colon is escaped", "E:/Misc/foo", filepath.Join("E%3A", "Misc", "foo"), false},
+		{"escape character is escaped", "home/50%/a:b", filepath.Join("home", "50%25", "a%3Ab"), false},
+		{"UNC key", "UNC/server/share/foo", filepath.Join("UNC", "server", "share", "foo"), false},
+		{"empty key", "", "", true},
+		{"leading slash", "/home/me", "", true},
+		{"empty element", "home//me", "", true},
+		{"trailing slash", "home/me/", "", true},
+		{"dot element", "home/./me", "", true},
+		{"parent element", "home/../../etc/passwd", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := localKeyToPath(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localKeyToPath(%q) error = %v, wantErr %t", tt.key, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("localKeyToPath(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+			if err == nil && pathToLocalKey(got) != tt.key {
+				t.Errorf("pathToLocalKey(%q) = %q, want %q", got, pathToLocalKey(got), tt.key)
+			}
+		})
+	}
+}
+
+//stores content under key, failing the test on error
+func putLocalObject(t *testing.T, s *localStorage, key string, content []byte) error {
+	sum := md5.Sum(content)
+	return s.PutObject(context.Background(), &domain.PutObjectRequest{
+		Container:  "bucket",
+		Key:        key,
+		Body:       bytes.NewReader(content),
+		ContentMD5: base64.StdEncoding.EncodeToString(sum[:]),
+		Metadata:   map[string]string{domain.MetadataMD5: base64.StdEncoding.EncodeToString(sum[:])},
+	})
+}
+
+//reads an object's content and the MD5 its sidecar holds
+func getLocalObject(t *testing.T, s *localStorage, key string) ([]byte, string) {
+	body, info, err := s.GetObject(context.Background(), "bucket", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, info.Metadata[domain.MetadataMD5]
+}
+
+func TestLocalStorageReplaceObject(t *testing.T) {
+	s, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.CreateContainer(context.Background(), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldContent, newContent := []byte("first version"), []byte("second version")
+	oldSum := md5.Sum(oldContent)
+	err = putLocalObject(t, s, "current/a.txt", oldContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//content that does not match its MD5 never replaces the object
+	err = s.PutObject(context.Background(), &domain.PutObjectRequest{Container: "bucket", Key: "current/a.txt",
+		Body: bytes.NewReader(newContent), ContentMD5: base64.StdEncoding.EncodeToString(oldSum[:])})
+	if err == nil {
+		t.Fatalf("PutObject() stored content that does not match its MD5")
+	}
+
+	//a failed move into place puts the earlier object back along with its sidecar
+	target, _ := s.objectPath("bucket", "current/a.txt")
+	err = s.moveIntoPlace(filepath.Join(filepath.Dir(target), "missing"), target, "bucket", "current/a.txt", &localObjectMeta{ETag: "new"})
+	if err == nil {
+		t.Fatalf("moveIntoPlace() of a missing temp file succeeded")
+	}
+	got, gotMD5 := getLocalObject(t, s, "current/a.txt")
+	if !bytes.Equal(got, oldContent) || gotMD5 != base64.StdEncoding.EncodeToString(oldSum[:]) {
+		t.Errorf("after failed puts object = %q with MD5 %s, want the first version", got, gotMD5)
+	}
+
+	err = putLocalObject(t, s, "current/a.txt", newContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSum := md5.Sum(newContent)
+	got, gotMD5 = getLocalObject(t, s, "current/a.txt")
+	if !bytes.Equal(got, newContent) || gotMD5 != base64.StdEncoding.EncodeToString(newSum[:]) {
+		t.Errorf("after replacing object = %q with MD5 %s, want the second version", got, gotMD5)
+	}
+
+	//nothing but the object and its sidecar is left behind
+	objects, err := s.ListObjects(context.Background(), "bucket", "")
+	if err != nil || len(objects) != 1 {
+		t.Errorf("ListObjects() = %d objects, err = %v, want 1", len(objects), err)
+	}
+	for _, dir := range []string{filepath.Dir(target), filepath.Join(s.root, "bucket", localMetaDir, "current")} {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("%s holds %d entries, want 1", dir, len(entries))
+		}
+	}
+}
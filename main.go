@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"backup/domain"
@@ -14,18 +18,69 @@ func main() {
 	//note start time
 	startTime := time.Now()
 
+	//a command (eg restore) may be given ahead of any flags. Without one we perform a backup
+	command, commandArgs, args := splitCommand(os.Args[1:])
+
 	//flags handling
 	debugLoggingPtr := flag.Bool("debug", false, "set to enable debug logging")
 	dryrunPtr := flag.Bool("dryrun", false, "set to enable dryrun (no aws calls)")
 	reprocessPtr := flag.Bool("reprocess", false, "set to enable reprocessing of previously failed files")
-	noConfirmPtr := flag.Bool("noconfirm", false, "only used during reprocessing. Set to bypass confirmation menu")
-	flag.Parse()
+	noConfirmPtr := flag.Bool("noconfirm", false, "only used during reprocessing and pruning. Set to bypass confirmation menu")
+	resumePtr := flag.Bool("resume", false, "set to continue the interrupted run recorded in the journal file")
+	rehashPtr := flag.Bool("rehash", false, "set to hash every file instead of reusing the cached hashes of unchanged files")
+	incrementalPtr := flag.Bool("incremental", false, "set to only store files that are new or changed since the latest manifest")
+	configPtr := flag.String("config", "", "read settings from this YAML file instead of "+domain.DefaultConfigFile)
+	profilePtr := flag.String("profile", "", "AWS shared profile to use. Overrides the config file")
+	regionPtr := flag.String("region", "", "AWS region to store buckets in. Overrides the config file")
+	endpointPtr := flag.String("endpoint", "", "URL of an S3-compatible service (eg MinIO) to use instead of AWS. Overrides the config file")
+	pathStylePtr := flag.Bool("pathstyle", false, "set to address buckets in the URL path, as most S3-compatible services expect")
+	hashRoutinesPtr := flag.Int("hashroutines", 0, "number of files hashed in parallel. Overrides the config file")
+	storageRoutinesPtr := flag.Int("storageroutines", 0, "number of objects stored in parallel. Overrides the config file")
+	retriesPtr := flag.Int("retries", 0, "number of attempts made to store each object. Overrides the config file")
+	localDirPtr := flag.String("localdir", "", "write objects to this local or mounted directory instead of AWS S3")
+	skipExistingPtr := flag.String("skipexisting", "", "skip files already stored with the same size and MD5. Either 'list' (list the bucket once) or 'head' (check each object)")
+	fixedBucketPtr := flag.String("bucket", "", "store every run in this long-lived bucket, each below a prefix of its own. Overrides the config file")
+	keyFilePtr := flag.String("keyfile", "", "encrypt objects with the 32 byte key in this file. See also the BACKUP_PASSPHRASE env var")
+	runIdPtr := flag.String("run", "", "restore and verify only. The run id of the backup to use (its bucket name unless a fixed bucket is used)")
+	targetPtr := flag.String("target", "", "restore only. The directory files are restored into")
+	keepLastPtr := flag.Int("keeplast", 0, "prune only. Keep this many of the most recent runs. Overrides the config file")
+	keepDailyPtr := flag.Int("keepdaily", 0, "prune only. Keep the latest run of this many days. Overrides the config file")
+	keepWeeklyPtr := flag.Int("keepweekly", 0, "prune only. Keep the latest run of this many weeks. Overrides the config file")
+	keepMonthlyPtr := flag.Int("keepmonthly", 0, "prune only. Keep the latest run of this many months. Overrides the config file")
+	var includes stringList
+	flag.Var(&includes, "include", "restore only. Regex limiting the restore to matching keys. May be repeated")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
 
 	cmdOpts := &domain.CommandOpts{
-		UseDebugLogger: *debugLoggingPtr,
-		Dryrun:         *dryrunPtr,
-		Reprocess:      *reprocessPtr,
-		NoConfirm:      *noConfirmPtr,
+		Command:           command,
+		CommandArgs:       append(commandArgs, flag.Args()...),
+		UseDebugLogger:    *debugLoggingPtr,
+		Dryrun:            *dryrunPtr,
+		Reprocess:         *reprocessPtr,
+		NoConfirm:         *noConfirmPtr,
+		Resume:            *resumePtr,
+		Rehash:            *rehashPtr,
+		Incremental:       *incrementalPtr,
+		LocalDestination:  *localDirPtr,
+		FixedBucket:       *fixedBucketPtr,
+		KeyFile:           *keyFilePtr,
+		SkipExisting:      *skipExistingPtr,
+		ConfigFile:        *configPtr,
+		AwsProfile:        *profilePtr,
+		AwsRegion:         *regionPtr,
+		S3Endpoint:        *endpointPtr,
+		S3PathStyle:       *pathStylePtr,
+		HashRoutines:      *hashRoutinesPtr,
+		StorageRoutines:   *storageRoutinesPtr,
+		StorageRetryCount: *retriesPtr,
+		RunId:             *runIdPtr,
+		RestoreTarget:     *targetPtr,
+		RestoreIncludes:   includes,
+		KeepLast:          *keepLastPtr,
+		KeepDaily:         *keepDailyPtr,
+		KeepWeekly:        *keepWeeklyPtr,
+		KeepMonthly:       *keepMonthlyPtr,
 	}
 
 	//create config with defaults overriden by app params
@@ -39,65 +94,151 @@ func main() {
 	logger := appConfig.Logger()
 	defer logger.Sync()
 
-	//build a list of all possible files - either from OS (default) or a JSON file (requested via CLI opts)
-	var allObjectsList []*domain.FileInfo
+	//run any command other than a backup and quit
+	if appConfig.Command() != "" {
+		err = runCommand(appConfig)
+		if err != nil {
+			logger.Fatalw("command failed", "command", appConfig.Command(), "err", err, "meta", domain.Err)
+		}
+		totalTime := prettyTime(time.Since(startTime))
+		logger.Infow("total execution time", "time", totalTime, "meta", domain.Stat)
+		return
+	}
+
+	//a dryrun walks the backup directives and checks storage is reachable but hashes and stores nothing
+	if appConfig.Dryrun() {
+		err = dryrunObjects(appConfig)
+		if err != nil {
+			logger.Fatalw("critical storage failure", "err", err, "meta", domain.Err)
+		}
+		totalTime := prettyTime(time.Since(startTime))
+		logger.Infow("total execution time", "time", totalTime, "meta", domain.Stat)
+		return
+	}
+
+	//files come either from the OS (default) or a JSON file of earlier failures (requested via CLI opts)
+	var reprocessList []*domain.FileInfo
+	var reprocessed *domain.BackupFailures
 	if appConfig.Reprocess() {
 		//read JSON file and determine which files need proccessed
-		allObjectsList, err = buildReprocessingList(appConfig)
+		reprocessList, reprocessed, _ = buildReprocessingList(appConfig)
 
 		//quit gracefully if there is no work to do - ignores errors intentionally
 		//(eg file may not exist so no sense to FATAL in this case or user declines to continue)
-		if len(allObjectsList) == 0 {
+		if len(reprocessList) == 0 {
 			logger.Infow("nothing to reprocess. Exiting", "meta", domain.Chat)
 			os.Exit(0)
 		}
-	} else {
-		allObjectsList, err = buildFileList(appConfig)
 	}
+
+	//walk, hash and store all at once. Ctrl-C or a SIGTERM stops the backup early but still records what was done. A
+	//second signal kills the process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	allObjectsList, basedOn, err := backupObjects(ctx, appConfig, reprocessList)
 	if err != nil {
-		logger.Fatalw("error when building file list", "err", err, "meta", domain.Err)
+		logger.Fatalw("critical backup failure. Aborting", "err", err, "meta", domain.Err)
 	}
 
-	//provide some basic stats on the amount of files and data to transfer/exclude and fetch a list
-	//of files we actually will process (eg trim files we are excluding from our list)
-	objectsToStore := displayFileStats(appConfig, allObjectsList)
-
-	//hash all files we are planning to transfer - skip this if we are in dry run
-	if !appConfig.Dryrun() {
-
-		hashAllFiles(appConfig, objectsToStore)
-
-		//display a count of files that failed to hash for some reason and determine if we should continue
-		tooManyFailedHashes := displayBadHashes(appConfig, objectsToStore)
-		if tooManyFailedHashes {
-			logger.Fatalw("hash calculation failures exceed allowable maximum. Aborting", "configuredMax", appConfig.MaxAllowedHashFailures(), "meta", domain.Core)
-		}
-	} else {
-		logger.Infow("skipping file hashing because of dryrun", "meta", domain.Chat)
+	//determine file failures if any and write a failures file (regardless if failures exist). Reprocessing rewrites
+	//the failures file of the run it is finishing, which keeps that run's date
+	failedFilesDetails := displayStorageStats(appConfig, allObjectsList)
+	if reprocessed != nil {
+		failedFilesDetails.DateCreated = reprocessed.DateCreated
 	}
+	err = writeFailureFile(appConfig, failedFilesDetails)
 
-	//actually write objects to AWS (dry run is handled internally to this routine to allow as much execution as possible)
-	err = writeObjectsToAws(appConfig, objectsToStore)
 	if err != nil {
-		logger.Fatalw("critical AWS failure", "err", err, "meta", domain.Err)
+		logger.Errorw("failed to write backup failures file", "path", appConfig.FailuresFilepath(), "err", err, "meta", domain.Err)
+	} else {
+		logger.Infow("failure filewritten", "path", appConfig.FailuresFilepath(), "meta", domain.Chat)
 	}
 
-	//handle files that failed to be stored, if any
-	if !appConfig.Dryrun() {
-
-		//determine file failures if any and write a failures file (regardless if failures exist)
-		failedFilesDetails := displayStorageStats(appConfig, allObjectsList)
-		err := writeFailureFile(appConfig, failedFilesDetails)
+	//record everything this run holds so later incremental runs can compare against it. Reprocessing adds the files
+	//it stored to the manifest of the run it is finishing instead
+	var manifestPath string
+	if appConfig.Reprocess() {
+		manifestPath, err = updateManifest(appConfig, allObjectsList)
+		if err != nil {
+			logger.Errorw("failed to update manifest file", "err", err, "meta", domain.Err)
+		} else if manifestPath != "" {
+			logger.Infow("manifest file updated", "path", manifestPath, "meta", domain.Chat)
+		}
+	} else {
+		manifestPath, err = writeManifest(appConfig, allObjectsList, basedOn)
+		if err != nil {
+			logger.Errorw("failed to write manifest file", "err", err, "meta", domain.Err)
+			manifestPath = ""
+		} else {
+			logger.Infow("manifest file written", "path", manifestPath, "meta", domain.Chat)
+		}
+	}
 
+	//in repository mode, or when small files are packed, the manifest is stored too as it is the only record of which
+	//object holds each file
+	if (appConfig.Repository() || appConfig.PackThreshold() > 0) && manifestPath != "" {
+		err = uploadIndex(appConfig, manifestPath)
 		if err != nil {
-			logger.Errorw("failed to write backup failures file", "path", appConfig.FailuresFilepath(), "err", err, "meta", domain.Err)
+			logger.Errorw("failed to store run index. Keep the manifest file to restore this run", "path", manifestPath, "err", err, "meta", domain.Err)
 		} else {
-			logger.Infow("failure filewritten", "path", appConfig.FailuresFilepath(), "meta", domain.Chat)
+			logger.Infow("run index stored", "bucketName", appConfig.Bucket(), "key", domain.IndexKey(appConfig.Prefix()), "meta", domain.Aws)
 		}
 	}
 
+	//catalog the run so it can be found again later
+	err = recordSnapshot(appConfig, allObjectsList, basedOn, startTime)
+	if err != nil {
+		logger.Errorw("failed to record run in catalog", "err", err, "meta", domain.Err)
+	}
+
 	//display total run time
 	totalTime := prettyTime(time.Since(startTime))
 	logger.Infow("total execution time", "time", totalTime, "meta", domain.Stat)
 
 }
+
+//runs a command other than a backup
+func runCommand(appConfig domain.Config) error {
+	switch appConfig.Command() {
+	case domain.CommandRestore:
+		return restoreObjects(appConfig)
+	case domain.CommandVerify:
+		return verifyBackup(appConfig)
+	case domain.CommandSnapshots:
+		return showSnapshots(appConfig)
+	case domain.CommandPrune:
+		return pruneRuns(appConfig)
+	default:
+		return fmt.Errorf("unknown command: %s", appConfig.Command())
+	}
+}
+
+//separates a leading command, and any arguments given to it, from the flags that follow
+func splitCommand(args []string) (string, []string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", nil, args
+	}
+	end := 1
+	for end < len(args) && !strings.HasPrefix(args[end], "-") {
+		end++
+	}
+	return args[0], args[1:end], args[end:]
+}
+
+//prints the usage of the app including its commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command [args]] [flags]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Commands:\n")
+	fmt.Fprintf(out, "  (none)    back up the folders listed in the backup directives file\n")
+	fmt.Fprintf(out, "  %-9s download the objects of an earlier run. Requires -run and -target\n", domain.CommandRestore)
+	fmt.Fprintf(out, "  %-9s audit the objects of an earlier run against the local files. Requires -run\n", domain.CommandVerify)
+	fmt.Fprintf(out, "  %-9s '%s %s' lists every run in the catalog, '%s %s <run id>' shows one\n", domain.CommandSnapshots, domain.CommandSnapshots, domain.SnapshotsList, domain.CommandSnapshots, domain.SnapshotsShow)
+	fmt.Fprintf(out, "  %-9s delete the runs that fall outside the retention policy. -dryrun lists them instead\n\n", domain.CommandPrune)
+	fmt.Fprintf(out, "Flags:\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backup/domain"
+)
+
+const (
+	manifestTimeFormat = "20060102T150405Z"
+	manifestExtension  = ".json"
+
+	//manifestDestinationS3 is the destination recorded for runs stored in AWS S3 itself
+	manifestDestinationS3 = "s3"
+)
+
+//loads the entries of a manifest, keyed by path, so unchanged files can be skipped during an incremental backup.
+//The manifest written by the run with id basedOn is used or, if basedOn is empty, the latest one. Also returns
+//the id of the run that wrote the manifest. Returns nil entries if there is no manifest
+func loadPreviousManifest(appConfig domain.Config, basedOn string) (map[string]*domain.ManifestEntry, string, error) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	var previous *domain.Manifest
+	var err error
+	if basedOn == "" {
+		previous, err = loadLatestManifest(appConfig)
+	} else {
+		previous, err = findManifest(appConfig, basedOn)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	//no earlier run to compare against - everything must be stored
+	if previous == nil {
+		logger.Infow("no previous manifest found for this destination. Performing a full backup", "manifestDir", appConfig.ManifestDir(), "meta", domain.Chat)
+		return nil, "", nil
+	}
+
+	entries := make(map[string]*domain.ManifestEntry, len(previous.Entries))
+	for _, e := range previous.Entries {
+		entries[e.Path] = e
+	}
+
+	logger.Infow("comparing files against previous manifest", "basedOn", previous.Id(), "meta", domain.Chat)
+	return entries, previous.Id(), nil
+}
+
+//checks a file against the previous manifest's entries. An unchanged file is marked as stored (in the bucket recorded
+//in the manifest) so it is carried into this run's manifest, and true is returned
+func applyPreviousEntry(fi *domain.FileInfo, entries map[string]*domain.ManifestEntry) bool {
+
+	//size and modification time are our only cheap indicators of change - anything else means a rehash
+	e, found := entries[fi.FullName]
+	if !found || e.Size != fi.Size || !e.ModTime.Equal(fi.ModTime) {
+		return false
+	}
+
+	fi.Hash = e.Hash
+	fi.HashSuccess = true
+	fi.StorageSuccess = true
+	fi.Bucket = e.Bucket
+	fi.Key = e.Key
+	fi.Packed = e.Packed
+	fi.Offset = e.Offset
+	return true
+}
+
+//writes a manifest holding every file that is part of this run's backup - including files carried over from an
+//earlier run during an incremental backup
+func writeManifest(appConfig domain.Config, objectsList []*domain.FileInfo, basedOn string) (string, error) {
+
+	manifest := &domain.Manifest{
+		Created:     time.Now().UTC(),
+		RunId:       appConfig.RunName(),
+		Bucket:      appConfig.Bucket(),
+		Prefix:      appConfig.Prefix(),
+		Destination: manifestDestination(appConfig),
+		Repository:  appConfig.Repository(),
+		BasePaths:   appConfig.BasePaths(),
+		Incremental: appConfig.Incremental(),
+		BasedOn:     basedOn,
+		Entries:     make([]*domain.ManifestEntry, 0, len(objectsList)),
+	}
+
+	for _, fi := range objectsList {
+		if fi.Excluded || !fi.StorageSuccess {
+			continue
+		}
+		manifest.Entries = append(manifest.Entries, &domain.ManifestEntry{
+			Path:    fi.FullName,
+			Size:    fi.Size,
+			ModTime: fi.ModTime,
+			Hash:    fi.Hash,
+			Bucket:  fi.Bucket,
+			Key:     fi.Key,
+			Packed:  fi.Packed,
+			Offset:  fi.Offset,
+		})
+	}
+
+	err := os.MkdirAll(appConfig.ManifestDir(), 0775)
+	if err != nil {
+		return "", fmt.Errorf("failed to create manifest directory: %s err: %v", appConfig.ManifestDir(), err)
+	}
+
+	//the name leads with a sortable UTC timestamp so the latest manifest is simply the last one by name, whatever
+	//the local time zone or daylight saving did in between
+	name := manifest.Created.Format(manifestTimeFormat) + "_" + manifest.RunId + manifestExtension
+	manifestPath := filepath.Join(appConfig.ManifestDir(), name)
+	return manifestPath, saveManifest(manifestPath, manifest)
+}
+
+//adds the files stored while reprocessing to the manifest of the run they belong to, so the manifest once again
+//describes the whole backup. Returns an empty path if that run has no manifest
+func updateManifest(appConfig domain.Config, objectsList []*domain.FileInfo) (string, error) {
+	manifestPath, err := findManifestPath(appConfig, appConfig.RunName())
+	if err != nil || manifestPath == "" {
+		return "", err
+	}
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	index := make(map[string]int, len(manifest.Entries))
+	for i, e := range manifest.Entries {
+		index[e.Path] = i
+	}
+	for _, fi := range objectsList {
+		if fi.Excluded || !fi.StorageSuccess {
+			continue
+		}
+		entry := &domain.ManifestEntry{
+			Path:    fi.FullName,
+			Size:    fi.Size,
+			ModTime: fi.ModTime,
+			Hash:    fi.Hash,
+			Bucket:  fi.Bucket,
+			Key:     fi.Key,
+			Packed:  fi.Packed,
+			Offset:  fi.Offset,
+		}
+		if i, found := index[fi.FullName]; found {
+			manifest.Entries[i] = entry
+		} else {
+			manifest.Entries = append(manifest.Entries, entry)
+		}
+	}
+	return manifestPath, saveManifest(manifestPath, manifest)
+}
+
+//writes a manifest to a file
+func saveManifest(manifestPath string, manifest *domain.Manifest) error {
+
+	//create indented json for easy human readability
+	jsonBytes, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest json structure: %v", err)
+	}
+
+	err = os.WriteFile(manifestPath, jsonBytes, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest file: %s err: %v", manifestPath, err)
+	}
+	return nil
+}
+
+//reads the most recently written manifest of a run stored the way this run is - see sameDestination. Returns nil if
+//there is no such manifest
+func loadLatestManifest(appConfig domain.Config) (*domain.Manifest, error) {
+	logger := appConfig.Logger()
+
+	names, err := filepath.Glob(filepath.Join(appConfig.ManifestDir(), "*"+manifestExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for i := len(names) - 1; i >= 0; i-- {
+		manifest, err := readManifest(names[i])
+		if err != nil {
+			return nil, err
+		}
+		if sameDestination(appConfig, manifest) {
+			return manifest, nil
+		}
+		logger.Debugw("skipping manifest of a run stored elsewhere", "manifest", names[i], "meta", domain.Chat)
+	}
+	return nil, nil
+}
+
+//returns true if a manifest was written by a run stored in the same place, in the same mode and of the same base
+//paths as this one. Only then do the objects its entries point at exist where this run will look for them. Manifests
+//written before the destination was recorded never match
+func sameDestination(appConfig domain.Config, manifest *domain.Manifest) bool {
+	if manifest.Destination != manifestDestination(appConfig) || manifest.Repository != appConfig.Repository() {
+		return false
+	}
+
+	//each run has a bucket of its own unless a fixed bucket is used, in which case the bucket and the kind of prefix
+	//(runs/ or current/) must match
+	if appConfig.FixedBucket() != "" && manifest.Bucket != appConfig.FixedBucket() {
+		return false
+	}
+	if runMode(manifest.Prefix) != runMode(appConfig.Prefix()) {
+		return false
+	}
+
+	if len(manifest.BasePaths) != len(appConfig.BasePaths()) {
+		return false
+	}
+	basePaths := make(map[string]bool, len(manifest.BasePaths))
+	for _, p := range manifest.BasePaths {
+		basePaths[p] = true
+	}
+	for _, p := range appConfig.BasePaths() {
+		if !basePaths[p] {
+			return false
+		}
+	}
+	return true
+}
+
+//returns the first part of a run's prefix, which says how runs are stored in a fixed bucket. Empty for a bucket per run
+func runMode(prefix string) string {
+	return strings.SplitN(prefix, "/", 2)[0]
+}
+
+//names where this run's objects are stored: the local destination directory, or the S3 endpoint
+func manifestDestination(appConfig domain.Config) string {
+	if appConfig.LocalDestination() != "" {
+		dir, err := filepath.Abs(appConfig.LocalDestination())
+		if err != nil {
+			return filepath.Clean(appConfig.LocalDestination())
+		}
+		return dir
+	}
+	if appConfig.S3Endpoint() != "" {
+		return appConfig.S3Endpoint()
+	}
+	return manifestDestinationS3
+}
+
+//reads the manifest written by the run with the given id. Returns nil if there is no such manifest
+func findManifest(appConfig domain.Config, runId string) (*domain.Manifest, error) {
+	manifestPath, err := findManifestPath(appConfig, runId)
+	if err != nil || manifestPath == "" {
+		return nil, err
+	}
+	return readManifest(manifestPath)
+}
+
+//finds the manifest file written by the run with the given id. Returns an empty path if there is no such manifest
+func findManifestPath(appConfig domain.Config, runId string) (string, error) {
+	names, err := filepath.Glob(filepath.Join(appConfig.ManifestDir(), "*_"+runId+manifestExtension))
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+//reads a single manifest file
+func readManifest(manifestPath string) (*domain.Manifest, error) {
+	jsonBytes, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest file: %s because: %v", manifestPath, err)
+	}
+
+	var manifest domain.Manifest
+	err = json.Unmarshal(jsonBytes, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal manifest file: %s because: %v", manifestPath, err)
+	}
+	return &manifest, nil
+}
+
+//stores a copy of this run's manifest, its index, below the run's prefix. In repository mode, or when small files are
+//packed, the keys of the run's objects do not say which file each holds, so restore, verify and prune read the index
+//when there is no local manifest
+func uploadIndex(appConfig domain.Config, manifestPath string) error {
+	ctx := context.Background()
+
+	jsonBytes, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("unable to read manifest file: %s because: %v", manifestPath, err)
+	}
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(jsonBytes)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	return putObjectWithRetry(ctx, store, appConfig, &domain.PutObjectRequest{
+		Container:  appConfig.Bucket(),
+		Key:        domain.IndexKey(appConfig.Prefix()),
+		Body:       bytes.NewReader(jsonBytes),
+		ContentMD5: contentMD5,
+		Metadata:   map[string]string{domain.MetadataMD5: contentMD5},
+	})
+}
+
+//reads the index stored by a run. Returns nil if the run has none
+func fetchIndex(ctx context.Context, store domain.Storage, bucket string, prefix string) (*domain.Manifest, error) {
+	key := domain.IndexKey(prefix)
+	body, _, err := store.GetObject(ctx, bucket, key)
+	if errors.Is(err, domain.ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch index: %s from bucket: %s error: %v", key, bucket, err)
+	}
+	defer body.Close()
+
+	jsonBytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch index: %s from bucket: %s error: %v", key, bucket, err)
+	}
+
+	var manifest domain.Manifest
+	err = json.Unmarshal(jsonBytes, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal index: %s because: %v", key, err)
+	}
+	return &manifest, nil
+}
+
+//reads the manifest of the run with the given id - the local manifest if there is one, otherwise the run's index.
+//Returns nil if there is neither
+func loadRunManifest(ctx context.Context, store domain.Storage, appConfig domain.Config, runId string) (*domain.Manifest, error) {
+	manifest, err := findManifest(appConfig, runId)
+	if err != nil || manifest != nil {
+		return manifest, err
+	}
+	bucket, prefix := appConfig.LocateRun(runId)
+	return fetchIndex(ctx, store, bucket, prefix)
+}
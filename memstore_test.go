@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"backup/domain"
+
+	"github.com/google/uuid"
+)
+
+//memStorage must satisfy the interface it stands in for
+var _ domain.Storage = (*memStorage)(nil)
+
+//errInjected is returned by a memStorage told to fail
+var errInjected = errors.New("injected failure")
+
+//memStorage is a domain.Storage held entirely in memory for tests. It checks content MD5s the way S3 does and can
+//be told to fail a number of puts. Safe for concurrent use
+type memStorage struct {
+	mu         sync.Mutex
+	containers map[string]map[string]*memObject
+	uploads    map[string]*memUpload
+
+	//putFailures fails this many PutObject calls, after reading their body, before any succeeds
+	putFailures int
+
+	//puts counts every PutObject call, failed or not
+	puts int
+}
+
+//memObject is a single stored object
+type memObject struct {
+	content  []byte
+	etag     string
+	metadata map[string]string
+}
+
+//memUpload is a multipart upload in progress
+type memUpload struct {
+	metadata map[string]string
+	parts    map[int32][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		containers: make(map[string]map[string]*memObject),
+		uploads:    make(map[string]*memUpload),
+	}
+}
+
+func (s *memStorage) Name() string {
+	return "memory"
+}
+
+func (s *memStorage) ListContainers(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.containers))
+	for name := range s.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memStorage) ContainerExists(ctx context.Context, container string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.containers[container]
+	return found, nil
+}
+
+func (s *memStorage) CreateContainer(ctx context.Context, container string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.containers[container]; found {
+		return fmt.Errorf("container already exists: %s", container)
+	}
+	s.containers[container] = make(map[string]*memObject)
+	return nil
+}
+
+func (s *memStorage) ConfigureContainer(ctx context.Context, container string, settings *domain.BucketSettings, tags map[string]string) error {
+	return nil
+}
+
+func (s *memStorage) PutObject(ctx context.Context, req *domain.PutObjectRequest) error {
+	content, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.puts++
+	if s.putFailures > 0 {
+		s.putFailures--
+		return errInjected
+	}
+	sum := md5.Sum(content)
+	if base64.StdEncoding.EncodeToString(sum[:]) != req.ContentMD5 {
+		return fmt.Errorf("content MD5 mismatch for object: %s expected: %s", req.Key, req.ContentMD5)
+	}
+	objects, found := s.containers[req.Container]
+	if !found {
+		return fmt.Errorf("no such container: %s", req.Container)
+	}
+	objects[req.Key] = &memObject{content: content, etag: hex.EncodeToString(sum[:]), metadata: req.Metadata}
+	return nil
+}
+
+func (s *memStorage) HeadObject(ctx context.Context, container string, key string) (*domain.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, found := s.containers[container][key]
+	if !found {
+		return nil, fmt.Errorf("%w: %s/%s", domain.ErrObjectNotFound, container, key)
+	}
+	return &domain.ObjectInfo{Key: key, Size: int64(len(obj.content)), ETag: obj.etag, Metadata: obj.metadata}, nil
+}
+
+func (s *memStorage) ListObjects(ctx context.Context, container string, prefix string) ([]*domain.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects := make([]*domain.ObjectInfo, 0)
+	for key, obj := range s.containers[container] {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &domain.ObjectInfo{Key: key, Size: int64(len(obj.content)), ETag: obj.etag})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s *memStorage) GetObject(ctx context.Context, container string, key string) (io.ReadCloser, *domain.ObjectInfo, error) {
+	info, err := s.HeadObject(ctx, container, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(s.containers[container][key].content)), info, nil
+}
+
+func (s *memStorage) CreateMultipartUpload(ctx context.Context, req *domain.PutObjectRequest) (*domain.MultipartUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload := &domain.MultipartUpload{Container: req.Container, Key: req.Key, UploadId: uuid.New().String()}
+	s.uploads[upload.UploadId] = &memUpload{metadata: req.Metadata, parts: make(map[int32][]byte)}
+	return upload, nil
+}
+
+func (s *memStorage) UploadPart(ctx context.Context, upload *domain.MultipartUpload, part *domain.UploadPartRequest) (string, error) {
+	content, err := io.ReadAll(part.Body)
+	if err != nil {
+		return "", err
+	}
+	sum := md5.Sum(content)
+	if base64.StdEncoding.EncodeToString(sum[:]) != part.ContentMD5 {
+		return "", fmt.Errorf("content MD5 mismatch for part: %d of object: %s", part.PartNumber, upload.Key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.uploads[upload.UploadId]
+	if !found {
+		return "", fmt.Errorf("unknown multipart upload: %s", upload.UploadId)
+	}
+	u.parts[part.PartNumber] = content
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *memStorage) CompleteMultipartUpload(ctx context.Context, upload *domain.MultipartUpload, parts []*domain.CompletedPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.uploads[upload.UploadId]
+	if !found {
+		return fmt.Errorf("unknown multipart upload: %s", upload.UploadId)
+	}
+	var content bytes.Buffer
+	partSums := md5.New()
+	for _, p := range parts {
+		partContent, found := u.parts[p.PartNumber]
+		if !found {
+			return fmt.Errorf("missing part: %d of object: %s", p.PartNumber, upload.Key)
+		}
+		partSum := md5.Sum(partContent)
+		partSums.Write(partSum[:])
+		content.Write(partContent)
+	}
+	objects, found := s.containers[upload.Container]
+	if !found {
+		return fmt.Errorf("no such container: %s", upload.Container)
+	}
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(partSums.Sum(nil)), len(parts))
+	objects[upload.Key] = &memObject{content: content.Bytes(), etag: etag, metadata: u.metadata}
+	delete(s.uploads, upload.UploadId)
+	return nil
+}
+
+func (s *memStorage) AbortMultipartUpload(ctx context.Context, upload *domain.MultipartUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploads, upload.UploadId)
+	return nil
+}
+
+func (s *memStorage) DeleteObjects(ctx context.Context, container string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.containers[container], key)
+	}
+	return nil
+}
+
+func (s *memStorage) DeleteContainer(ctx context.Context, container string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.containers, container)
+	return nil
+}
@@ -63,7 +63,9 @@ func displayStorageStats(appConfig domain.Config, objectsList []*domain.FileInfo
 	//prep JSON struct to hold failure data
 	failures := &domain.BackupFailures{
 		DateCreated: time.Now().Format(time.RFC822),
+		RunId:       appConfig.RunName(),
 		Bucket:      appConfig.Bucket(),
+		Prefix:      appConfig.Prefix(),
 		HasFailures: false,
 		FailedPaths: make([]*domain.FileInfo, 0),
 	}
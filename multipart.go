@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"backup/domain"
+)
+
+const (
+	multipartMaxParts     = 10000
+	multipartAbortTimeout = 30 * time.Second
+)
+
+//multipartPart is a single part of a file being stored in parts
+type multipartPart struct {
+	number int32
+	offset int64
+	size   int64
+
+	//md5 is the base64-encoded MD5 hash of the part
+	md5 string
+
+	//etag and err are set once the part has been uploaded (or has failed to upload)
+	etag string
+	err  error
+}
+
+//stores content as an object sent in parts. Parts are uploaded in parallel, each with its own MD5 and retries. If
+//any part ultimately fails the upload is aborted so no incomplete parts are left behind
+func putMultipartObject(ctx context.Context, store domain.Storage, appConfig domain.Config, req *domain.PutObjectRequest, content io.ReaderAt, size int64) error {
+	logger := appConfig.Logger()
+
+	//hash every part up front. This also rehashes the content as a whole - S3 only validates each part, so this is
+	//how we keep the guarantee that what is stored is exactly what was hashed
+	parts, err := planParts(content, size, multipartPartSize(appConfig.MultipartPartSize(), size), req.ContentMD5)
+	if err != nil {
+		return err
+	}
+
+	upload, err := store.CreateMultipartUpload(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %v", err)
+	}
+	logger.Debugw("multipart upload created", "key", req.Key, "partCount", len(parts), "meta", domain.Aws)
+
+	//a failed part stops the remaining parts - there is no sense sending the rest of an upload we are going to abort
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	channel := make(chan *multipartPart, len(parts))
+	for _, part := range parts {
+		channel <- part
+	}
+	close(channel)
+
+	var wg sync.WaitGroup
+	for i := 0; i < appConfig.MultipartRoutinesCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range channel {
+				if partCtx.Err() != nil {
+					part.err = partCtx.Err()
+					continue
+				}
+				part.etag, part.err = uploadPartWithRetry(partCtx, store, appConfig, upload, content, part)
+				if part.err != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	//report the part that actually failed rather than one that was cancelled because of it
+	var failed *multipartPart
+	completed := make([]*domain.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		if part.err != nil && (failed == nil || errors.Is(failed.err, context.Canceled)) {
+			failed = part
+		}
+		completed = append(completed, &domain.CompletedPart{PartNumber: part.number, ETag: part.etag})
+	}
+	if failed != nil {
+		abortMultipartUpload(ctx, store, appConfig, upload)
+		return fmt.Errorf("failed to store part: %d error: %v", failed.number, failed.err)
+	}
+
+	err = store.CompleteMultipartUpload(ctx, upload, completed)
+	if err != nil {
+		abortMultipartUpload(ctx, store, appConfig, upload)
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+	return nil
+}
+
+//determines the size of each part. The configured size is used unless it would need more parts than S3 allows
+func multipartPartSize(configured int64, size int64) int64 {
+	partSize := configured
+	if size > partSize*multipartMaxParts {
+		partSize = (size + multipartMaxParts - 1) / multipartMaxParts
+	}
+	return partSize
+}
+
+//splits content into parts, hashing each of them and the content as a whole in a single pass. The content must
+//still match expectedMD5
+func planParts(content io.ReaderAt, size int64, partSize int64, expectedMD5 string) ([]*multipartPart, error) {
+	whole := md5.New()
+	parts := make([]*multipartPart, 0, size/partSize+1)
+	for offset := int64(0); offset < size; offset += partSize {
+		part := &multipartPart{
+			number: int32(len(parts) + 1),
+			offset: offset,
+			size:   partSize,
+		}
+		if offset+partSize > size {
+			part.size = size - offset
+		}
+
+		h := md5.New()
+		_, err := io.Copy(io.MultiWriter(h, whole), io.NewSectionReader(content, part.offset, part.size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash part: %d error: %v", part.number, err)
+		}
+		part.md5 = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		parts = append(parts, part)
+	}
+
+	actual := base64.StdEncoding.EncodeToString(whole.Sum(nil))
+	if actual != expectedMD5 {
+		return nil, fmt.Errorf("file changed since it was hashed. expected: %s actual: %s", expectedMD5, actual)
+	}
+	return parts, nil
+}
+
+//uploads a single part, retrying a few times using the same 2^n exponential backoff used for whole objects
+func uploadPartWithRetry(ctx context.Context, store domain.Storage, appConfig domain.Config, upload *domain.MultipartUpload, content io.ReaderAt, part *multipartPart) (string, error) {
+	logger := appConfig.Logger()
+
+	req := &domain.UploadPartRequest{
+		PartNumber: part.number,
+		Body:       io.NewSectionReader(content, part.offset, part.size),
+		ContentMD5: part.md5,
+	}
+
+	allowedAttempts := appConfig.StorageRetryCount()
+	if allowedAttempts <= 0 {
+		allowedAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= allowedAttempts; attempt++ {
+		var etag string
+		etag, err = store.UploadPart(ctx, upload, req)
+		if err == nil {
+			return etag, nil
+		}
+		logger.Debugw("uploadPart attempt failed", "key", upload.Key, "part", part.number, "failCount", attempt, "err", err, "meta", domain.Aws)
+
+		//give up when out of attempts or when another part has already failed
+		if attempt == allowedAttempts || ctx.Err() != nil {
+			break
+		}
+		backoffDuration, backoffErr := calcBackoff(attempt)
+		if backoffErr != nil {
+			logger.Errorw("unable to calculate backoff duration", "err", backoffErr, "meta", domain.Err)
+		} else {
+			retryPause(ctx, backoffDuration)
+		}
+		req.Body.Seek(0, io.SeekStart) //move back to head of the part so the retry sends all of it
+	}
+	return "", err
+}
+
+//aborts a multipart upload. Failure is only logged - the upload has already failed and an incomplete upload can also
+//be cleaned up later by a bucket lifecycle rule. The abort is sent even if ctx has been cancelled, as it will have been
+//when the backup is interrupted
+func abortMultipartUpload(ctx context.Context, store domain.Storage, appConfig domain.Config, upload *domain.MultipartUpload) {
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), multipartAbortTimeout)
+		defer cancel()
+	}
+	err := store.AbortMultipartUpload(ctx, upload)
+	if err != nil {
+		appConfig.Logger().Errorw("failed to abort multipart upload", "key", upload.Key, "uploadId", upload.UploadId, "err", err, "meta", domain.Err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"backup/domain"
+
+	"github.com/google/uuid"
+)
+
+//segmentPacker packs files below the pack threshold into tar segments, so a few large objects are stored instead of
+//many small ones. The storage routines share the segment being filled and whichever routine fills it stores it. Safe
+//for concurrent use
+type segmentPacker struct {
+	store     domain.Storage
+	appConfig domain.Config
+
+	mu sync.Mutex
+
+	//current is the segment being filled, if any
+	current *segment
+
+	//routines counts the storage routines still adding files. The last one to finish stores the final segment
+	routines int
+}
+
+//segment is a tar file of packed files, built in a temp file until it is stored
+type segment struct {
+	key  string
+	file *os.File
+	tw   *tar.Writer
+
+	//size counts the bytes written so far and md5 hashes them
+	size int64
+	md5  hash.Hash
+
+	//files are the files packed into the segment. None is stored until the segment is
+	files []*domain.FileInfo
+
+	//err is set if the segment could not be written, which fails every file in it
+	err error
+}
+
+//creates the packer of small files. Returns nil if files are never packed
+func newSegmentPacker(store domain.Storage, appConfig domain.Config) *segmentPacker {
+	if appConfig.PackThreshold() <= 0 {
+		return nil
+	}
+	return &segmentPacker{store: store, appConfig: appConfig, routines: appConfig.StorageRoutinesCount()}
+}
+
+//returns true if a file is small enough to be packed. Segments are stored in the default storage class, so a file a
+//storage class rule picks another class for is never packed
+func (p *segmentPacker) packs(fi *domain.FileInfo) bool {
+	return fi.Size < p.appConfig.PackThreshold() && storageClassFor(p.appConfig, fi) == ""
+}
+
+//packs a file into the current segment. Returns the segment if the file filled it, in which case the caller must
+//store it. A file that cannot be read as it was hashed is not packed and an error is returned instead
+func (p *segmentPacker) add(fi *domain.FileInfo) (*segment, error) {
+
+	//small files are read whole so a file that changed after it was hashed never reaches a segment
+	content, err := os.ReadFile(fi.FullName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file for packing: %v", err)
+	}
+	sum := md5.Sum(content)
+	if int64(len(content)) != fi.Size || base64.StdEncoding.EncodeToString(sum[:]) != fi.Hash {
+		return nil, fmt.Errorf("file changed after it was hashed")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current == nil {
+		p.current, err = p.newSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+	seg := p.current
+	seg.files = append(seg.files, fi)
+	seg.err = seg.write(fi, content)
+
+	if seg.err != nil || seg.size >= p.appConfig.PackSegmentSize() {
+		p.current = nil
+		return seg, nil
+	}
+	return nil, nil
+}
+
+//called by each storage routine once it has no more files. Returns the final segment to the last routine to finish,
+//which must store it
+func (p *segmentPacker) finish() *segment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.routines--
+	if p.routines > 0 || p.current == nil {
+		return nil
+	}
+	seg := p.current
+	p.current = nil
+	return seg
+}
+
+//starts a new segment in a temp file
+func (p *segmentPacker) newSegment() (*segment, error) {
+	file, err := os.CreateTemp("", "backup-segment-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment file: %v", err)
+	}
+	seg := &segment{
+		key:   domain.SegmentKey(p.appConfig.Prefix(), uuid.New().String()),
+		file:  file,
+		md5:   md5.New(),
+		files: make([]*domain.FileInfo, 0),
+	}
+	seg.tw = tar.NewWriter(seg)
+	return seg, nil
+}
+
+//Write adds to the segment's temp file, keeping count of its size and hash. Only called by the segment's tar writer
+func (s *segment) Write(b []byte) (int, error) {
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	s.md5.Write(b[:n])
+	return n, err
+}
+
+//writes a file into the segment as a tar entry named by its key, noting where its content begins
+func (s *segment) write(fi *domain.FileInfo, content []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	err := s.tw.WriteHeader(&tar.Header{
+		Name:    domain.KeyForPath(fi.FullName),
+		Mode:    0664,
+		Size:    fi.Size,
+		ModTime: fi.ModTime,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write segment file: %v", err)
+	}
+
+	fi.Packed = true
+	fi.Offset = s.size
+	_, err = s.tw.Write(content)
+	if err != nil {
+		return fmt.Errorf("failed to write segment file: %v", err)
+	}
+	return nil
+}
+
+//stores a segment then passes every file in it on to the out channel, stored or not. Returns the error that kept the
+//segment from being stored, if any
+func (p *segmentPacker) storeSegment(ctx context.Context, seg *segment, out chan<- *domain.FileInfo) error {
+	logger := p.appConfig.Logger()
+	defer removeTempFile(seg.file)
+
+	err := seg.err
+	if err == nil {
+		err = p.putSegment(ctx, seg)
+	}
+	if err != nil {
+		logger.Errorw("failed to store segment", "key", seg.key, "fileCount", len(seg.files), "err", err, "meta", domain.Err)
+	} else {
+		logger.Debugw("segment stored", "key", seg.key, "fileCount", len(seg.files), "size", seg.size, "meta", domain.Aws)
+	}
+
+	for _, fi := range seg.files {
+		if err != nil {
+			fi.StorageSuccess = false
+			fi.Packed = false
+			fi.Offset = 0
+		} else {
+			fi.StorageSuccess = true
+			fi.Bucket = p.appConfig.Bucket()
+			fi.Key = seg.key
+		}
+		out <- fi
+	}
+	return err
+}
+
+//finishes the tar file and stores it, compressing and encrypting it first if configured. Segments go through the same
+//retries and MD5 checks as any other object
+func (p *segmentPacker) putSegment(ctx context.Context, seg *segment) error {
+	err := seg.tw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish segment file: %v", err)
+	}
+	_, err = seg.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to rewind segment file: %v", err)
+	}
+
+	contentMD5 := base64.StdEncoding.EncodeToString(seg.md5.Sum(nil))
+	body, size := seg.file, seg.size
+	req := &domain.PutObjectRequest{
+		Container:  p.appConfig.Bucket(),
+		Key:        seg.key,
+		Body:       body,
+		ContentMD5: contentMD5,
+		Metadata: map[string]string{
+			domain.MetadataMD5:   contentMD5,
+			domain.MetadataFiles: strconv.Itoa(len(seg.files)),
+		},
+	}
+
+	compressed, compressedSize, err := compressRequest(p.appConfig, req, seg.file, seg.size, seg.key)
+	if err != nil {
+		return err
+	}
+	if compressed != nil {
+		defer removeTempFile(compressed)
+		body, size = compressed, compressedSize
+	}
+
+	if keyring := p.appConfig.Keyring(); keyring != nil {
+		encrypted, encryptedSize, err := encryptRequest(keyring, req, body, seg.size)
+		if err != nil {
+			return err
+		}
+		defer removeTempFile(encrypted)
+		body, size = encrypted, encryptedSize
+	}
+
+	if size >= p.appConfig.MultipartThreshold() {
+		return putMultipartObject(ctx, p.store, p.appConfig, req, body, size)
+	}
+	return putObjectWithRetry(ctx, p.store, p.appConfig, req)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backup/domain"
+)
+
+//writes small files of assorted sizes and returns them hashed, ready for packing
+func writeSmallFiles(t *testing.T, dir string, count int) []*domain.FileInfo {
+	files := make([]*domain.FileInfo, 0, count)
+	modTime := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%02d.txt", i))
+		content := []byte(strings.Repeat(fmt.Sprintf("file %d ", i), 10*i))
+		err := os.WriteFile(name, content, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum(content)
+		files = append(files, &domain.FileInfo{
+			FullName:    name,
+			Size:        int64(len(content)),
+			ModTime:     modTime,
+			Hash:        base64.StdEncoding.EncodeToString(sum[:]),
+			HashSuccess: true,
+		})
+	}
+	return files
+}
+
+//packs files the way a single storage routine does, returning the files as they come out of the packer
+func packFiles(t *testing.T, packer *segmentPacker, files []*domain.FileInfo) []*domain.FileInfo {
+	ctx := context.Background()
+	out := make(chan *domain.FileInfo, len(files))
+	for _, fi := range files {
+		seg, err := packer.add(fi)
+		if err != nil {
+			t.Fatalf("add(%s) error = %v", fi.FullName, err)
+		}
+		if seg != nil {
+			err = packer.storeSegment(ctx, seg, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if seg := packer.finish(); seg != nil {
+		err := packer.storeSegment(ctx, seg, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(out)
+
+	packed := make([]*domain.FileInfo, 0, len(files))
+	for fi := range out {
+		packed = append(packed, fi)
+	}
+	return packed
+}
+
+func TestPackRestoreAndVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		encrypted   bool
+	}{
+		{"plain", "", false},
+		{"compressed", domain.CompressionGzip, false},
+		{"encrypted", "", true},
+		{"compressed and encrypted", domain.CompressionGzip, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newMemStorage()
+			err := store.CreateContainer(ctx, "nightly")
+			if err != nil {
+				t.Fatal(err)
+			}
+			appConfig := &testConfig{
+				retryCount:      1,
+				bucket:          "nightly",
+				prefix:          "runs/run1/",
+				packThreshold:   1024,
+				packSegmentSize: 2048,
+				storageRoutines: 1,
+				compression:     tt.compression,
+				restoreTarget:   t.TempDir(),
+			}
+			if tt.encrypted {
+				appConfig.keyring = newTestKeyring(t)
+			}
+
+			files := writeSmallFiles(t, t.TempDir(), 12)
+			packed := packFiles(t, newSegmentPacker(store, appConfig), files)
+			if len(packed) != len(files) {
+				t.Fatalf("packer returned %d files, want %d", len(packed), len(files))
+			}
+
+			segments := make(map[string]bool)
+			for _, fi := range packed {
+				if !fi.StorageSuccess || !fi.Packed || fi.Bucket != "nightly" || !strings.HasPrefix(fi.Key, "runs/run1/"+domain.ReservedKeyPrefix) {
+					t.Fatalf("file not packed as expected: %+v", fi)
+				}
+				segments[fi.Key] = true
+			}
+			stored, _ := store.ListObjects(ctx, "nightly", "runs/run1/")
+			if len(segments) < 2 || len(stored) != len(segments) {
+				t.Fatalf("files packed into %d segments with %d objects stored, want several segments and nothing else", len(segments), len(stored))
+			}
+
+			//restore reads each segment once and writes every file in it
+			items := make([]*restoreItem, 0, len(packed))
+			for _, fi := range packed {
+				items = append(items, &restoreItem{bucket: fi.Bucket, key: fi.Key, name: domain.KeyForPath(fi.FullName), hash: fi.Hash,
+					modTime: fi.ModTime, packed: true, offset: fi.Offset, size: fi.Size})
+			}
+			jobs := groupSegments(items)
+			if len(jobs) != len(segments) {
+				t.Fatalf("groupSegments() made %d jobs, want one per segment: %d", len(jobs), len(segments))
+			}
+			for _, job := range jobs {
+				err = restoreSegment(ctx, store, appConfig, job)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, fi := range packed {
+				rel, err := keyToRestorePath(domain.KeyForPath(fi.FullName))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, _ := os.ReadFile(fi.FullName)
+				got, err := os.ReadFile(filepath.Join(appConfig.restoreTarget, rel))
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("restored %s differs from the original, err = %v", fi.FullName, err)
+				}
+			}
+
+			//verify reads the size and MD5 of every packed file out of its segment
+			pairs := make(map[string][]*verifyPair)
+			for _, fi := range packed {
+				pairs[fi.Key] = append(pairs[fi.Key], &verifyPair{file: fi, bucket: fi.Bucket, key: fi.Key, packed: true, offset: fi.Offset, size: fi.Size})
+			}
+			for _, job := range pairs {
+				readPackedFiles(ctx, store, appConfig, job)
+				for _, p := range job {
+					if p.err != nil || p.head == nil || p.head.Size != p.file.Size || p.head.Metadata[domain.MetadataMD5] != p.file.Hash {
+						t.Errorf("readPackedFiles() for %s = %+v, err = %v", p.file.FullName, p.head, p.err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPackedFileDamagedInSegment(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStorage()
+	err := store.CreateContainer(ctx, "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := &testConfig{retryCount: 1, bucket: "nightly", packThreshold: 1024, packSegmentSize: 1 << 20,
+		storageRoutines: 1, restoreTarget: t.TempDir()}
+
+	files := writeSmallFiles(t, t.TempDir(), 4)
+	packed := packFiles(t, newSegmentPacker(store, appConfig), files)
+
+	//flip a byte of the third file's content in the stored segment
+	damaged := packed[2]
+	obj := store.containers["nightly"][damaged.Key]
+	obj.content[damaged.Offset] ^= 1
+
+	items := make([]*restoreItem, 0, len(packed))
+	pairs := make([]*verifyPair, 0, len(packed))
+	for _, fi := range packed {
+		items = append(items, &restoreItem{bucket: fi.Bucket, key: fi.Key, name: domain.KeyForPath(fi.FullName), hash: fi.Hash,
+			packed: true, offset: fi.Offset, size: fi.Size})
+		pairs = append(pairs, &verifyPair{file: fi, bucket: fi.Bucket, key: fi.Key, packed: true, offset: fi.Offset, size: fi.Size})
+	}
+
+	jobs := groupSegments(items)
+	if len(jobs) != 1 {
+		t.Fatalf("groupSegments() made %d jobs, want 1", len(jobs))
+	}
+	err = restoreSegment(ctx, store, appConfig, jobs[0])
+	if err == nil {
+		t.Fatalf("restoreSegment() restored a damaged file without error")
+	}
+	for _, item := range items {
+		wantSuccess := item.offset != damaged.Offset
+		if item.success != wantSuccess {
+			t.Errorf("restoreSegment() success of %s = %t, want %t", item.name, item.success, wantSuccess)
+		}
+	}
+
+	readPackedFiles(ctx, store, appConfig, pairs)
+	for _, p := range pairs {
+		matches := p.head != nil && p.head.Metadata[domain.MetadataMD5] == p.file.Hash
+		if matches != (p.file != damaged) {
+			t.Errorf("readPackedFiles() MD5 of %s matches = %t, want %t", p.file.FullName, matches, p.file != damaged)
+		}
+	}
+}
+
+func TestPacks(t *testing.T) {
+	archive, err := domain.ParseStorageClassRule(1, "GLACIER .*archive.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packer := newSegmentPacker(newMemStorage(), &testConfig{packThreshold: 1024, packSegmentSize: 1 << 20, storageRoutines: 1,
+		storageClassRules: []*domain.StorageClassRule{archive}})
+
+	tests := []struct {
+		name string
+		path string
+		size int64
+		want bool
+	}{
+		{"small file", "/home/me/notes.txt", 100, true},
+		{"empty file", "/home/me/empty.txt", 0, true},
+		{"at the threshold", "/home/me/notes.txt", 1024, false},
+		{"small file with another storage class", "/home/me/archive/notes.txt", 100, false},
+	}
+	for _, tt := range tests {
+		got := packer.packs(&domain.FileInfo{FullName: tt.path, Size: tt.size})
+		if got != tt.want {
+			t.Errorf("%s: packs() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	if newSegmentPacker(newMemStorage(), &testConfig{}) != nil {
+		t.Errorf("newSegmentPacker() made a packer with packing disabled")
+	}
+}
+
+func TestPackRejectsFileChangedAfterHashing(t *testing.T) {
+	appConfig := &testConfig{bucket: "nightly", packThreshold: 1024, packSegmentSize: 1 << 20, storageRoutines: 1}
+	packer := newSegmentPacker(newMemStorage(), appConfig)
+	fi := writeSmallFiles(t, t.TempDir(), 2)[1]
+
+	err := os.WriteFile(fi.FullName, []byte("changed"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := packer.add(fi)
+	if err == nil || seg != nil || fi.Packed {
+		t.Errorf("add() of a changed file = %v, %v, packed %t, want an error", seg, err, fi.Packed)
+	}
+	if packer.finish() != nil {
+		t.Errorf("finish() returned a segment although nothing was packed")
+	}
+}
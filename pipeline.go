@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"backup/domain"
+)
+
+//top-level function to back up files. Walking, hashing and storing run at the same time, connected by channels that
+//only hold a few files per routine, so storing starts as soon as the first file is hashed and the work waiting in
+//between never grows with the size of the backup. Files come from the backup directives or, when reprocessing, from
+//reprocessList. Returns every file and directory seen (stored, failed, excluded or unchanged) and, for an incremental
+//backup, the bucket of the run it was based on. When ctx is cancelled (eg the user hits Ctrl-C) nothing more is hashed
+//or stored but the walk carries on, so every file not stored is still returned and ends up in the failures file
+func backupObjects(ctx context.Context, appConfig domain.Config, reprocessList []*domain.FileInfo) ([]*domain.FileInfo, string, error) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	//cancelled to abandon the backup. Every stage keeps passing files along once cancelled so nothing blocks. The
+	//walk has its own context as it only stops when the backup is abandoned, not when interrupted
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	walkCtx, stopWalk := context.WithCancel(context.Background())
+	defer stopWalk()
+
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	//a resumed run picks up where the interrupted run left off, in the bucket it already created. Reprocessing also
+	//stores into the bucket of the run that failed
+	var resumed map[string]*domain.JournalEntry
+	var basedOn string
+	if appConfig.Resume() {
+		resumed, basedOn, err = loadResumeJournal(appConfig)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to resume run: %v", err)
+		}
+	} else if reprocessList == nil {
+		err = prepareBucket(ctx, store, appConfig)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	//files already in the bucket with the same content need not be stored again, if so configured
+	existing, err := newExistingObjects(ctx, store, appConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	//in repository mode content already in the bucket, or stored earlier in this run, is not stored again
+	repo, err := newContentRepository(ctx, store, appConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	//small files are packed into segments, if so configured
+	packer := newSegmentPacker(store, appConfig)
+
+	//on an incremental backup, files unchanged since the last run skip hashing and storing entirely. A resumed run
+	//compares against the same run the interrupted one did, if any
+	var previous map[string]*domain.ManifestEntry
+	if appConfig.Incremental() && reprocessList == nil && (!appConfig.Resume() || basedOn != "") {
+		previous, basedOn, err = loadPreviousManifest(appConfig, basedOn)
+		if err != nil {
+			return nil, "", fmt.Errorf("error when comparing against previous manifest: %v", err)
+		}
+	}
+
+	//record each file as it finishes so an interrupted run can be resumed. Reprocessing is simply rerun instead
+	var journal *domain.Journal
+	if reprocessList == nil {
+		journal, err = openJournal(appConfig, basedOn)
+		if err != nil {
+			return nil, "", err
+		}
+		defer journal.Close()
+	}
+
+	//files unchanged since an earlier run need not be read to be hashed
+	cache, err := openHashCache(appConfig)
+	if err != nil {
+		return nil, "", err
+	}
+	if cache != nil {
+		defer cache.close()
+	}
+
+	logger.Infow("preparing to walk, hash and store objects", "hashRoutineCount", appConfig.HashRoutinesCount(), "storageRoutineCount", appConfig.StorageRoutinesCount(), "meta", domain.Chat)
+	backupStart := time.Now()
+
+	//files to hash, files to store and files that are finished with. Everything ends up in done - files that need no
+	//hashing or storing (excluded or unchanged) go straight there
+	toHash := make(chan *domain.FileInfo, appConfig.HashRoutinesCount())
+	toStore := make(chan *domain.FileInfo, appConfig.StorageRoutinesCount())
+	done := make(chan *domain.FileInfo, appConfig.StorageRoutinesCount())
+
+	//walk (or read the reprocessing list) and feed the hashers
+	var sourceErr error
+	go func() {
+		defer close(toHash)
+
+		unchanged, alreadyStored := 0, 0
+		var unchangedSize int64
+		emit := func(fi *domain.FileInfo) {
+			switch {
+			case fi.Excluded:
+				done <- fi
+			case previous != nil && applyPreviousEntry(fi, previous):
+				unchanged++
+				unchangedSize += fi.Size
+				done <- fi
+			case resumed != nil && applyJournalEntry(fi, resumed):
+				alreadyStored++
+				done <- fi
+			case fi.HashSuccess:
+				//hashed before the run was interrupted. toStore stays open until toHash is closed, which only
+				//happens once we are done here
+				toStore <- fi
+			default:
+				toHash <- fi
+			}
+		}
+
+		if reprocessList != nil {
+			for _, fi := range reprocessList {
+				emit(fi)
+			}
+		} else {
+			sourceErr = walkBasePaths(walkCtx, appConfig, emit)
+			if sourceErr != nil {
+				cancel()
+			}
+		}
+
+		logger.Infow("finished finding files", "meta", domain.Chat)
+		if previous != nil {
+			logger.Infow("unchanged objects metrics", "count", unchanged, "totalSize", unchangedSize, "meta", domain.Stat)
+		}
+		if resumed != nil {
+			logger.Infow("objects stored before the run was interrupted", "count", alreadyStored, "meta", domain.Stat)
+		}
+	}()
+
+	//hash and pass on to the storers
+	var hashWg sync.WaitGroup
+	for i := 0; i < appConfig.HashRoutinesCount(); i++ {
+		hashWg.Add(1)
+		go hashFilesInChannel(ctx, appConfig, cache, toHash, toStore, &hashWg)
+	}
+	go closeStage(toHash, toStore, &hashWg)
+
+	//store and pass on to done
+	var storeWg sync.WaitGroup
+	for i := 0; i < appConfig.StorageRoutinesCount(); i++ {
+		storeWg.Add(1)
+		go storeFilesInChannel(ctx, store, appConfig, existing, repo, packer, toStore, done, &storeWg)
+	}
+	go closeStage(toStore, done, &storeWg)
+
+	//collect every file as it finishes, abandoning the backup if too many files fail to hash
+	allObjectsList := make([]*domain.FileInfo, 0, appConfig.FileCountEstimate())
+	failedHashCount := 0
+	tooManyFailedHashes := false
+	for fi := range done {
+		allObjectsList = append(allObjectsList, fi)
+
+		//a journal that cannot be written only costs us the ability to resume - not worth stopping the backup for
+		if journal != nil && !fi.Excluded {
+			err = journal.Record(fi)
+			if err != nil {
+				logger.Errorw("failed to write journal. This run cannot be resumed", "path", appConfig.JournalFilepath(), "err", err, "meta", domain.Err)
+				journal = nil
+			}
+		}
+
+		if !fi.Excluded && !fi.HashSuccess && ctx.Err() == nil {
+			failedHashCount++
+			if failedHashCount >= appConfig.MaxAllowedHashFailures() {
+				tooManyFailedHashes = true
+				cancel()
+				stopWalk()
+			}
+		}
+	}
+
+	backupTime := prettyTime(time.Since(backupStart))
+	logger.Infow("walking, hashing and storing is complete", "totalTime", backupTime, "meta", domain.Stat)
+	if ctx.Err() != nil && !tooManyFailedHashes && sourceErr == nil {
+		logger.Warnw("backup interrupted. Files not yet stored are listed as failures", "meta", domain.Chat)
+	}
+
+	if sourceErr != nil && !errors.Is(sourceErr, context.Canceled) {
+		return nil, "", fmt.Errorf("error when building file list: %v", sourceErr)
+	}
+	if tooManyFailedHashes {
+		return nil, "", fmt.Errorf("hash calculation failures exceed allowable maximum of: %d", appConfig.MaxAllowedHashFailures())
+	}
+
+	if repo != nil {
+		count, size := repo.deduplicated()
+		logger.Infow("deduplicated objects metrics", "count", count, "totalSize", size, "meta", domain.Stat)
+		if appConfig.ChunkThreshold() > 0 {
+			count, size = repo.deduplicatedChunks()
+			logger.Infow("deduplicated chunks metrics", "count", count, "totalSize", size, "meta", domain.Stat)
+		}
+	}
+
+	displayFileStats(appConfig, allObjectsList)
+	displayBadHashes(appConfig, allObjectsList)
+	return allObjectsList, basedOn, nil
+}
+
+//closes a stage's output once all of its routines are finished. Routines that gave up because of excessive errors
+//can leave files behind in the stage's input - those are passed on untouched so nothing is lost
+func closeStage(in <-chan *domain.FileInfo, out chan<- *domain.FileInfo, wg *sync.WaitGroup) {
+	wg.Wait()
+	for fi := range in {
+		out <- fi
+	}
+	close(out)
+}
+
+//top-level function for a dryrun. Walks the backup directives but hashes and stores nothing
+func dryrunObjects(appConfig domain.Config) error {
+	ctx := context.Background()
+
+	allObjectsList, err := buildFileList(appConfig)
+	if err != nil {
+		return fmt.Errorf("error when building file list: %v", err)
+	}
+	objectsToStore := displayFileStats(appConfig, allObjectsList)
+
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+	return handleDryrun(ctx, store, appConfig, objectsToStore)
+}
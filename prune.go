@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"backup/domain"
+)
+
+//top-level function for the prune command. Finds this app's runs in the destination and deletes those that fall
+//outside the retention policy, keeping any run a kept incremental run still depends on. In repository mode the content
+//no kept run refers to is deleted as well
+func pruneRuns(appConfig domain.Config) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	ctx := context.Background()
+
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+	catalog, err := domain.ReadCatalog(appConfig.CatalogFilepath())
+	if err != nil {
+		return err
+	}
+	if appConfig.FixedBucket() != "" {
+		stored, err := fetchCatalog(ctx, store, appConfig.Bucket())
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			catalog.Merge(stored)
+		}
+	}
+
+	runs, err := findRuns(ctx, store, appConfig, catalog)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		logger.Infow("no runs found. Nothing to prune", "meta", domain.Chat)
+		return nil
+	}
+
+	appConfig.Retention().Apply(runs)
+	protectRuns(appConfig, runs)
+
+	doomed := make([]*domain.RetainedRun, 0)
+	for _, run := range runs {
+		if !run.Keep() {
+			doomed = append(doomed, run)
+		}
+	}
+	logger.Infow("runs kept", "count", len(runs)-len(doomed), "meta", domain.Stat)
+	logger.Infow("runs outside the retention policy", "count", len(doomed), "meta", domain.Stat)
+	if len(doomed) == 0 {
+		logger.Infow("every run is kept. Nothing to prune", "meta", domain.Chat)
+		return nil
+	}
+
+	//a dryrun only shows what would happen
+	if appConfig.Dryrun() {
+		fmt.Print(formatPrunePlan(runs))
+		if appConfig.Repository() {
+			unused, _, err := findUnusedContent(ctx, store, appConfig, runs)
+			if err != nil {
+				return err
+			}
+			logger.Infow("content objects no kept run uses", "count", len(unused), "meta", domain.Stat)
+		}
+		logger.Infow("dryrun - no runs deleted", "meta", domain.Chat)
+		return nil
+	}
+
+	//get confirmation unless bypassed by CLI opts
+	if !appConfig.NoConfirm() && !confirmPrune(os.Stdin, runs, len(doomed)) {
+		logger.Infow("prune cancelled", "meta", domain.Chat)
+		return nil
+	}
+
+	failed := 0
+	for _, run := range doomed {
+		err = deleteRun(ctx, store, run)
+		if err != nil {
+			failed++
+			logger.Errorw("failed to delete run", "runId", run.RunId, "bucketName", run.Bucket, "prefix", run.Prefix, "err", err, "meta", domain.Err)
+			continue
+		}
+		logger.Infow("run deleted", "runId", run.RunId, "bucketName", run.Bucket, "prefix", run.Prefix, "meta", domain.Aws)
+
+		//forget the run too, so incremental backups are not based on it and it is no longer listed
+		catalog.Remove(run.RunId)
+		manifestPath, err := findManifestPath(appConfig, run.RunId)
+		if err == nil && manifestPath != "" {
+			err = os.Remove(manifestPath)
+		}
+		if err != nil {
+			logger.Errorw("failed to remove manifest of deleted run", "runId", run.RunId, "err", err, "meta", domain.Err)
+		}
+	}
+
+	err = catalog.Save(appConfig.CatalogFilepath())
+	if err != nil {
+		return err
+	}
+	if appConfig.FixedBucket() != "" {
+		err = uploadCatalog(ctx, store, appConfig, catalog)
+		if err != nil {
+			return fmt.Errorf("unable to store catalog in bucket: %s error: %v", appConfig.Bucket(), err)
+		}
+	}
+
+	logger.Infow("number of runs deleted", "count", len(doomed)-failed, "meta", domain.Stat)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d runs could not be deleted", failed, len(doomed))
+	}
+
+	if appConfig.Repository() {
+		return collectGarbage(ctx, store, appConfig, runs)
+	}
+	return nil
+}
+
+//deletes the content objects of a repository that no kept run uses. Content still being stored by a backup would look
+//unused too, which is why prune must not run at the same time as a backup into the repository
+func collectGarbage(ctx context.Context, store domain.Storage, appConfig domain.Config, runs []*domain.RetainedRun) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	unused, size, err := findUnusedContent(ctx, store, appConfig, runs)
+	if err != nil {
+		return err
+	}
+	err = store.DeleteObjects(ctx, appConfig.Bucket(), unused)
+	if err != nil {
+		return fmt.Errorf("unable to delete unused content from bucket: %s error: %v", appConfig.Bucket(), err)
+	}
+	logger.Infow("unused content deleted", "count", len(unused), "totalSize", size, "meta", domain.Stat)
+	return nil
+}
+
+//finds the content objects no kept run uses, returning their keys and total size. The manifest (or index) of every kept
+//run must be read to know what it uses - if one cannot be found nothing is unused, as nothing can safely be deleted.
+//The run a resume would continue has no manifest yet, so the content recorded in the journal is used too, as are the
+//chunks named by every chunk list in use
+func findUnusedContent(ctx context.Context, store domain.Storage, appConfig domain.Config, runs []*domain.RetainedRun) ([]string, int64, error) {
+	used := make(map[string]bool)
+	header, entries, err := domain.ReadJournal(appConfig.JournalFilepath())
+	journalRunId := ""
+	if err == nil {
+		journalRunId = header.RunId
+		for _, e := range entries {
+			if e.Stored {
+				used[e.Key] = true
+			}
+		}
+	}
+
+	for _, run := range runs {
+		if !run.Keep() {
+			continue
+		}
+		manifest, err := loadRunManifest(ctx, store, appConfig, run.RunId)
+		if err != nil {
+			return nil, 0, err
+		}
+		if manifest == nil {
+			if run.RunId == journalRunId {
+				continue
+			}
+			appConfig.Logger().Warnw("kept run has no manifest or index. Unused content is not deleted", "runId", run.RunId, "meta", domain.Chat)
+			return nil, 0, nil
+		}
+		for _, e := range manifest.Entries {
+			used[e.Key] = true
+		}
+	}
+
+	for key := range used {
+		if !domain.IsChunkListKey(key) {
+			continue
+		}
+		list, err := fetchChunkList(ctx, store, appConfig.Bucket(), key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if list == nil {
+			continue
+		}
+		for _, c := range list.Chunks {
+			used[domain.ContentKey(c.Hash)] = true
+		}
+	}
+
+	objects, err := store.ListObjects(ctx, appConfig.Bucket(), domain.RepositoryDataPrefix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to list bucket: %s error: %v", appConfig.Bucket(), err)
+	}
+	unused := make([]string, 0)
+	var size int64
+	for _, o := range objects {
+		if !used[o.Key] {
+			unused = append(unused, o.Key)
+			size += o.Size
+		}
+	}
+	return unused, size, nil
+}
+
+//finds every run made by this app: the buckets named like a run id or, with a fixed bucket, the run prefixes in it
+func findRuns(ctx context.Context, store domain.Storage, appConfig domain.Config, catalog *domain.Catalog) ([]*domain.RetainedRun, error) {
+	runIds := make([]string, 0)
+	if appConfig.FixedBucket() == "" {
+		names, err := store.ListContainers(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list buckets: %v", err)
+		}
+		for _, name := range names {
+			if domain.IsRunName(name) {
+				runIds = append(runIds, name)
+			}
+		}
+	} else {
+		runsPrefix := domain.RunPrefixRuns + "/"
+		objects, err := store.ListObjects(ctx, appConfig.FixedBucket(), runsPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects in bucket: %s error: %v", appConfig.FixedBucket(), err)
+		}
+		seen := make(map[string]bool)
+		for _, o := range objects {
+			runId := strings.SplitN(strings.TrimPrefix(o.Key, runsPrefix), "/", 2)[0]
+			if domain.IsRunName(runId) && !seen[runId] {
+				seen[runId] = true
+				runIds = append(runIds, runId)
+			}
+		}
+
+		//an incremental run that found nothing changed stored nothing below its prefix. Only the catalog knows it, yet
+		//it still depends on the run it was based on
+		for _, s := range catalog.Snapshots {
+			bucket, prefix := appConfig.LocateRun(s.RunId)
+			if s.Bucket == bucket && s.Prefix == prefix && domain.IsRunName(s.RunId) && !seen[s.RunId] {
+				seen[s.RunId] = true
+				runIds = append(runIds, s.RunId)
+			}
+		}
+	}
+
+	runs := make([]*domain.RetainedRun, 0, len(runIds))
+	for _, runId := range runIds {
+		run, err := describeRun(ctx, store, appConfig, catalog, runId)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+//works out when a run began and which run it was based on. The catalog is the best source, then the run's manifest
+//and, for a run with a bucket of its own, the copy of the catalog in that bucket (eg a run made on another machine).
+//Failing all of those, the run began on the date in its id and was not based on another
+func describeRun(ctx context.Context, store domain.Storage, appConfig domain.Config, catalog *domain.Catalog, runId string) (*domain.RetainedRun, error) {
+	run := &domain.RetainedRun{RunId: runId}
+	run.Bucket, run.Prefix = appConfig.LocateRun(runId)
+
+	if s := catalog.Find(runId); s != nil {
+		run.Started, run.BasedOn = s.Started, s.BasedOn
+		return run, nil
+	}
+
+	manifest, err := findManifest(appConfig, runId)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		run.Started, run.BasedOn = manifest.Created, manifest.BasedOn
+		return run, nil
+	}
+
+	if run.Prefix == "" {
+		stored, err := fetchCatalog(ctx, store, run.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			if s := stored.Find(runId); s != nil {
+				run.Started, run.BasedOn = s.Started, s.BasedOn
+				return run, nil
+			}
+		}
+	}
+
+	run.Started, err = domain.RunNameDate(runId)
+	if err != nil {
+		return nil, err
+	}
+	appConfig.Logger().Warnw("nothing records the run. Runs it may be based on are not protected", "runId", runId, "meta", domain.Chat)
+	return run, nil
+}
+
+//keeps the runs still needed by the runs the retention policy keeps: every run a kept incremental run is based on
+//(directly or through other incremental runs) holds files it did not store again. The runs a resume or reprocess
+//would continue are kept too. A repository keeps every file's content outside of the runs so no run depends on another
+func protectRuns(appConfig domain.Config, runs []*domain.RetainedRun) {
+	byId := make(map[string]*domain.RetainedRun, len(runs))
+	for _, run := range runs {
+		byId[run.RunId] = run
+	}
+
+	header, _, err := domain.ReadJournal(appConfig.JournalFilepath())
+	if err == nil {
+		keepRun(byId, header.RunId, header.Bucket, domain.KeepReasonJournal)
+	}
+	failures, err := domain.ReadFailureFile(appConfig.FailuresFilepath())
+	if err == nil && failures.HasFailures {
+		keepRun(byId, failures.RunId, failures.Bucket, domain.KeepReasonFailures)
+	}
+
+	if appConfig.Repository() {
+		return
+	}
+
+	//follow each chain of incremental runs back to the full run it began with
+	pending := make([]*domain.RetainedRun, 0, len(runs))
+	for _, run := range runs {
+		if run.Keep() {
+			pending = append(pending, run)
+		}
+	}
+	for len(pending) > 0 {
+		run := pending[0]
+		pending = pending[1:]
+
+		base, found := byId[run.BasedOn]
+		if !found {
+			continue
+		}
+		wasKept := base.Keep()
+		base.Reasons = append(base.Reasons, domain.KeepReasonBase+run.RunId)
+		if !wasKept {
+			pending = append(pending, base)
+		}
+	}
+}
+
+//adds a reason to keep a run, if it is one of the runs found. Older journals and failures files only record the
+//bucket, which was then the run id
+func keepRun(byId map[string]*domain.RetainedRun, runId string, bucket string, reason string) {
+	if runId == "" {
+		runId = bucket
+	}
+	if run, found := byId[runId]; found {
+		run.Reasons = append(run.Reasons, reason)
+	}
+}
+
+//deletes a run's bucket or, in a fixed bucket, every object below the run's prefix
+func deleteRun(ctx context.Context, store domain.Storage, run *domain.RetainedRun) error {
+	if run.Prefix == "" {
+		return store.DeleteContainer(ctx, run.Bucket)
+	}
+
+	objects, err := store.ListObjects(ctx, run.Bucket, run.Prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	return store.DeleteObjects(ctx, run.Bucket, keys)
+}
+
+//asks before deleting anything, in the style of the reprocessing menu. Returns true to go ahead and false when
+//pruning is cancelled or input ends before an answer
+func confirmPrune(in io.Reader, runs []*domain.RetainedRun, doomedCount int) bool {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Println()
+		fmt.Printf("Prune Menu: %d of %d runs fall outside the retention policy\n", doomedCount, len(runs))
+		fmt.Println()
+		fmt.Println("1: List runs to keep and delete")
+		fmt.Println("2: Delete now")
+		fmt.Println("3: Cancel Pruning")
+		fmt.Println()
+		fmt.Println("Enter ")
+
+		//nobody is there to answer once input ends (eg under cron), so pruning is cancelled
+		if !scanner.Scan() {
+			return false
+		}
+		choice, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil {
+			continue
+		}
+		switch choice {
+		case 1:
+			fmt.Println()
+			fmt.Print(formatPrunePlan(runs))
+		case 2:
+			return true
+		case 3:
+			return false
+		}
+	}
+}
+
+//lays out every run, newest first, with whether it is kept and why
+func formatPrunePlan(runs []*domain.RetainedRun) string {
+	var sb strings.Builder
+
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN ID\tSTARTED\tLOCATION\tACTION\tKEPT AS")
+	for _, run := range runs {
+		action := "delete"
+		if run.Keep() {
+			action = "keep"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", run.RunId, run.Started.Local().Format("2006-01-02 15:04"),
+			run.Bucket+"/"+run.Prefix, action, strings.Join(run.Reasons, ", "))
+	}
+	tw.Flush()
+	return sb.String()
+}
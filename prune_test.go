@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"backup/domain"
+)
+
+func TestConfirmPrune(t *testing.T) {
+	runs := []*domain.RetainedRun{{RunId: "run1"}, {RunId: "run2", Reasons: []string{domain.KeepReasonLast}}}
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{"delete now", "2\n", true},
+		{"cancel", "3\n", false},
+		{"list then delete", "1\n2\n", true},
+		{"answer without a newline", "2", true},
+		{"unparsable answers are asked again", "yes\n\n9\n 2 \n", true},
+		{"no input", "", false},
+		{"input ends after listing", "1\n", false},
+		{"input ends after an unparsable answer", "delete\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := confirmPrune(strings.NewReader(tt.input), runs, 1)
+			if got != tt.want {
+				t.Errorf("confirmPrune() with input %q = %t, want %t", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"backup/domain"
+)
+
+//contentRepository stores the content of each file once, keyed by the content's SHA-256, in repository mode. Content
+//already in the bucket (from this or any earlier run) or already stored by this run is never stored again, so renamed,
+//moved and duplicated files cost nothing. Safe for concurrent use
+type contentRepository struct {
+	store     domain.Storage
+	appConfig domain.Config
+
+	mu sync.Mutex
+
+	//uploads holds the content (and chunk lists) stored or being stored, keyed by key
+	uploads map[string]*contentUpload
+
+	//dedupCount and dedupSize count the files that were not stored as their content already was
+	dedupCount int
+	dedupSize  int64
+
+	//chunkDedupCount and chunkDedupSize count the chunks of chunked files that were not stored as they already were
+	chunkDedupCount int
+	chunkDedupSize  int64
+}
+
+//contentUpload is the storing of a single content object. done is closed once it is finished, after which err is set
+//if it failed
+type contentUpload struct {
+	done chan struct{}
+	err  error
+}
+
+//creates the content repository, listing the content already in the bucket. Returns nil outside repository mode
+func newContentRepository(ctx context.Context, store domain.Storage, appConfig domain.Config) (*contentRepository, error) {
+	if !appConfig.Repository() {
+		return nil, nil
+	}
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	objects, err := store.ListObjects(ctx, appConfig.Bucket(), domain.RepositoryDataPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list bucket: %s error: %v", appConfig.Bucket(), err)
+	}
+
+	//content already stored is simply a finished upload
+	stored := &contentUpload{done: make(chan struct{})}
+	close(stored.done)
+
+	repo := &contentRepository{store: store, appConfig: appConfig, uploads: make(map[string]*contentUpload, len(objects))}
+	for _, o := range objects {
+		repo.uploads[o.Key] = stored
+	}
+	logger.Infow("listed content already stored", "bucketName", appConfig.Bucket(), "count", len(objects), "meta", domain.Aws)
+	return repo, nil
+}
+
+//stores a file's content, or its chunks and chunk list if it is chunked, unless the repository already holds it. On
+//success the file's bucket and key are set
+func (r *contentRepository) storeFile(ctx context.Context, fi *domain.FileInfo) error {
+	if fi.ContentHash == "" {
+		return fmt.Errorf("file has no content hash. Rehash it to store it in the repository")
+	}
+
+	key := objectKey(r.appConfig, fi)
+	stored, err := r.storeOnce(ctx, key, func() error {
+		if isChunked(r.appConfig, fi) {
+			return r.storeChunkedFile(ctx, fi, key)
+		}
+		return storeFile(ctx, r.store, r.appConfig, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !stored {
+		r.mu.Lock()
+		r.dedupCount++
+		r.dedupSize += fi.Size
+		r.mu.Unlock()
+		r.appConfig.Logger().Debugw("content already stored", "path", fi.FullName, "contentHash", fi.ContentHash, "meta", domain.Aws)
+	}
+	fi.Bucket = r.appConfig.Bucket()
+	fi.Key = key
+	return nil
+}
+
+//stores the object with the given key by calling put, unless the repository already holds it. A caller wanting an
+//object another routine is storing waits for it to finish and, should that fail, tries to store it itself. Returns
+//true if put stored the object
+func (r *contentRepository) storeOnce(ctx context.Context, key string, put func() error) (bool, error) {
+	for {
+		r.mu.Lock()
+		upload, found := r.uploads[key]
+		if !found {
+			upload = &contentUpload{done: make(chan struct{})}
+			r.uploads[key] = upload
+		}
+		r.mu.Unlock()
+
+		//this routine claimed the object - store it, forgetting the claim on failure so another routine may try again
+		if !found {
+			upload.err = put()
+			if upload.err != nil {
+				r.mu.Lock()
+				delete(r.uploads, key)
+				r.mu.Unlock()
+			}
+			close(upload.done)
+			return true, upload.err
+		}
+
+		select {
+		case <-upload.done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		if upload.err == nil {
+			return false, nil
+		}
+	}
+}
+
+//returns the number and total size of the files whose content was already stored
+func (r *contentRepository) deduplicated() (int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dedupCount, r.dedupSize
+}
+
+//returns the number and total size of the chunks of chunked files that were already stored
+func (r *contentRepository) deduplicatedChunks() (int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.chunkDedupCount, r.chunkDedupSize
+}
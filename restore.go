@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"backup/domain"
+)
+
+const (
+	restoreTempPrefix = ".restore-"
+)
+
+//restoreItem describes a single object to download and the file it becomes
+type restoreItem struct {
+
+	//bucket and key locate the object in storage
+	bucket string
+	key    string
+
+	//name is the key without the prefix of the run that stored it. It decides where the file is restored to
+	name string
+
+	//hash is the expected base64 MD5 of the file when known up front (eg from a manifest)
+	hash string
+
+	//modTime is applied to the restored file when known
+	modTime time.Time
+
+	//packed is set true if the file was packed into the segment at key. offset and size then locate its content
+	packed bool
+	offset int64
+	size   int64
+
+	//members are the packed files restored from this item's segment, if it is one
+	members []*restoreItem
+
+	//success is set true once the file is restored and verified
+	success bool
+}
+
+//top-level function to restore the objects of an earlier run into the target directory
+func restoreObjects(appConfig domain.Config) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	ctx := context.Background()
+
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+
+	items, err := buildRestoreList(ctx, store, appConfig)
+	if err != nil {
+		return err
+	}
+	logger.Infow("objects to restore", "count", len(items), "runId", appConfig.RunId(), "target", appConfig.RestoreTarget(), "meta", domain.Stat)
+
+	restoreStart := time.Now()
+
+	//the channel that will carry all data to the routines - size it to handle the data we will put in
+	jobs := groupSegments(items)
+	channel := make(chan *restoreItem, len(jobs))
+	for _, job := range jobs {
+		channel <- job
+	}
+	close(channel)
+
+	//launch multiple go routines to fetch the objects. use waitgroup to halt main thread until all
+	//routines are finished
+	var wg sync.WaitGroup
+	for i := 0; i < appConfig.StorageRoutinesCount(); i++ {
+		wg.Add(1)
+		go restoreFilesInChannel(ctx, store, appConfig, channel, &wg)
+	}
+
+	logger.Infow("waiting for restore to complete...", "meta", domain.Chat)
+	wg.Wait()
+
+	restoreTime := prettyTime(time.Since(restoreStart))
+	logger.Infow("restore is complete", "totalTime", restoreTime, "meta", domain.Stat)
+
+	failed := 0
+	for _, item := range items {
+		if !item.success {
+			failed++
+			logger.Infow("object not restored", "bucket", item.bucket, "key", item.key, "meta", domain.Stat)
+		}
+	}
+	logger.Infow("number of objects successfully restored", "count", len(items)-failed, "meta", domain.Stat)
+	logger.Infow("number of restore failures", "count", failed, "meta", domain.Stat)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed to restore", failed, len(items))
+	}
+	return nil
+}
+
+//builds the list of objects to restore. A manifest for the run (the local one or the copy stored with the run) is
+//preferred as it also knows about files an incremental run left in earlier runs. Without one, the run's bucket (or
+//prefix of a fixed bucket) is listed
+func buildRestoreList(ctx context.Context, store domain.Storage, appConfig domain.Config) ([]*restoreItem, error) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	runId := appConfig.RunId()
+	candidates := make([]*restoreItem, 0)
+
+	manifest, err := loadRunManifest(ctx, store, appConfig, runId)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest != nil {
+		logger.Infow("restoring from manifest", "runId", runId, "entryCount", len(manifest.Entries), "meta", domain.Chat)
+		for _, e := range manifest.Entries {
+			candidates = append(candidates, &restoreItem{
+				bucket:  e.Bucket,
+				key:     e.Key,
+				name:    domain.KeyForRecordedPath(e.Path),
+				hash:    e.Hash,
+				modTime: e.ModTime,
+				packed:  e.Packed,
+				offset:  e.Offset,
+				size:    e.Size,
+			})
+		}
+	} else {
+		bucket, prefix := appConfig.LocateRun(runId)
+		logger.Infow("no manifest found for run. Restoring from bucket listing", "runId", runId, "bucket", bucket, "prefix", prefix, "meta", domain.Chat)
+		objects, err := store.ListObjects(ctx, bucket, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list bucket: %s error: %v", bucket, err)
+		}
+		for _, o := range objects {
+			if strings.HasPrefix(strings.TrimPrefix(o.Key, prefix), domain.ReservedKeyPrefix) {
+				continue
+			}
+			candidates = append(candidates, &restoreItem{
+				bucket: bucket,
+				key:    o.Key,
+				name:   strings.TrimPrefix(o.Key, prefix),
+			})
+		}
+	}
+
+	//apply include filters, if any
+	includes := appConfig.RestoreIncludes()
+	if len(includes) == 0 {
+		return candidates, nil
+	}
+	items := make([]*restoreItem, 0, len(candidates))
+	for _, item := range candidates {
+		for _, rgx := range includes {
+			if rgx.MatchString(item.name) {
+				items = append(items, item)
+				break
+			}
+		}
+	}
+	return items, nil
+}
+
+//replaces the packed files among the items with one item per segment, so each segment is downloaded only once
+func groupSegments(items []*restoreItem) []*restoreItem {
+	jobs := make([]*restoreItem, 0, len(items))
+	segments := make(map[string]*restoreItem)
+	for _, item := range items {
+		if !item.packed {
+			jobs = append(jobs, item)
+			continue
+		}
+		id := item.bucket + "/" + item.key
+		seg, found := segments[id]
+		if !found {
+			seg = &restoreItem{bucket: item.bucket, key: item.key, name: item.key}
+			segments[id] = seg
+			jobs = append(jobs, seg)
+		}
+		seg.members = append(seg.members, item)
+	}
+
+	//a segment is read front to back
+	for _, seg := range segments {
+		sort.Slice(seg.members, func(i, j int) bool {
+			return seg.members[i].offset < seg.members[j].offset
+		})
+	}
+	return jobs
+}
+
+//routine to read objects from the channel and restore them to disk
+func restoreFilesInChannel(ctx context.Context, store domain.Storage, appConfig domain.Config, ch chan *restoreItem, wg *sync.WaitGroup) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+	defer wg.Done()
+
+	allowedAttempts := appConfig.StorageRetryCount()
+	if allowedAttempts <= 0 {
+		allowedAttempts = 1
+	}
+
+	for item := range ch {
+
+		//retry a few times using the same 2^n exponential backoff used when storing
+		var err error
+		for attempt := 1; attempt <= allowedAttempts; attempt++ {
+			if len(item.members) > 0 {
+				err = restoreSegment(ctx, store, appConfig, item)
+			} else {
+				err = restoreObject(ctx, store, appConfig, item)
+			}
+			if err == nil {
+				break
+			}
+			logger.Debugw("restore attempt failed", "key", item.key, "failCount", attempt, "err", err, "meta", domain.Aws)
+
+			//retrying cannot help an archived object
+			if attempt == allowedAttempts || errors.Is(err, domain.ErrObjectArchived) {
+				break
+			}
+			backoffDuration, backoffErr := calcBackoff(attempt)
+			if backoffErr != nil {
+				logger.Errorw("unable to calculate backoff duration", "err", backoffErr, "meta", domain.Err)
+			} else {
+				retryPause(ctx, backoffDuration)
+			}
+		}
+
+		if errors.Is(err, domain.ErrObjectArchived) {
+			logger.Errorw("object is archived. Restore it in S3 (RestoreObject) and run the restore again", "bucket", item.bucket, "key", item.key, "err", err, "meta", domain.Err)
+			continue
+		}
+		if err != nil {
+			logger.Errorw("failed to restore object after exhausting retries", "bucket", item.bucket, "key", item.key, "err", err, "meta", domain.Err)
+			continue
+		}
+		item.success = true
+	}
+}
+
+//downloads a single object and restores the file it holds
+func restoreObject(ctx context.Context, store domain.Storage, appConfig domain.Config, item *restoreItem) error {
+	body, info, err := store.GetObject(ctx, item.bucket, item.key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	//decrypt and decompress on the way down if the object was encrypted or compressed before upload
+	content, err := decodeContent(appConfig, body, info.Metadata)
+	if err != nil {
+		return err
+	}
+
+	//a chunked file is put back together from the chunks its chunk list names
+	if info.Metadata[domain.MetadataChunks] != "" {
+		chunks, err := newChunkReader(ctx, store, appConfig, item.bucket, content)
+		if err != nil {
+			return err
+		}
+		defer chunks.Close()
+		content = chunks
+	}
+
+	return writeRestoredFile(appConfig, item, content, storedHash(item.hash, info))
+}
+
+//downloads a segment once and restores each of its packed files not yet restored. Returns an error if any of them
+//could not be restored, so only those are tried again
+func restoreSegment(ctx context.Context, store domain.Storage, appConfig domain.Config, seg *restoreItem) error {
+	body, info, err := store.GetObject(ctx, seg.bucket, seg.key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	content, err := decodeContent(appConfig, body, info.Metadata)
+	if err != nil {
+		return err
+	}
+
+	//members are sorted by offset, so the segment is read once, skipping whatever lies between them
+	var pos int64
+	failed := 0
+	for _, item := range seg.members {
+		if item.success {
+			continue
+		}
+		_, err = io.CopyN(io.Discard, content, item.offset-pos)
+		if err != nil {
+			return fmt.Errorf("failed to download segment: %s error: %v", seg.key, err)
+		}
+
+		file := &io.LimitedReader{R: content, N: item.size}
+		err = writeRestoredFile(appConfig, item, file, item.hash)
+		if err != nil {
+			failed++
+			appConfig.Logger().Debugw("failed to restore packed file", "key", seg.key, "name", item.name, "err", err, "meta", domain.Aws)
+		} else {
+			item.success = true
+		}
+
+		//whatever of the file was not read is skipped so the next one is found where expected
+		_, err = io.Copy(io.Discard, file)
+		if err != nil {
+			return fmt.Errorf("failed to download segment: %s error: %v", seg.key, err)
+		}
+		pos = item.offset + item.size
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packed files failed to restore from segment: %s", failed, len(seg.members), seg.key)
+	}
+	return nil
+}
+
+//writes a file's content into a temp file, checks its MD5 against expected and only then moves it into place
+func writeRestoredFile(appConfig domain.Config, item *restoreItem, content io.Reader, expected string) error {
+	rel, err := keyToRestorePath(item.name)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(appConfig.RestoreTarget(), rel)
+	within, err := filepath.Rel(appConfig.RestoreTarget(), dest)
+	if err != nil || within != rel {
+		return fmt.Errorf("unable to restore object with key: %s outside of the restore target", item.name)
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0775)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), restoreTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) //no-op once the file has been renamed into place
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), content)
+	closeErr := tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to download object: %s error: %w", item.key, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close restored file: %s error: %v", tmpName, closeErr)
+	}
+
+	//never leave a file behind that does not match what was backed up
+	actual := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if expected == "" {
+		appConfig.Logger().Warnw("no stored MD5 for object. Restored without verification", "key", item.key, "meta", domain.Hash)
+	} else if expected != actual {
+		return fmt.Errorf("MD5 mismatch for object: %s expected: %s actual: %s", item.key, expected, actual)
+	}
+
+	err = os.Rename(tmpName, dest)
+	if err != nil {
+		return err
+	}
+	if !item.modTime.IsZero() {
+		err = os.Chtimes(dest, item.modTime, item.modTime)
+		if err != nil {
+			appConfig.Logger().Warnw("unable to set modification time of restored file", "path", dest, "err", err, "meta", domain.Chat)
+		}
+	}
+	return nil
+}
+
+//reverses domain.KeyForRecordedPath into a path relative to the restore target. The drive letter becomes the top
+//directory (eg the key E:/foo/bar restores to <target>/E/foo/bar) as does UNC for UNC paths. POSIX paths keep their
+//layout below the target (eg home/foo restores to <target>/home/foo)
+func keyToRestorePath(key string) (string, error) {
+	elements := strings.Split(key, "/")
+	if windowsDriveElementRegex.MatchString(elements[0]) {
+		elements[0] = strings.TrimSuffix(elements[0], ":")
+	}
+	for _, e := range elements {
+		if !isLocalElement(e) {
+			return "", fmt.Errorf("unable to restore object with key: %s", key)
+		}
+	}
+	return filepath.Join(elements...), nil
+}
+
+//a drive element of a key, eg E:
+var windowsDriveElementRegex = regexp.MustCompile(`^[A-Za-z]:$`)
+
+//names Windows keeps for devices in every directory, whatever the extension
+var windowsReservedNameRegex = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9]|LPT[0-9])(\..*)?$`)
+
+//reports whether a single element of a key names an entry within its directory on this OS. A backup recorded on
+//POSIX can hold names with backslashes or colons, which Windows would read as separators, drives or streams
+func isLocalElement(e string) bool {
+	if e == "" || e == "." || e == ".." || strings.ContainsAny(e, `/\:`) || strings.ContainsRune(e, 0) {
+		return false
+	}
+	if runtime.GOOS == "windows" && windowsReservedNameRegex.MatchString(strings.TrimRight(e, ". ")) {
+		return false
+	}
+	return true
+}
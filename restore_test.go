@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyToRestorePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{"drive path", "E:/Misc/foo", filepath.Join("E", "Misc", "foo"), false},
+		{"UNC path", "UNC/server/share/foo", filepath.Join("UNC", "server", "share", "foo"), false},
+		{"POSIX path", "home/foo", filepath.Join("home", "foo"), false},
+		{"POSIX name with spaces and dots", "home/my notes..txt", filepath.Join("home", "my notes..txt"), false},
+		{"empty key", "", "", true},
+		{"empty element", "home//foo", "", true},
+		{"dot element", "home/./foo", "", true},
+		{"parent element", "home/../../etc/passwd", "", true},
+		{"POSIX name with backslashes", `home/a\..\..\x`, "", true},
+		{"POSIX name with a colon", "home/a:b", "", true},
+		{"colon after the drive element", "E:/Misc/C:/foo", "", true},
+		{"drive element that is not a drive", "EE:/foo", "", true},
+		{"name with a NUL", "home/a\x00b", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keyToRestorePath(tt.key)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("keyToRestorePath(%q) = %q, %v, want %q, wantErr %t", tt.key, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteRestoredFile(t *testing.T) {
+	appConfig := &testConfig{restoreTarget: t.TempDir()}
+	content := []byte("restored content")
+	sum := md5.Sum(content)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+
+	err := writeRestoredFile(appConfig, &restoreItem{name: "home/me/a.txt"}, bytes.NewReader(content), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(appConfig.restoreTarget, "home", "me", "a.txt"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("restored file = %q, err = %v, want %q", got, err, content)
+	}
+
+	//content that does not match its MD5 leaves nothing behind
+	err = writeRestoredFile(appConfig, &restoreItem{name: "home/me/b.txt"}, bytes.NewReader([]byte("other")), hash)
+	if err == nil {
+		t.Errorf("writeRestoredFile() wrote content that does not match its MD5")
+	}
+	entries, _ := os.ReadDir(filepath.Join(appConfig.restoreTarget, "home", "me"))
+	if len(entries) != 1 {
+		t.Errorf("restore target holds %d entries, want only a.txt", len(entries))
+	}
+
+	err = writeRestoredFile(appConfig, &restoreItem{name: `home/a\..\..\..\x`}, bytes.NewReader(content), hash)
+	if err == nil {
+		t.Errorf("writeRestoredFile() restored a name that can leave the restore target")
+	}
+}
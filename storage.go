@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"backup/domain"
+)
+
+const (
+	dryrunSampleFileListLength = 25
+)
+
+//creates the storage backend selected by the config - a local directory if one is configured, otherwise AWS S3
+func newStorage(ctx context.Context, appConfig domain.Config) (domain.Storage, error) {
+	if appConfig.LocalDestination() != "" {
+		return newLocalStorage(appConfig.LocalDestination())
+	}
+	return newS3Storage(ctx, appConfig)
+}
+
+//routine to read files from channel and write them to storage, then pass them on, stored or not, to the out channel.
+//Files that were not hashed are never stored and once ctx is cancelled files are passed on without being stored. Files
+//existing finds already stored are passed on as stored. In repository mode repo stores each file's content only once.
+//Small files are packed into segments by packer and only passed on once their segment is stored. existing, repo and
+//packer may be nil
+func storeFilesInChannel(ctx context.Context, store domain.Storage, appConfig domain.Config, existing *existingObjects, repo *contentRepository, packer *segmentPacker, ch <-chan *domain.FileInfo, out chan<- *domain.FileInfo, wg *sync.WaitGroup) {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+	defer wg.Done()
+
+	//track file and storaged-related errors and shut down this routine if excessive errors occur
+	//this is just a quick failure in case there is a systemic problem somewhere - it allows
+	//the routine to give up under the assumption that a systemic issue will cause all other
+	//routines issues as well and there is no sense in continuing to try to open ~25-50K files
+	//under such circumstances
+	errCount := 0
+	maxAllowedErrors := appConfig.MaxStorageChannelErrorCount()
+
+	filesProcessed := 0
+	for fi := range ch {
+
+		filesProcessed++
+
+		//do not attempt to store files that have not been / were not successfully hashed
+		if !fi.HashSuccess {
+			logger.Infow("skipping un-hashed file", "path", fi.FullName, "meta", domain.Aws)
+			out <- fi
+			continue
+		}
+		if ctx.Err() != nil {
+			out <- fi
+			continue
+		}
+
+		//a packed file never has an object of its own, so there is nothing existing to find
+		packs := packer != nil && packer.packs(fi)
+
+		//a failed check is no reason not to store the file
+		if existing != nil && !packs {
+			found, err := existing.matches(ctx, fi)
+			if err != nil {
+				logger.Warnw("unable to check for existing object. Storing file", "path", fi.FullName, "err", err, "meta", domain.Aws)
+			} else if found {
+				logger.Debugw("skipping file already stored", "path", fi.FullName, "meta", domain.Aws)
+				fi.StorageSuccess = true
+				fi.Bucket = appConfig.Bucket()
+				fi.Key = objectKey(appConfig, fi)
+				out <- fi
+				continue
+			}
+		}
+
+		if packs {
+			full, err := packer.add(fi)
+			if err != nil {
+				errCount++
+				logger.Errorw("failed to pack file", "path", fi.FullName, "err", err, "meta", domain.Err)
+				fi.StorageSuccess = false
+				out <- fi
+			} else if full != nil && packer.storeSegment(ctx, full, out) != nil {
+				errCount++
+			}
+			if errCount > maxAllowedErrors {
+				logger.Errorw("storage routine exceeded max error count. Shutting it down", "maxAllowedErrors", maxAllowedErrors, "meta", domain.Aws)
+				break
+			}
+			continue
+		}
+
+		var err error
+		if repo != nil {
+			err = repo.storeFile(ctx, fi)
+		} else {
+			err = storeFile(ctx, store, appConfig, fi)
+		}
+		if err != nil {
+			errCount++
+			logger.Errorw("failed to store file", "path", fi.FullName, "err", err, "meta", domain.Err)
+			fi.StorageSuccess = false
+		} else {
+			fi.StorageSuccess = true
+		}
+		out <- fi
+
+		//exit on excessive errors
+		if errCount > maxAllowedErrors {
+			logger.Errorw("storage routine exceeded max error count. Shutting it down", "maxAllowedErrors", maxAllowedErrors, "meta", domain.Aws)
+			break
+		}
+
+		//note each 100 files this routine handles
+		if filesProcessed == 100 {
+			logger.Debugw("a storage routine has processed 100 files", "meta", domain.Chat)
+			filesProcessed = 0
+		}
+
+	}
+
+	//the last routine to finish stores whatever was packed since the last full segment
+	if packer != nil {
+		if last := packer.finish(); last != nil {
+			packer.storeSegment(ctx, last, out)
+		}
+	}
+
+}
+
+//stores a single file, compressing and encrypting it first if configured. On success the file's bucket and key are set
+func storeFile(ctx context.Context, store domain.Storage, appConfig domain.Config, fi *domain.FileInfo) error {
+	logger := appConfig.Logger()
+	filename := fi.FullName
+
+	//open the file
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for storage: %v", err)
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			logger.Warnw("failed to close file after storing", "path", filename, "meta", domain.Aws)
+		}
+	}()
+
+	//prep the call to storage
+	body, size := f, fi.Size
+	req := &domain.PutObjectRequest{
+		Container:    appConfig.Bucket(),
+		Key:          objectKey(appConfig, fi),
+		Body:         body,
+		ContentMD5:   fi.Hash,
+		Metadata:     map[string]string{domain.MetadataMD5: fi.Hash},
+		StorageClass: storageClassFor(appConfig, fi),
+	}
+
+	//when compressing, what we store (or encrypt) is the compressed temp file
+	compressed, compressedSize, err := compressRequest(appConfig, req, f, fi.Size, filename)
+	if err != nil {
+		return err
+	}
+	if compressed != nil {
+		defer removeTempFile(compressed)
+		body, size = compressed, compressedSize
+	}
+
+	//when encrypting, what we store is the encrypted temp file
+	if keyring := appConfig.Keyring(); keyring != nil {
+		encrypted, encryptedSize, err := encryptRequest(keyring, req, body, fi.Size)
+		if err != nil {
+			return err
+		}
+		defer removeTempFile(encrypted)
+		body, size = encrypted, encryptedSize
+	}
+
+	//large files are sent in parts so a failure only resends a part - and so they may exceed the 5GB PutObject limit
+	if size >= appConfig.MultipartThreshold() {
+		err = putMultipartObject(ctx, store, appConfig, req, body, size)
+	} else {
+		err = putObjectWithRetry(ctx, store, appConfig, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	fi.Bucket = req.Container
+	fi.Key = req.Key
+	return nil
+}
+
+//switches a request over to the encrypted content of src, whose original content (before any compression) holds size
+//bytes. The metadata keeps the original MD5 and size for restore and verify while ContentMD5 switches to the hash of the
+//encrypted content. Returns the encrypted temp file, which the caller must remove, and its size
+func encryptRequest(keyring *domain.Keyring, req *domain.PutObjectRequest, src io.Reader, size int64) (*os.File, int64, error) {
+	encrypted, encryptedMD5, encryptionMetadata, err := encryptToTempFile(keyring, src)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encrypt file: %v", err)
+	}
+	encryptedInfo, err := encrypted.Stat()
+	if err != nil {
+		removeTempFile(encrypted)
+		return nil, 0, fmt.Errorf("failed to stat encrypted file: %v", err)
+	}
+
+	req.Body = encrypted
+	req.ContentMD5 = encryptedMD5
+	for k, v := range encryptionMetadata {
+		req.Metadata[k] = v
+	}
+	req.Metadata[domain.MetadataSize] = strconv.FormatInt(size, 10)
+	return encrypted, encryptedInfo.Size(), nil
+}
+
+//returns the key a file is stored under - its path as a key, below this run's prefix if there is one. In repository
+//mode it is the key of the file's content, or of its chunk list if it is chunked, instead
+func objectKey(appConfig domain.Config, fi *domain.FileInfo) string {
+	if appConfig.Repository() && isChunked(appConfig, fi) {
+		return domain.ChunkListKey(domain.ContentName(appConfig.Keyring(), fi.ContentHash))
+	}
+	if appConfig.Repository() {
+		return domain.ContentKey(domain.ContentName(appConfig.Keyring(), fi.ContentHash))
+	}
+	return appConfig.Prefix() + domain.KeyForPath(fi.FullName)
+}
+
+//picks a file's storage class from the storage class rules. The first rule that matches wins and a file no rule
+//matches is left to the bucket's default, STANDARD
+func storageClassFor(appConfig domain.Config, fi *domain.FileInfo) string {
+	for _, rule := range appConfig.StorageClassRules() {
+		if rule.Matches(fi.FullName, fi.Size) {
+			appConfig.Logger().Debugw("storage class rule applies", "path", fi.FullName, "ruleId", rule.Id, "storageClass", rule.StorageClass, "meta", domain.Aws)
+			return rule.StorageClass
+		}
+	}
+	return ""
+}
+
+//sends an object to storage, retrying a few times using a 2^n exponential backoff where n is
+//the number of failures that have happened for this object
+func putObjectWithRetry(ctx context.Context, store domain.Storage, appConfig domain.Config, req *domain.PutObjectRequest) error {
+	logger := appConfig.Logger()
+
+	storageErrorCount := 0
+	var storageErr error
+	allowedStorageAttempts := appConfig.StorageRetryCount()
+	if allowedStorageAttempts <= 0 {
+		allowedStorageAttempts = 1
+	}
+
+	//while we have not hit our max error threshold, attempt a send to storage
+	for storageErrorCount < allowedStorageAttempts {
+
+		//send to storage
+		storageErr = store.PutObject(ctx, req)
+
+		//storage error
+		if storageErr != nil {
+
+			//increase failure count
+			storageErrorCount++
+			logger.Debugw("putObject attempt failed", "key", req.Key, "failCount", storageErrorCount, "meta", domain.Aws)
+
+			//give up & leave retry loop - no sense in mucking about with retries, we have failed or been cancelled
+			if storageErrorCount >= allowedStorageAttempts || ctx.Err() != nil {
+				break
+			}
+
+			//a retry is possible - calculate a backoff delay
+			backoffDuration, err := calcBackoff(storageErrorCount)
+			if err != nil { //failed to parse the duration - should not happen, right? Right?
+				logger.Errorw("unable to calculate backoff duration", "err", err, "meta", domain.Err)
+			} else {
+				retryPause(ctx, backoffDuration) //sleep this thread and retry
+			}
+
+			//move back to head of the body so the retry sends all of it
+			_, err = req.Body.Seek(0, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("failed to rewind object: %s for retry: %v", req.Key, err)
+			}
+		} else { //storage success, leave the retry loop
+			break
+		}
+	}
+
+	if storageErr != nil {
+		return fmt.Errorf("failed to store object after exhausting retries: %v", storageErr)
+	}
+	return nil
+}
+
+//determines the base64 MD5 of the original file held by an object. Prefers the hash we already know, then the hash
+//stored in the object's metadata and finally the ETag, which is the hex MD5 for objects stored with a single
+//unencrypted PutObject
+func storedHash(known string, info *domain.ObjectInfo) string {
+	if known != "" {
+		return known
+	}
+	if info == nil {
+		return ""
+	}
+	if stored := info.Metadata[domain.MetadataMD5]; stored != "" {
+		return stored
+	}
+	if info.Metadata[domain.MetadataEncryption] == "" && len(info.ETag) == hex.EncodedLen(md5.Size) {
+		sum, err := hex.DecodeString(info.ETag)
+		if err == nil {
+			return base64.StdEncoding.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
+//determines the size of the original file held by an object - encrypted objects are larger than their file
+func storedSize(info *domain.ObjectInfo) int64 {
+	if raw := info.Metadata[domain.MetadataSize]; raw != "" {
+		size, err := strconv.ParseInt(raw, 10, 64)
+		if err == nil {
+			return size
+		}
+	}
+	return info.Size
+}
+
+//manages a dryrun from a storage perspective
+func handleDryrun(ctx context.Context, store domain.Storage, appConfig domain.Config, objectsList []*domain.FileInfo) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	logger.Infow("beginning storage dryrun...", "storage", store.Name(), "meta", domain.Chat)
+
+	var sb strings.Builder
+
+	//config dump
+	sb.WriteString("\n")
+	sb.WriteString("Current Configuration\n")
+	sb.WriteString("---------------------\n")
+	sb.WriteString(appConfig.String())
+
+	//Try to contact storage and get a bucket list
+	containers, err := store.ListContainers(ctx)
+	if err != nil {
+		return fmt.Errorf("dryrun Error: unable to list %s buckets: %v", store.Name(), err)
+	}
+
+	found := false
+	sb.WriteString("\n")
+	sb.WriteString("Bucket Listing\n")
+	sb.WriteString("---------------------\n")
+	for _, name := range containers {
+		sb.WriteString(fmt.Sprintf("  %s\n", name))
+		if name == appConfig.DryrunBucket() {
+			found = true
+		}
+	}
+
+	//note the existance of the dryrun bucket
+	sb.WriteString("Successfully located dryrun bucket: ")
+	if found {
+		sb.WriteString("true\n")
+	} else {
+		sb.WriteString("false\n")
+		return fmt.Errorf("dryrun Error: unable to locate dryrun bucket: %s", appConfig.DryrunBucket())
+	}
+
+	//print out a selection of the files to be transferred
+	sb.WriteString("\n")
+	sampleLength := dryrunSampleFileListLength
+	if len(objectsList) < sampleLength {
+		sampleLength = len(objectsList)
+	}
+	sb.WriteString(fmt.Sprintf("Sample File List [%d of %d total files]\n", sampleLength, len(objectsList)))
+	sb.WriteString("---------------------------------------\n")
+	for i := 0; i < sampleLength; i++ {
+		if class := storageClassFor(appConfig, objectsList[i]); class != "" {
+			sb.WriteString(fmt.Sprintf("  %s [%s]\n", objectsList[i].FullName, class))
+		} else {
+			sb.WriteString(fmt.Sprintf("  %s\n", objectsList[i].FullName))
+		}
+	}
+
+	fmt.Println(sb.String())
+
+	logger.Infow("storage dryrun complete", "meta", domain.Chat)
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"backup/domain"
+
+	"go.uber.org/zap"
+)
+
+//testConfig supplies the few settings the code under test reads. Any other method panics
+type testConfig struct {
+	domain.Config
+	retryCount        int
+	bucket            string
+	prefix            string
+	packThreshold     int64
+	packSegmentSize   int64
+	storageRoutines   int
+	compression       string
+	keyring           *domain.Keyring
+	storageClassRules []*domain.StorageClassRule
+	restoreTarget     string
+}
+
+func (c *testConfig) Logger() *zap.SugaredLogger {
+	return zap.NewNop().Sugar()
+}
+
+func (c *testConfig) StorageRetryCount() int {
+	return c.retryCount
+}
+
+func (c *testConfig) Bucket() string {
+	return c.bucket
+}
+
+func (c *testConfig) Prefix() string {
+	return c.prefix
+}
+
+func (c *testConfig) PackThreshold() int64 {
+	return c.packThreshold
+}
+
+func (c *testConfig) PackSegmentSize() int64 {
+	return c.packSegmentSize
+}
+
+func (c *testConfig) StorageRoutinesCount() int {
+	return c.storageRoutines
+}
+
+func (c *testConfig) MultipartThreshold() int64 {
+	return 1 << 40
+}
+
+func (c *testConfig) Compression() string {
+	return c.compression
+}
+
+func (c *testConfig) Keyring() *domain.Keyring {
+	return c.keyring
+}
+
+func (c *testConfig) StorageClassRules() []*domain.StorageClassRule {
+	return c.storageClassRules
+}
+
+func (c *testConfig) RestoreTarget() string {
+	return c.restoreTarget
+}
+
+//replaces the pause between retries for the duration of a test, recording each pause instead of sleeping
+func recordRetryPauses(t *testing.T) *[]time.Duration {
+	pauses := make([]time.Duration, 0)
+	retryPause = func(ctx context.Context, d time.Duration) {
+		pauses = append(pauses, d)
+	}
+	t.Cleanup(func() {
+		retryPause = sleepWithContext
+	})
+	return &pauses
+}
+
+func TestPutObjectWithRetry(t *testing.T) {
+	content := []byte("the quick brown fox")
+	sum := md5.Sum(content)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		retryCount  int
+		putFailures int
+		contentMD5  string
+		cancelled   bool
+		wantErr     bool
+		wantPuts    int
+		wantPauses  []time.Duration
+	}{
+		{"first attempt succeeds", 3, 0, contentMD5, false, false, 1, []time.Duration{}},
+		{"succeeds after failures", 3, 2, contentMD5, false, false, 3, []time.Duration{2 * time.Second, 4 * time.Second}},
+		{"retries exhausted", 3, 5, contentMD5, false, true, 3, []time.Duration{2 * time.Second, 4 * time.Second}},
+		{"retry count below one still tries once", 0, 1, contentMD5, false, true, 1, []time.Duration{}},
+		{"content that does not match its MD5 is never stored", 2, 0, "bm90IHRoZSBtZDU=", false, true, 2, []time.Duration{2 * time.Second}},
+		{"cancelled context stops retrying", 3, 5, contentMD5, true, true, 1, []time.Duration{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pauses := recordRetryPauses(t)
+			store := newMemStorage()
+			store.putFailures = tt.putFailures
+			err := store.CreateContainer(context.Background(), "bucket")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+
+			//the failed attempts read the body, so a retry only stores the whole content if the body is rewound
+			req := &domain.PutObjectRequest{Container: "bucket", Key: "a/b", Body: bytes.NewReader(content), ContentMD5: tt.contentMD5}
+			err = putObjectWithRetry(ctx, store, &testConfig{retryCount: tt.retryCount}, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("putObjectWithRetry() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if store.puts != tt.wantPuts {
+				t.Errorf("putObjectWithRetry() made %d attempts, want %d", store.puts, tt.wantPuts)
+			}
+			if !reflect.DeepEqual(*pauses, tt.wantPauses) {
+				t.Errorf("putObjectWithRetry() paused %v, want %v", *pauses, tt.wantPauses)
+			}
+
+			body, _, err := store.GetObject(context.Background(), "bucket", "a/b")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("object stored although putObjectWithRetry() failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := io.ReadAll(body)
+			if !bytes.Equal(stored, content) {
+				t.Errorf("stored %q, want %q", stored, content)
+			}
+		})
+	}
+}
+
+func TestCalcBackoff(t *testing.T) {
+	tests := []struct {
+		exponent int
+		want     time.Duration
+		wantErr  bool
+	}{
+		{-1, 0, true},
+		{1, 2 * time.Second, false},
+		{2, 4 * time.Second, false},
+		{4, 16 * time.Second, false},
+		{highestReasonableExponentThatWontOverflowInt32 + 1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := calcBackoff(tt.exponent)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("calcBackoff(%d) = %v, %v, want %v, wantErr %t", tt.exponent, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPutObjectWithRetryRewindsWithoutBackoff(t *testing.T) {
+	pauses := recordRetryPauses(t)
+	content := []byte("the quick brown fox")
+	sum := md5.Sum(content)
+	store := newMemStorage()
+	err := store.CreateContainer(context.Background(), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the last retry follows the first failure calcBackoff has no backoff for, so it is sent without a pause
+	failures := 1
+	for _, err := calcBackoff(failures); err == nil; _, err = calcBackoff(failures) {
+		failures++
+	}
+	store.putFailures = failures
+	req := &domain.PutObjectRequest{Container: "bucket", Key: "a/b", Body: bytes.NewReader(content), ContentMD5: base64.StdEncoding.EncodeToString(sum[:])}
+	err = putObjectWithRetry(context.Background(), store, &testConfig{retryCount: failures + 1}, req)
+	if err != nil {
+		t.Fatalf("putObjectWithRetry() error = %v", err)
+	}
+	if len(*pauses) != failures-1 {
+		t.Errorf("putObjectWithRetry() paused %d times, want %d", len(*pauses), failures-1)
+	}
+}
+
+//unseekableReader fails every seek
+type unseekableReader struct {
+	io.Reader
+}
+
+func (r *unseekableReader) Seek(offset int64, whence int) (int64, error) {
+	return 0, errInjected
+}
+
+func TestPutObjectWithRetryRewindFails(t *testing.T) {
+	recordRetryPauses(t)
+	store := newMemStorage()
+	store.putFailures = 1
+	err := store.CreateContainer(context.Background(), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &domain.PutObjectRequest{Container: "bucket", Key: "a/b", Body: &unseekableReader{Reader: bytes.NewReader([]byte("x"))}}
+	err = putObjectWithRetry(context.Background(), store, &testConfig{retryCount: 3}, req)
+	if err == nil || !strings.Contains(err.Error(), "rewind") {
+		t.Errorf("putObjectWithRetry() error = %v, want the rewind to fail", err)
+	}
+	if store.puts != 1 {
+		t.Errorf("putObjectWithRetry() made %d attempts after the rewind failed, want 1", store.puts)
+	}
+}
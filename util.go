@@ -2,12 +2,16 @@ package main
 
 import (
 	"backup/domain"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -15,13 +19,14 @@ const (
 	highestReasonableExponentThatWontOverflowInt32 = 46340
 )
 
-//create a base64-encoded string of the md5 hash of a file
-func hashFile(filename string) (string, error) {
+//create a base64-encoded string of the md5 hash of a file and, if asked for, a hex string of its sha256 hash. Both
+//come from a single read of the file
+func hashFile(filename string, withContentHash bool) (string, string, error) {
 
 	//open file
 	f, err := os.Open(filename)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file for hashing: %s with error %v", filename, err)
+		return "", "", fmt.Errorf("failed to open file for hashing: %s with error %v", filename, err)
 	}
 
 	//ensure closure
@@ -38,12 +43,21 @@ func hashFile(filename string) (string, error) {
 
 	//hash file to base64 encoded MD5 string
 	h := md5.New()
-	_, err = io.Copy(h, f)
+	var w io.Writer = h
+	sha := sha256.New()
+	if withContentHash {
+		w = io.MultiWriter(h, sha)
+	}
+	_, err = io.Copy(w, f)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy file for hashing: %s with error %v", filename, err)
+		return "", "", fmt.Errorf("failed to copy file for hashing: %s with error %v", filename, err)
 	}
 
-	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	contentHash := ""
+	if withContentHash {
+		contentHash = hex.EncodeToString(sha.Sum(nil))
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), contentHash, nil
 }
 
 //convert a duration to a reasonably-looking string
@@ -52,6 +66,21 @@ func prettyTime(delta time.Duration) string {
 	return delta.String()
 }
 
+//convert a byte count to a reasonably-looking string (eg 1.5 GB)
+func prettySize(size int64) string {
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
 //return a time.Duration that represents 2^(exponent) seconds
 func calcBackoff(exponent int) (time.Duration, error) {
 
@@ -75,6 +104,19 @@ func calcBackoff(exponent int) (time.Duration, error) {
 	return time.ParseDuration(exponentialRetryDelayString)
 }
 
+//pauses between storage retries. A variable so tests need not wait out the backoff
+var retryPause = sleepWithContext
+
+//sleeps for the duration or until ctx is cancelled, whichever comes first
+func sleepWithContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
 //write a json-formatted file containing failure information
 func writeFailureFile(appConfig domain.Config, failureInfo *domain.BackupFailures) error {
 
@@ -91,3 +133,15 @@ func writeFailureFile(appConfig domain.Config, failureInfo *domain.BackupFailure
 	}
 	return nil
 }
+
+//stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
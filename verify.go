@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"backup/domain"
+)
+
+//verifyPair couples a local file with the object expected to hold it
+type verifyPair struct {
+	file   *domain.FileInfo
+	bucket string
+	key    string
+
+	//packed is set true if the file was packed into the segment at key. offset and size then locate its content
+	packed bool
+	offset int64
+	size   int64
+
+	//head holds the object details, including metadata, once fetched
+	head *domain.ObjectInfo
+	err  error
+}
+
+//top-level function to audit a finished backup against the local tree and write a json report of differences
+func verifyBackup(appConfig domain.Config) error {
+	logger := appConfig.Logger()
+	defer logger.Sync()
+
+	ctx := context.Background()
+	runId := appConfig.RunId()
+
+	store, err := newStorage(ctx, appConfig)
+	if err != nil {
+		return err
+	}
+
+	//walk and hash the local tree exactly as a backup would
+	allObjectsList, err := buildFileList(appConfig)
+	if err != nil {
+		return fmt.Errorf("error when building file list: %v", err)
+	}
+	localFiles := displayFileStats(appConfig, allObjectsList)
+	hashAllFiles(appConfig, localFiles)
+
+	//an incremental run's manifest points unchanged files at earlier runs - honor that when it is available
+	locations := make(map[string]*domain.ManifestEntry)
+	manifest, err := loadRunManifest(ctx, store, appConfig, runId)
+	if err != nil {
+		return err
+	}
+	bucket, prefix := appConfig.LocateRun(runId)
+	if manifest != nil {
+		bucket, prefix = manifest.Bucket, manifest.Prefix
+		for _, e := range manifest.Entries {
+			locations[e.Path] = e
+		}
+	}
+
+	report := &domain.VerifyReport{
+		DateCreated:     time.Now().Format(time.RFC822),
+		RunId:           runId,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		MissingObjects:  make([]*domain.FileInfo, 0),
+		ExtraObjects:    make([]*domain.ObjectInfo, 0),
+		SizeMismatches:  make([]*domain.VerifyMismatch, 0),
+		HashMismatches:  make([]*domain.VerifyMismatch, 0),
+		UnverifiedFiles: make([]*domain.FileInfo, 0),
+	}
+
+	//list the run's own objects. Objects an incremental run left elsewhere (another bucket or another run's prefix in
+	//a fixed bucket) are checked individually instead so shared buckets are never listed in full
+	objects, err := store.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return fmt.Errorf("unable to list bucket: %s error: %v", bucket, err)
+	}
+	listed := make(map[string]*domain.ObjectInfo, len(objects))
+	for _, o := range objects {
+		if !strings.HasPrefix(strings.TrimPrefix(o.Key, prefix), domain.ReservedKeyPrefix) {
+			listed[o.Key] = o
+		}
+	}
+	logger.Infow("listed bucket", "bucket", bucket, "prefix", prefix, "objectCount", len(listed), "meta", domain.Stat)
+
+	//match each local file to its object
+	matched := make(map[string]bool)
+	pairs := make([]*verifyPair, 0, len(localFiles))
+	for _, fi := range localFiles {
+		objectBucket, key := bucket, prefix+domain.KeyForPath(fi.FullName)
+		var packed bool
+		var offset, size int64
+		if e, found := locations[fi.FullName]; found {
+			objectBucket, key = e.Bucket, e.Key
+			packed, offset, size = e.Packed, e.Offset, e.Size
+		}
+
+		//segments are never listed with the run's objects - a packed file is checked when its segment is read
+		if !packed && objectBucket == bucket && strings.HasPrefix(key, prefix) {
+			if _, found := listed[key]; !found {
+				report.MissingObjects = append(report.MissingObjects, fi.Copy())
+				continue
+			}
+			matched[key] = true
+		}
+		if !fi.HashSuccess {
+			report.UnverifiedFiles = append(report.UnverifiedFiles, fi.Copy())
+			continue
+		}
+		pairs = append(pairs, &verifyPair{file: fi, bucket: objectBucket, key: key, packed: packed, offset: offset, size: size})
+	}
+
+	//anything left in the run's listing has no local counterpart
+	for key, o := range listed {
+		if !matched[key] {
+			report.ExtraObjects = append(report.ExtraObjects, o)
+		}
+	}
+
+	//fetch the details of each matched object - listings do not carry the metadata holding the original MD5
+	headAllObjects(ctx, store, appConfig, pairs)
+
+	for _, p := range pairs {
+		if errors.Is(p.err, domain.ErrObjectNotFound) {
+			report.MissingObjects = append(report.MissingObjects, p.file.Copy())
+			continue
+		}
+		if errors.Is(p.err, domain.ErrObjectArchived) {
+			logger.Warnw("object is archived and cannot be read until it is restored in S3 (RestoreObject)", "bucket", p.bucket, "key", p.key, "meta", domain.Err)
+			report.UnverifiedFiles = append(report.UnverifiedFiles, p.file.Copy())
+			continue
+		}
+		if p.err != nil {
+			logger.Errorw("unable to examine stored object", "bucket", p.bucket, "key", p.key, "err", p.err, "meta", domain.Err)
+			report.UnverifiedFiles = append(report.UnverifiedFiles, p.file.Copy())
+			continue
+		}
+
+		mismatch := &domain.VerifyMismatch{
+			Path:       p.file.FullName,
+			Bucket:     p.bucket,
+			Key:        p.key,
+			LocalSize:  p.file.Size,
+			StoredSize: storedSize(p.head),
+			LocalHash:  p.file.Hash,
+			StoredHash: storedHash("", p.head),
+		}
+		if mismatch.LocalSize != mismatch.StoredSize {
+			report.SizeMismatches = append(report.SizeMismatches, mismatch)
+		}
+		if mismatch.LocalHash != mismatch.StoredHash {
+			report.HashMismatches = append(report.HashMismatches, mismatch)
+		}
+	}
+
+	problems := len(report.MissingObjects) + len(report.ExtraObjects) + len(report.SizeMismatches) +
+		len(report.HashMismatches) + len(report.UnverifiedFiles)
+	report.HasProblems = problems > 0
+
+	logger.Infow("number of objects verified", "count", len(pairs), "meta", domain.Stat)
+	logger.Infow("number of missing objects", "count", len(report.MissingObjects), "meta", domain.Stat)
+	logger.Infow("number of extra objects", "count", len(report.ExtraObjects), "meta", domain.Stat)
+	logger.Infow("number of size mismatches", "count", len(report.SizeMismatches), "meta", domain.Stat)
+	logger.Infow("number of hash mismatches", "count", len(report.HashMismatches), "meta", domain.Stat)
+	logger.Infow("number of unverified files", "count", len(report.UnverifiedFiles), "meta", domain.Stat)
+
+	err = writeVerifyReport(appConfig, report)
+	if err != nil {
+		return err
+	}
+	logger.Infow("verify report written", "path", appConfig.VerifyFilepath(), "meta", domain.Chat)
+
+	if report.HasProblems {
+		return fmt.Errorf("verify found %d problems. See: %s", problems, appConfig.VerifyFilepath())
+	}
+	return nil
+}
+
+//fetches the details of every paired object using the storage routine count for parallelism. Packed files are read
+//from their segments instead, fetching each segment once
+func headAllObjects(ctx context.Context, store domain.Storage, appConfig domain.Config, pairs []*verifyPair) {
+	jobs := make([][]*verifyPair, 0, len(pairs))
+	segments := make(map[string]int)
+	for _, p := range pairs {
+		if !p.packed {
+			jobs = append(jobs, []*verifyPair{p})
+			continue
+		}
+		id := p.bucket + "/" + p.key
+		i, found := segments[id]
+		if !found {
+			i = len(jobs)
+			segments[id] = i
+			jobs = append(jobs, make([]*verifyPair, 0))
+		}
+		jobs[i] = append(jobs[i], p)
+	}
+
+	channel := make(chan []*verifyPair, len(jobs))
+	for _, job := range jobs {
+		channel <- job
+	}
+	close(channel)
+
+	var wg sync.WaitGroup
+	for i := 0; i < appConfig.StorageRoutinesCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range channel {
+				if job[0].packed {
+					readPackedFiles(ctx, store, appConfig, job)
+					continue
+				}
+				p := job[0]
+				p.head, p.err = store.HeadObject(ctx, p.bucket, p.key)
+				if p.err == nil && p.head.Metadata[domain.MetadataChunks] != "" {
+					headChunks(ctx, store, appConfig, p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+//checks every chunk of a chunked file is stored with the size its chunk list gives, as the chunk list's own details
+//say nothing of its chunks. The pair's size becomes that of the chunks together and a missing chunk makes the file
+//missing
+func headChunks(ctx context.Context, store domain.Storage, appConfig domain.Config, p *verifyPair) {
+	logger := appConfig.Logger()
+
+	list, err := fetchChunkList(ctx, store, p.bucket, p.key)
+	if err != nil {
+		p.err = err
+		return
+	}
+	if list == nil {
+		p.err = domain.ErrObjectNotFound
+		return
+	}
+
+	var size int64
+	for _, ref := range list.Chunks {
+		key := domain.ContentKey(ref.Hash)
+		info, err := store.HeadObject(ctx, p.bucket, key)
+		if errors.Is(err, domain.ErrObjectNotFound) {
+			logger.Warnw("chunk of chunked file is missing", "path", p.file.FullName, "key", key, "meta", domain.Hash)
+			p.err = err
+			return
+		}
+		if err != nil {
+			p.err = fmt.Errorf("unable to examine chunk: %s error: %v", key, err)
+			return
+		}
+		if storedSize(info) != ref.Size {
+			logger.Warnw("chunk of chunked file has the wrong size", "path", p.file.FullName, "key", key, "expectedSize", ref.Size, "actualSize", storedSize(info), "meta", domain.Hash)
+		}
+		size += storedSize(info)
+	}
+	p.head = &domain.ObjectInfo{
+		Key:      p.key,
+		Size:     size,
+		Metadata: map[string]string{domain.MetadataMD5: storedHash("", p.head)},
+	}
+}
+
+//reads the packed files of a single segment, giving each pair the size and MD5 of its content in place of the
+//details a stored object would have
+func readPackedFiles(ctx context.Context, store domain.Storage, appConfig domain.Config, pairs []*verifyPair) {
+	fail := func(err error) {
+		for _, p := range pairs {
+			if p.head == nil {
+				p.err = err
+			}
+		}
+	}
+
+	body, info, err := store.GetObject(ctx, pairs[0].bucket, pairs[0].key)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer body.Close()
+
+	content, err := decodeContent(appConfig, body, info.Metadata)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	//the segment is read once, front to back
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].offset < pairs[j].offset
+	})
+	var pos int64
+	for _, p := range pairs {
+		_, err = io.CopyN(io.Discard, content, p.offset-pos)
+		if err != nil {
+			fail(fmt.Errorf("failed to read segment: %s error: %v", p.key, err))
+			return
+		}
+
+		//a segment ending early leaves the file short, which shows as a mismatch
+		h := md5.New()
+		n, err := io.CopyN(h, content, p.size)
+		if err != nil && err != io.EOF {
+			fail(fmt.Errorf("failed to read segment: %s error: %v", p.key, err))
+			return
+		}
+		p.head = &domain.ObjectInfo{
+			Key:      p.key,
+			Size:     n,
+			Metadata: map[string]string{domain.MetadataMD5: base64.StdEncoding.EncodeToString(h.Sum(nil))},
+		}
+		pos = p.offset + n
+	}
+}
+
+//write a json-formatted file containing the verify report
+func writeVerifyReport(appConfig domain.Config, report *domain.VerifyReport) error {
+
+	//create indented json for easy human readability
+	jsonBytes, err := json.MarshalIndent(report, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal verify report json structure: %v", err)
+	}
+
+	err = os.WriteFile(appConfig.VerifyFilepath(), jsonBytes, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to write verify report file: %s err: %v", appConfig.VerifyFilepath(), err)
+	}
+	return nil
+}
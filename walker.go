@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,11 +12,24 @@ import (
 
 //walks each path in each directory to be archived and builds a list of files that need to be backed up
 func buildFileList(appConfig domain.Config) ([]*domain.FileInfo, error) {
+	allInfo := make([]*domain.FileInfo, 0, appConfig.FileCountEstimate())
+
+	err := walkBasePaths(context.Background(), appConfig, func(fi *domain.FileInfo) {
+		allInfo = append(allInfo, fi)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return allInfo, nil
+}
+
+//walks each path in each directory to be archived and hands every file and directory found - excluded or not - to
+//emit as soon as it is found. Stops early if ctx is cancelled
+func walkBasePaths(ctx context.Context, appConfig domain.Config, emit func(*domain.FileInfo)) error {
 	logger := appConfig.Logger()
 	defer logger.Sync()
 
-	allInfo := make([]*domain.FileInfo, 0, appConfig.FileCountEstimate())
-
 	//for each top-level path
 	for _, pth := range appConfig.BasePaths() {
 
@@ -31,10 +44,16 @@ func buildFileList(appConfig domain.Config) ([]*domain.FileInfo, error) {
 					return err
 				}
 
+				//the backup was abandoned - stop walking
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
 				//build struct about this file/dir - assume it is excluded
 				newFileData := &domain.FileInfo{
 					FullName: path,
 					Size:     info.Size(),
+					ModTime:  info.ModTime(),
 					Excluded: true,
 				}
 
@@ -45,32 +64,32 @@ func buildFileList(appConfig domain.Config) ([]*domain.FileInfo, error) {
 				//the file walker should not descend into the directory's children while a return of nil indicates that
 				//the walker should continue processing children
 				if info.IsDir() && skipThisObject(appConfig, path, info) {
-					allInfo = append(allInfo, newFileData)
+					emit(newFileData)
 					return filepath.SkipDir //do not process this directory (or its children) further
 				} else if skipThisObject(appConfig, path, info) {
-					allInfo = append(allInfo, newFileData)
+					emit(newFileData)
 					return nil //not interested in this file
 				}
 
 				//this is a dir we are interested in, but since it isn't a file, just continue
 				//(and by continue I mean descend into this dir)
 				if info.IsDir() {
-					allInfo = append(allInfo, newFileData)
+					emit(newFileData)
 					return nil
 				}
 
 				//we want this file, add it to the list
 				newFileData.Excluded = false
-				allInfo = append(allInfo, newFileData)
+				emit(newFileData)
 				return nil
 			})
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return allInfo, nil
+	return nil
 }
 
 //determines if any object (file) should be excluded from the backup because of a rule
@@ -84,9 +103,11 @@ func skipThisObject(appConfig domain.Config, path string, info os.FileInfo) bool
 		return true
 	}
 
-	//test each regex rule in the exclusions list and if one applies, return false
+	//test each regex rule in the exclusions list and if one applies, return false. Rules may be written against the
+	//native path or its forward slash form
+	normalized := domain.NormalizePath(path)
 	for _, exclusion := range appConfig.Exclusions() {
-		if exclusion.Regex.MatchString(path) {
+		if exclusion.Regex.MatchString(path) || exclusion.Regex.MatchString(normalized) {
 			logger.Debugw("rule exclusion", "path", path, "isDir", info.IsDir(), "rule id", exclusion.Id, "meta", domain.Exclude)
 			return true
 		}
@@ -95,25 +116,18 @@ func skipThisObject(appConfig domain.Config, path string, info os.FileInfo) bool
 	return false
 }
 
-//reprocesses a JSON file listing files that failed to transfer on the last run
-func buildReprocessingList(appConfig domain.Config) ([]*domain.FileInfo, error) {
+//reprocesses a JSON file listing files that failed to transfer on the last run. Also returns the failures as read
+func buildReprocessingList(appConfig domain.Config) ([]*domain.FileInfo, *domain.BackupFailures, error) {
 
 	//read JSON file
-	jsonBytes, err := os.ReadFile(appConfig.FailuresFilepath())
-	if err != nil {
-		return nil, fmt.Errorf("unable to read JSON failures file: %s because: %v", appConfig.FailuresFilepath(), err)
-	}
-
-	//unmarshall
-	var failures domain.BackupFailures
-	err = json.Unmarshal(jsonBytes, &failures)
+	failures, err := domain.ReadFailureFile(appConfig.FailuresFilepath())
 	if err != nil {
-		return nil, fmt.Errorf("unable to unmarshal JSON failures file: %s because: %v", appConfig.FailuresFilepath(), err)
+		return nil, nil, err
 	}
 
 	//no work to do
 	if !failures.HasFailures {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	//get confirmation unless bypassed by CLI opts
@@ -144,7 +158,7 @@ func buildReprocessingList(appConfig domain.Config) ([]*domain.FileInfo, error)
 				runMenu = false
 				continue
 			case 3:
-				return nil, nil
+				return nil, nil, nil
 			default:
 				continue
 			}
@@ -165,11 +179,12 @@ func buildReprocessingList(appConfig domain.Config) ([]*domain.FileInfo, error)
 
 		fileInfo, err := os.Stat(f.FullName)
 		if err != nil {
-			return nil, fmt.Errorf("unable to stat file: %s because: %v", f.FullName, err)
+			return nil, nil, fmt.Errorf("unable to stat file: %s because: %v", f.FullName, err)
 		}
 		fi.Size = fileInfo.Size()
+		fi.ModTime = fileInfo.ModTime()
 		fileData = append(fileData, fi)
 	}
 
-	return fileData, nil
+	return fileData, failures, nil
 }